@@ -0,0 +1,303 @@
+package blocklist
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OdyseeTeam/mirage/internal/imagehash"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+CREATE TABLE `blocklist` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `kind` varchar(16) NOT NULL,
+  `value` varchar(700) NOT NULL,
+  `reason` text NOT NULL,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `blocklist_kind_value_index` (`kind`, `value`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4
+*/
+
+// Kind is what a blocklist entry matches on
+type Kind string
+
+const (
+	// KindURL matches a source url exactly
+	KindURL Kind = "url"
+	// KindHost matches every source url served by a host
+	KindHost Kind = "host"
+	// KindSHA256 matches sources by the SHA-256 of their bytes, wherever they are served from
+	KindSHA256 Kind = "sha256"
+	// KindPHash matches sources whose perceptual hash is close enough to the entry's
+	KindPHash Kind = "phash"
+)
+
+// Entry is a single blocked url, host or content hash
+type Entry struct {
+	Kind      Kind      `json:"kind"`
+	Value     string    `json:"value"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// BlockedError is returned when a source matches a blocklist entry
+type BlockedError struct {
+	Entry Entry
+}
+
+func (e *BlockedError) Error() string {
+	return fmt.Sprintf("source is blocked (%s %s)", e.Entry.Kind, e.Entry.Value)
+}
+
+// Blocklist keeps an in-memory copy of the blocklist table, refreshed periodically so that entries
+// added on another instance eventually apply here too. A nil *Blocklist blocks nothing.
+type Blocklist struct {
+	dbConn        *sql.DB
+	phashDistance int
+	grp           *stop.Group
+
+	mu      sync.RWMutex
+	entries map[Kind]map[string]Entry
+}
+
+// Init connects to the database, loads the blocklist and refreshes it every refreshInterval.
+// Perceptual hashes within phashDistance bits of a phash entry are considered blocked.
+func Init(dsn string, phashDistance int, refreshInterval time.Duration) (*Blocklist, error) {
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	b := &Blocklist{
+		dbConn:        db,
+		phashDistance: phashDistance,
+		grp:           stop.New(),
+	}
+	err = b.Refresh()
+	if err != nil {
+		return nil, err
+	}
+	if refreshInterval > 0 {
+		b.grp.Add(1)
+		go b.refreshEvery(refreshInterval)
+	}
+	return b, nil
+}
+
+// NewMemory returns a blocklist that isn't backed by a database, for tests and tools running without one
+func NewMemory(phashDistance int) *Blocklist {
+	return &Blocklist{
+		phashDistance: phashDistance,
+		grp:           stop.New(),
+		entries:       make(map[Kind]map[string]Entry),
+	}
+}
+
+// Shutdown stops the periodic refresh
+func (b *Blocklist) Shutdown() {
+	b.grp.StopAndWait()
+}
+
+func (b *Blocklist) refreshEvery(interval time.Duration) {
+	defer b.grp.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.grp.Ch():
+			return
+		case <-ticker.C:
+			err := b.Refresh()
+			if err != nil {
+				logrus.Errorf("failed to refresh blocklist: %s", errors.FullTrace(err))
+			}
+		}
+	}
+}
+
+// Refresh reloads all the entries from the database
+func (b *Blocklist) Refresh() error {
+	if b.dbConn == nil {
+		return nil
+	}
+	rows, err := b.dbConn.Query("SELECT kind, value, reason, created_at FROM blocklist")
+	if err != nil {
+		return errors.Err(err)
+	}
+	defer func(rows *sql.Rows) {
+		_ = rows.Close()
+	}(rows)
+	entries := make(map[Kind]map[string]Entry)
+	for rows.Next() {
+		var e Entry
+		err = rows.Scan(&e.Kind, &e.Value, &e.Reason, &e.CreatedAt)
+		if err != nil {
+			return errors.Err(err)
+		}
+		if entries[e.Kind] == nil {
+			entries[e.Kind] = make(map[string]Entry)
+		}
+		entries[e.Kind][e.Value] = e
+	}
+	if err = rows.Err(); err != nil {
+		return errors.Err(err)
+	}
+	b.mu.Lock()
+	b.entries = entries
+	b.mu.Unlock()
+	return nil
+}
+
+// Normalize validates an entry and brings its value to the form it is matched in
+func Normalize(e Entry) (Entry, error) {
+	e.Value = strings.TrimSpace(e.Value)
+	if e.Value == "" {
+		return e, errors.Err("blocklist value is required")
+	}
+	switch e.Kind {
+	case KindURL:
+	case KindHost:
+		e.Value = strings.ToLower(e.Value)
+	case KindSHA256:
+		e.Value = strings.ToLower(e.Value)
+		if len(e.Value) != 64 {
+			return e, errors.Err("sha256 must be 64 hex characters")
+		}
+	case KindPHash:
+		h, err := imagehash.Parse(e.Value)
+		if err != nil || h == 0 {
+			return e, errors.Err("phash must be a non zero 64 bit hex value")
+		}
+		e.Value = h.String()
+	default:
+		return e, errors.Err("unknown blocklist kind %q", e.Kind)
+	}
+	return e, nil
+}
+
+// Add stores a new entry (or updates the reason of an existing one)
+func (b *Blocklist) Add(e Entry) (Entry, error) {
+	e, err := Normalize(e)
+	if err != nil {
+		return e, err
+	}
+	e.CreatedAt = time.Now().UTC()
+	if b.dbConn != nil {
+		query := `INSERT INTO blocklist (kind, value, reason, created_at) VALUES (?, ?, ?, ?)
+ON DUPLICATE KEY UPDATE reason=values(reason)`
+		_, err = b.dbConn.Exec(query, e.Kind, e.Value, e.Reason, e.CreatedAt)
+		if err != nil {
+			return e, errors.Err(err)
+		}
+	}
+	b.mu.Lock()
+	if b.entries[e.Kind] == nil {
+		b.entries[e.Kind] = make(map[string]Entry)
+	}
+	b.entries[e.Kind][e.Value] = e
+	b.mu.Unlock()
+	return e, nil
+}
+
+// Remove deletes an entry
+func (b *Blocklist) Remove(e Entry) error {
+	e, err := Normalize(e)
+	if err != nil {
+		return err
+	}
+	if b.dbConn != nil {
+		_, err = b.dbConn.Exec("DELETE FROM blocklist WHERE kind = ? AND value = ?", e.Kind, e.Value)
+		if err != nil {
+			return errors.Err(err)
+		}
+	}
+	b.mu.Lock()
+	delete(b.entries[e.Kind], e.Value)
+	b.mu.Unlock()
+	return nil
+}
+
+// List returns every entry
+func (b *Blocklist) List() []Entry {
+	list := make([]Entry, 0)
+	if b == nil {
+		return list
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, byValue := range b.entries {
+		for _, e := range byValue {
+			list = append(list, e)
+		}
+	}
+	return list
+}
+
+// PHashDistance is the maximum hamming distance for a phash entry to match
+func (b *Blocklist) PHashDistance() int {
+	return b.phashDistance
+}
+
+// MatchURL returns the entry blocking sourceURL, if any
+func (b *Blocklist) MatchURL(sourceURL string) *Entry {
+	if b == nil {
+		return nil
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if e, ok := b.entries[KindURL][sourceURL]; ok {
+		return &e
+	}
+	parsed, err := url.Parse(sourceURL)
+	if err != nil {
+		return nil
+	}
+	if e, ok := b.entries[KindHost][strings.ToLower(parsed.Hostname())]; ok {
+		return &e
+	}
+	return nil
+}
+
+// HasContentEntries reports whether any entry matches sources by their content rather than their url
+func (b *Blocklist) HasContentEntries() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.entries[KindSHA256]) > 0 || len(b.entries[KindPHash]) > 0
+}
+
+// MatchContent returns the entry blocking a source with the given fingerprint, if any. A zero phash is never matched.
+func (b *Blocklist) MatchContent(sourceSHA256 string, phash imagehash.Hash) *Entry {
+	if b == nil {
+		return nil
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if e, ok := b.entries[KindSHA256][sourceSHA256]; ok {
+		return &e
+	}
+	if phash == 0 {
+		return nil
+	}
+	for value, e := range b.entries[KindPHash] {
+		h, err := imagehash.Parse(value)
+		if err != nil {
+			continue
+		}
+		if h.Distance(phash) <= b.phashDistance {
+			return &e
+		}
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/OdyseeTeam/mirage/optimizer"
+
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	benchWidth      int64
+	benchHeight     int64
+	benchQuality    int64
+	benchIterations int
+	benchProcessors []string
+	benchJSON       bool
+)
+
+func init() {
+	benchCmd.Flags().Int64Var(&benchWidth, "width", 400, "output width, 0 keeps the aspect ratio")
+	benchCmd.Flags().Int64Var(&benchHeight, "height", 0, "output height, 0 keeps the aspect ratio")
+	benchCmd.Flags().Int64Var(&benchQuality, "quality", 85, "output quality")
+	benchCmd.Flags().IntVar(&benchIterations, "iterations", 3, "times each file is optimized per processor")
+	benchCmd.Flags().StringSliceVar(&benchProcessors, "processors", []string{optimizer.ProcessorGo, optimizer.ProcessorVips}, "processors to compare")
+	benchCmd.Flags().BoolVar(&benchJSON, "json", false, "print the results as JSON")
+	rootCmd.AddCommand(benchCmd)
+}
+
+// benchResult is how one processor did on the files of one format
+type benchResult struct {
+	Processor string `json:"processor"`
+	Format    string `json:"format"`
+	Files     int    `json:"files"`
+	Failed    int    `json:"failed"`
+	// MeanMs is the mean time of an optimization, Bytes the total size of the outputs
+	MeanMs float64 `json:"mean_ms"`
+	Bytes  int     `json:"bytes"`
+}
+
+var benchCmd = &cobra.Command{
+	Use:   "bench <directory>",
+	Short: "Compares the image processors on a local corpus",
+	Long: `Optimizes every image under the directory with each processor, as the server would for /optimize/,
+and reports per source format how long it took and how big the outputs are. Animations are converted without
+going through the processors, so they only show the noise of the measure.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		results, err := bench(args[0])
+		if err != nil {
+			logrus.Fatal(errors.FullTrace(err))
+		}
+		if benchJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			_ = enc.Encode(results)
+			return
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		_, _ = fmt.Fprintln(w, "format\tprocessor\tfiles\tfailed\tmean ms\tbytes")
+		for _, r := range results {
+			_, _ = fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%.1f\t%d\n", r.Format, r.Processor, r.Files, r.Failed, r.MeanMs, r.Bytes)
+		}
+		_ = w.Flush()
+	},
+}
+
+func bench(dir string) ([]benchResult, error) {
+	corpus := map[string][]string{}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		mime, err := mimetype.DetectFile(path)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(mime.String(), "image/") {
+			corpus[mime.String()] = append(corpus[mime.String()], path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	if len(corpus) == 0 {
+		return nil, errors.Err("no images under %s", dir)
+	}
+	formats := make([]string, 0, len(corpus))
+	for format := range corpus {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+
+	var results []benchResult
+	for _, processor := range benchProcessors {
+		o, err := optimizer.NewOptimizer(optimizer.Config{Processor: optimizer.ProcessorConfig{Default: processor}})
+		if err != nil {
+			return nil, err
+		}
+		for _, format := range formats {
+			result := benchResult{Processor: processor, Format: format}
+			var elapsed time.Duration
+			runs := 0
+			for _, path := range corpus[format] {
+				data, err := os.ReadFile(path)
+				if err != nil {
+					return nil, errors.Err(err)
+				}
+				result.Files++
+				opts := optimizer.Options{Quality: benchQuality, Width: benchWidth, Height: benchHeight}
+				for i := 0; i < benchIterations; i++ {
+					start := time.Now()
+					optimized, _, _, err := o.Optimize(data, opts)
+					if err != nil {
+						logrus.Debugf("%s failed on %s: %s", processor, path, err)
+						result.Failed++
+						break
+					}
+					elapsed += time.Since(start)
+					runs++
+					if i == 0 {
+						result.Bytes += len(optimized)
+					}
+				}
+			}
+			if runs > 0 {
+				result.MeanMs = float64(elapsed.Microseconds()) / 1000 / float64(runs)
+			}
+			results = append(results, result)
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Format < results[j].Format })
+	return results, nil
+}
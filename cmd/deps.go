@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/OdyseeTeam/mirage/blocklist"
+	"github.com/OdyseeTeam/mirage/metadata"
+	"github.com/OdyseeTeam/mirage/notifier"
+	"github.com/OdyseeTeam/mirage/optimizer"
+	http "github.com/OdyseeTeam/mirage/server"
+	"github.com/OdyseeTeam/mirage/video"
+
+	"github.com/OdyseeTeam/gody-cdn/cleanup"
+	"github.com/OdyseeTeam/gody-cdn/configs"
+	"github.com/OdyseeTeam/gody-cdn/store"
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// buildServer wires the object store, metadata and moderation dependencies described by the configuration.
+// The returned function releases them.
+func buildServer(stopper *stop.Group) (*http.Server, func()) {
+	ds, err := store.NewDiskStore(viper.GetString("disk_cache.path"), 2)
+	if err != nil {
+		logrus.Fatal(errors.FullTrace(err))
+	}
+	localDsn := fmt.Sprintf("%s:%s@tcp(%s:3306)/%s", viper.GetString("local_db.user"), viper.GetString("local_db.password"), viper.GetString("local_db.host"), viper.GetString("local_db.database"))
+	dbs := store.NewDBBackedStore(ds, localDsn)
+	cacheParams := configs.ObjectCacheParams{
+		Path: viper.GetString("disk_cache.path"),
+		Size: viper.GetString("disk_cache.size"),
+	}
+	go cleanup.SelfCleanup(dbs, dbs, stopper, cacheParams, 30*time.Second)
+	metadataDsn := fmt.Sprintf("%s:%s@tcp(%s:3306)/%s?parseTime=true", viper.GetString("metadata_db.user"), viper.GetString("metadata_db.password"), viper.GetString("metadata_db.host"), viper.GetString("metadata_db.database"))
+	metadataManager, err := metadata.Init(metadataDsn)
+	if err != nil {
+		logrus.Fatal(errors.FullTrace(err))
+	}
+	var notifierConfigs []notifier.Config
+	err = viper.UnmarshalKey("purge.notifiers", &notifierConfigs)
+	if err != nil {
+		logrus.Fatal(errors.FullTrace(err))
+	}
+	purgeNotifier, err := notifier.FromConfig(notifierConfigs)
+	if err != nil {
+		logrus.Fatal(errors.FullTrace(err))
+	}
+	var bl *blocklist.Blocklist
+	if viper.GetBool("blocklist.enabled") {
+		bl, err = blocklist.Init(metadataDsn, viper.GetInt("blocklist.phash_distance"), viper.GetDuration("blocklist.refresh_interval"))
+		if err != nil {
+			logrus.Fatal(errors.FullTrace(err))
+		}
+	}
+	optimizerConfig, err := loadOptimizerConfig()
+	if err != nil {
+		logrus.Fatal(errors.FullTrace(err))
+	}
+	o, err := optimizer.NewOptimizer(optimizerConfig)
+	if err != nil {
+		logrus.Fatal(errors.FullTrace(err))
+	}
+	var frames http.FrameExtractor
+	if viper.GetBool("video.enabled") {
+		var videoConfig video.Config
+		err = viper.UnmarshalKey("video", &videoConfig)
+		if err != nil {
+			logrus.Fatal(errors.FullTrace(err))
+		}
+		frames = video.NewExtractor(videoConfig)
+	}
+	closeDeps := func() {
+		if bl != nil {
+			bl.Shutdown()
+		}
+	}
+	return http.NewServer(o, http.NewObjectStore(dbs), metadataManager, purgeNotifier, bl, frames), closeDeps
+}
+
+// loadOptimizerConfig reads the optimizer settings, which the commands optimizing images outside of the server
+// share with it
+func loadOptimizerConfig() (optimizer.Config, error) {
+	var cfg optimizer.Config
+	err := viper.UnmarshalKey("optimizer", &cfg)
+	return cfg, errors.Err(err)
+}
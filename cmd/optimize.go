@@ -0,0 +1,232 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/OdyseeTeam/mirage/config"
+	"github.com/OdyseeTeam/mirage/downloader"
+	"github.com/OdyseeTeam/mirage/optimizer"
+	"github.com/OdyseeTeam/mirage/video"
+
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	optimizeWidth    int64
+	optimizeHeight   int64
+	optimizeQuality  string
+	optimizeFormat   string
+	optimizeOutput   string
+	optimizeJSON     bool
+	optimizePolicy   string
+	optimizeGamut    bool
+	optimizeSVG      bool
+	optimizeLossless bool
+	optimizeColors   int
+	optimizeKernel   string
+	optimizeLinear   bool
+)
+
+func init() {
+	optimizeCmd.Flags().Int64Var(&optimizeWidth, "width", 0, "output width, 0 keeps the aspect ratio")
+	optimizeCmd.Flags().Int64Var(&optimizeHeight, "height", 0, "output height, 0 keeps the aspect ratio")
+	optimizeCmd.Flags().StringVar(&optimizeQuality, "quality", "85", `output quality from 1 to 100, "auto" picks it like quality:auto does`)
+	optimizeCmd.Flags().StringVar(&optimizeFormat, "format", "webp", `output format: "webp" as served on /optimize/, "jpeg" as served on /card/, "png" or "avif"`)
+	optimizeCmd.Flags().StringVarP(&optimizeOutput, "output", "o", "-", `file to write the optimized image to, "-" for stdout`)
+	optimizeCmd.Flags().StringVar(&optimizePolicy, "metadata-policy", "", `metadata kept in the output: "strip", "icc" or "copyright", empty for optimizer.metadata_policy`)
+	optimizeCmd.Flags().BoolVar(&optimizeGamut, "preserve-wide-gamut", false, "keep avif output in the color space of the source, overriding optimizer.preserve_wide_gamut")
+	optimizeCmd.Flags().BoolVar(&optimizeSVG, "rasterize-svg", false, "render svg sources instead of sanitizing them, implied by --format jpeg")
+	optimizeCmd.Flags().BoolVar(&optimizeLossless, "lossless", false, "encode webp output losslessly")
+	optimizeCmd.Flags().IntVar(&optimizeColors, "colors", 0, "quantize png output to this many colors, rounded up to 2, 4, 16 or 256, 0 for png.max_colors")
+	optimizeCmd.Flags().StringVar(&optimizeKernel, "kernel", "", `resampling kernel: "nearest", "bilinear", "catmullrom" or "lanczos", empty for optimizer.resize.kernel`)
+	optimizeCmd.Flags().BoolVar(&optimizeLinear, "linear", false, "resize in linear light")
+	optimizeCmd.Flags().BoolVar(&optimizeJSON, "json", false, "print the report as JSON")
+	rootCmd.AddCommand(optimizeCmd)
+}
+
+type optimizeReport struct {
+	Source        string  `json:"source"`
+	OriginalMime  string  `json:"original_mime"`
+	OptimizedMime string  `json:"optimized_mime"`
+	OriginalSize  int     `json:"original_size"`
+	OptimizedSize int     `json:"optimized_size"`
+	Ratio         float64 `json:"ratio"`
+	Width         int     `json:"width"`
+	Height        int     `json:"height"`
+	Quality       int64   `json:"quality"`
+}
+
+var optimizeCmd = &cobra.Command{
+	Use:   "optimize <file|url>",
+	Short: "Optimizes a single image without running the server",
+	Long: `Optimizes a local file or a url the same way the server would, writes the result to a file or stdout
+and reports what was done. The report goes to stderr so that stdout can carry the image.
+The settings are read from config.json like the server's when there is one, the flags overriding them.
+Videos are optimized as their poster frame, which needs ffmpeg.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		config.InitializeOptionalConfiguration()
+		report, err := optimizeSource(cmd, args[0])
+		if err != nil {
+			logrus.Fatal(errors.FullTrace(err))
+		}
+		if optimizeJSON {
+			enc := json.NewEncoder(os.Stderr)
+			enc.SetIndent("", "  ")
+			_ = enc.Encode(report)
+			return
+		}
+		_, _ = fmt.Fprintf(os.Stderr, "source:     %s\n", report.Source)
+		_, _ = fmt.Fprintf(os.Stderr, "mime:       %s -> %s\n", report.OriginalMime, report.OptimizedMime)
+		_, _ = fmt.Fprintf(os.Stderr, "dimensions: %dx%d\n", report.Width, report.Height)
+		_, _ = fmt.Fprintf(os.Stderr, "quality:    %d\n", report.Quality)
+		_, _ = fmt.Fprintf(os.Stderr, "size:       %d -> %d bytes (%.2f:1)\n", report.OriginalSize, report.OptimizedSize, report.Ratio)
+	},
+}
+
+func optimizeSource(cmd *cobra.Command, source string) (*optimizeReport, error) {
+	if optimizeFormat != "webp" && optimizeFormat != "jpeg" && optimizeFormat != "png" && optimizeFormat != "avif" {
+		return nil, errors.Err("unknown format %q", optimizeFormat)
+	}
+	quality, err := optimizer.ParseQuality(optimizeQuality)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	var videoMime string
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		downloaded, err := downloader.Download(source)
+		if err != nil {
+			return nil, err
+		}
+		data = downloaded.Data
+		if downloaded.IsVideo() {
+			videoMime = downloaded.MimeType
+		}
+	} else {
+		var err error
+		data, err = os.ReadFile(source)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		if detected := mimetype.Detect(data).String(); strings.HasPrefix(detected, "video/") {
+			videoMime = detected
+		}
+	}
+	if videoMime != "" {
+		var videoConfig video.Config
+		err := viper.UnmarshalKey("video", &videoConfig)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		data, err = video.NewExtractor(videoConfig).PosterFrame(source, videoMime)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	optimizerConfig, err := loadOptimizerConfig()
+	if err != nil {
+		return nil, err
+	}
+	if optimizePolicy != "" {
+		optimizerConfig.MetadataPolicy = optimizer.MetadataPolicy(optimizePolicy)
+	}
+	if cmd.Flags().Changed("preserve-wide-gamut") {
+		optimizerConfig.PreserveWideGamut = optimizeGamut
+	}
+	o, err := optimizer.NewOptimizer(optimizerConfig)
+	if err != nil {
+		return nil, err
+	}
+	var kernel optimizer.Kernel
+	if optimizeKernel != "" {
+		kernel, err = optimizer.ParseKernel(optimizeKernel)
+		if err != nil {
+			return nil, err
+		}
+	}
+	opts := optimizer.Options{
+		Quality:  quality,
+		Width:    optimizeWidth,
+		Height:   optimizeHeight,
+		Lossless: optimizeLossless,
+		Kernel:   kernel,
+		Linear:   optimizeLinear,
+		// cards, PNG and AVIF output are always rasterized
+		RasterizeSVG: optimizeSVG || optimizeFormat == "jpeg" || optimizeFormat == "png" || optimizeFormat == "avif",
+		Avif:         optimizeFormat == "avif",
+	}
+	if optimizeFormat == "png" {
+		opts.Png = &optimizer.PngOptions{}
+		err = viper.UnmarshalKey("png", opts.Png)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		if optimizeColors != 0 {
+			opts.Png.Colors = optimizeColors
+		}
+	}
+	// the quality search and the optimization share the decoded source
+	src := optimizer.NewSource(data)
+	if opts.Quality == optimizer.AutoQuality {
+		opts.Quality, err = o.ChooseQualitySource(src, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	optimized, origMime, optimizedMime, err := o.OptimizeSource(src, opts)
+	if err != nil {
+		return nil, err
+	}
+	if videoMime != "" {
+		origMime = videoMime
+	}
+	if optimizeFormat == "jpeg" {
+		var jpegOptions optimizer.JpegOptions
+		err = viper.UnmarshalKey("card.jpeg", &jpegOptions)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		jpegOptions.Quality = opts.Quality
+		optimized, _, optimizedMime, err = o.JpegOptimize(optimized, jpegOptions)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var out io.Writer = os.Stdout
+	if optimizeOutput != "-" {
+		f, err := os.Create(optimizeOutput)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		defer func() { _ = f.Close() }()
+		out = f
+	}
+	_, err = out.Write(optimized)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+
+	width, height := optimizer.Dimensions(optimized)
+	return &optimizeReport{
+		Source:        source,
+		OriginalMime:  origMime,
+		OptimizedMime: optimizedMime,
+		OriginalSize:  len(data),
+		OptimizedSize: len(optimized),
+		Ratio:         float64(len(data)) / float64(len(optimized)),
+		Width:         width,
+		Height:        height,
+		Quality:       opts.Quality,
+	}, nil
+}
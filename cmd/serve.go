@@ -1,21 +1,13 @@
 package cmd
 
 import (
-	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
-	"time"
 
-	"github.com/OdyseeTeam/gody-cdn/cleanup"
-	"github.com/OdyseeTeam/gody-cdn/configs"
-	"github.com/OdyseeTeam/gody-cdn/store"
 	"github.com/OdyseeTeam/mirage/config"
-	"github.com/OdyseeTeam/mirage/metadata"
-	"github.com/OdyseeTeam/mirage/optimizer"
 	http "github.com/OdyseeTeam/mirage/server"
 
-	"github.com/lbryio/lbry.go/v2/extras/errors"
 	"github.com/lbryio/lbry.go/v2/extras/stop"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -43,32 +35,31 @@ var serveCmd = &cobra.Command{
 		stopper := stop.New()
 		config.InitializeConfiguration()
 
-		ds, err := store.NewDiskStore(viper.GetString("disk_cache.path"), 2)
-		if err != nil {
-			logrus.Fatal(errors.FullTrace(err))
-		}
-		localDsn := fmt.Sprintf("%s:%s@tcp(%s:3306)/%s", viper.GetString("local_db.user"), viper.GetString("local_db.password"), viper.GetString("local_db.host"), viper.GetString("local_db.database"))
-		dbs := store.NewDBBackedStore(ds, localDsn)
-		cacheParams := configs.ObjectCacheParams{
-			Path: viper.GetString("disk_cache.path"),
-			Size: viper.GetString("disk_cache.size"),
-		}
-		go cleanup.SelfCleanup(dbs, dbs, stopper, cacheParams, 30*time.Second)
-		metadataDsn := fmt.Sprintf("%s:%s@tcp(%s:3306)/%s?parseTime=true", viper.GetString("metadata_db.user"), viper.GetString("metadata_db.password"), viper.GetString("metadata_db.host"), viper.GetString("metadata_db.database"))
-		metadataManager, err := metadata.Init(metadataDsn)
-		if err != nil {
-			logrus.Fatal(errors.FullTrace(err))
-		}
-		httpServer := http.NewServer(optimizer.NewOptimizer(), dbs, metadataManager)
-		err = httpServer.Start(":6456")
-		if err != nil {
-			logrus.Fatal(err)
-		}
-		defer httpServer.Shutdown()
+		httpServer, closeDeps := buildServer(stopper)
+		// Start serves until the server is shut down, or returns the error that stopped it
+		served := make(chan error, 1)
+		go func() {
+			served <- httpServer.Start(http.ListenConfig{
+				Addresses:      viper.GetStringSlice("http.listen"),
+				AdminAddresses: viper.GetStringSlice("http.admin_listen"),
+				TLSCertFile:    viper.GetString("http.tls.cert_file"),
+				TLSKeyFile:     viper.GetString("http.tls.key_file"),
+				H2C:            viper.GetBool("http.h2c"),
+			})
+		}()
 
 		interruptChan := make(chan os.Signal, 1)
 		signal.Notify(interruptChan, os.Interrupt, syscall.SIGTERM)
-		<-interruptChan
+		var err error
+		select {
+		case err = <-served:
+		case <-interruptChan:
+		}
+		httpServer.Shutdown()
 		stopper.StopAndWait()
+		closeDeps()
+		if err != nil {
+			logrus.Fatal(err)
+		}
 	},
 }
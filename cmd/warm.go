@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+
+	"github.com/OdyseeTeam/mirage/config"
+	http "github.com/OdyseeTeam/mirage/server"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	warmConcurrency int
+	warmRate        float64
+	warmRecent      int
+)
+
+func init() {
+	warmCmd.Flags().IntVar(&warmConcurrency, "concurrency", 4, "number of variants generated at once")
+	warmCmd.Flags().Float64Var(&warmRate, "rate", 10, "maximum number of variants started per second (0 for unlimited)")
+	warmCmd.Flags().IntVar(&warmRecent, "recent", 0, "also replay the given number of most recently served variants")
+	rootCmd.AddCommand(warmCmd)
+}
+
+var warmCmd = &cobra.Command{
+	Use:   "warm [file]",
+	Short: "Pre-generates variants into the cache",
+	Long: `Pre-generates variants into the cache, e.g. after a deploy or a cache wipe.
+The file (or stdin when it is "-") holds either a JSON array of {"url", "width", "height", "quality", "card"}
+objects, or one such object or bare url per line.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// the arguments are fine past this point, failures are the warming's
+		cmd.SilenceUsage = true
+		return warm(args)
+	},
+}
+
+// warm runs the warm command, releasing the server and its dependencies before returning
+func warm(args []string) error {
+	stopper := stop.New()
+	config.InitializeConfiguration()
+	httpServer, closeDeps := buildServer(stopper)
+	defer func() {
+		httpServer.Shutdown()
+		stopper.StopAndWait()
+		closeDeps()
+	}()
+
+	var items []http.WarmItem
+	if len(args) == 1 {
+		var r io.Reader = os.Stdin
+		if args[0] != "-" {
+			f, err := os.Open(args[0])
+			if err != nil {
+				return errors.Err(err)
+			}
+			defer func() { _ = f.Close() }()
+			r = f
+		}
+		parsed, err := http.ParseWarmItems(r)
+		if err != nil {
+			return err
+		}
+		items = append(items, parsed...)
+	}
+	if warmRecent > 0 {
+		recent, err := httpServer.RecentWarmItems(warmRecent)
+		if err != nil {
+			return err
+		}
+		items = append(items, recent...)
+	}
+	if len(items) == 0 {
+		return errors.Err("nothing to warm: pass a file and/or --recent")
+	}
+
+	result := httpServer.Warm(items, http.WarmOptions{Concurrency: warmConcurrency, Rate: warmRate}, func(p http.WarmProgress) {
+		if p.Processed%100 == 0 || p.Processed == p.Total {
+			logrus.Infof("warmed %d/%d (%d cached, %d generated, %d failed)", p.Processed, p.Total, p.Cached, p.Generated, len(p.Failed))
+		}
+	})
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(result)
+	if len(result.Failed) > 0 {
+		return errors.Err("%d of %d items failed", len(result.Failed), result.Total)
+	}
+	return nil
+}
@@ -11,11 +11,22 @@ var Debugging bool
 
 // InitializeConfiguration inits the base configuration
 func InitializeConfiguration() {
+	initialize(true)
+}
+
+// InitializeOptionalConfiguration is InitializeConfiguration for the commands that can run on the defaults when
+// there is no config file
+func InitializeOptionalConfiguration() {
+	initialize(false)
+}
+
+func initialize(required bool) {
 	viper.SetConfigName("config")
 	viper.SetConfigType("json")
 	viper.AddConfigPath("./")
 	err := viper.ReadInConfig() // Find and read the config file
-	if err != nil {             // Handle errors reading the config file
+	_, notFound := err.(viper.ConfigFileNotFoundError)
+	if err != nil && (required || !notFound) { // Handle errors reading the config file
 		logrus.Fatalf("Fatal error config file: %s", errors.FullTrace(errors.Err(err)))
 	}
 	if viper.GetBool("debugmode") {
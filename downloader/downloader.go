@@ -3,12 +3,83 @@ package downloader
 import (
 	"io"
 	"net/http"
+	"strings"
 	"time"
 
+	"github.com/gabriel-vasile/mimetype"
 	"github.com/lbryio/lbry.go/v2/extras/errors"
 )
 
+// UserAgent is sent with every request made to the origins
+const UserAgent = "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/106.0.0.0 Safari/537.36"
+
+// sniffLength is how much of a source is read to tell what it is, the same as mimetype reads
+const sniffLength = 3072
+
+// Source is a downloaded source image. Videos are only read as far as needed to recognize them, their frames are
+// extracted straight from the url instead.
+type Source struct {
+	Data     []byte
+	MimeType string
+	// Size is the size of the whole source, which differs from len(Data) for videos. It is -1 when unknown.
+	Size int64
+}
+
+// IsVideo reports whether the source is a video, in which case Data only holds its first bytes
+func (s *Source) IsVideo() bool {
+	return strings.HasPrefix(s.MimeType, "video/")
+}
+
 func DownloadFile(URL string, isRetry bool) ([]byte, error) {
+	response, err := get(URL, isRetry)
+	if err != nil {
+		return nil, err
+	}
+	defer func(body io.ReadCloser) {
+		_ = body.Close()
+	}(response.Body)
+	bodyBytes, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+
+	return bodyBytes, nil
+}
+
+// Download fetches a source, stopping after the first bytes when it turns out to be a video
+func Download(URL string) (*Source, error) {
+	response, err := get(URL, false)
+	if err != nil {
+		return nil, err
+	}
+	defer func(body io.ReadCloser) {
+		_ = body.Close()
+	}(response.Body)
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(response.Body, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, errors.Err(err)
+	}
+	head = head[:n]
+	source := &Source{
+		Data:     head,
+		MimeType: mimetype.Detect(head).String(),
+		Size:     response.ContentLength,
+	}
+	if source.IsVideo() {
+		return source, nil
+	}
+	rest, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	source.Data = append(head, rest...)
+	source.Size = int64(len(source.Data))
+	return source, nil
+}
+
+// get requests URL, retrying once on a 502, and fails on anything but a 200
+func get(URL string, isRetry bool) (*http.Response, error) {
 	method := "GET"
 
 	client := &http.Client{
@@ -18,26 +89,20 @@ func DownloadFile(URL string, isRetry bool) ([]byte, error) {
 	if err != nil {
 		return nil, errors.Err(err)
 	}
-	req.Header.Add("User-Agent", "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/106.0.0.0 Safari/537.36")
+	req.Header.Add("User-Agent", UserAgent)
 	response, err := client.Do(req)
 	if err != nil {
 		return nil, errors.Err(err)
 	}
-	defer func(body io.ReadCloser) {
-		_ = body.Close()
-	}(response.Body)
 
 	if response.StatusCode != http.StatusOK {
+		_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, 4096))
+		_ = response.Body.Close()
 		if !isRetry && response.StatusCode == http.StatusBadGateway {
 			time.Sleep(100 * time.Millisecond)
-			return DownloadFile(URL, true)
+			return get(URL, true)
 		}
 		return nil, errors.Err("Received non 200 response code %d for %s", response.StatusCode, URL)
 	}
-	bodyBytes, err := io.ReadAll(response.Body)
-	if err != nil {
-		return nil, errors.Err(err)
-	}
-
-	return bodyBytes, nil
+	return response, nil
 }
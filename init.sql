@@ -22,6 +22,54 @@ CREATE TABLE `metadata`
     `original_size`  int(11)      NOT NULL,
     `optimized_size` int(11)      NOT NULL,
     `original_mime`  varchar(100) NOT NULL,
+    `optimized_mime` varchar(100) NOT NULL DEFAULT '',
+    `width`          int(11)      NOT NULL DEFAULT 0,
+    `height`         int(11)      NOT NULL DEFAULT 0,
+    `variant`        varchar(255) NOT NULL DEFAULT '',
+    `source_sha256`  varchar(64)  NOT NULL DEFAULT '',
+    `phash`          bigint unsigned NOT NULL DEFAULT 0,
+    `object_hash`    varchar(64)  NOT NULL DEFAULT '',
+    `last_served_at` timestamp    NULL DEFAULT NULL,
+    `quality`        int(11)      NOT NULL DEFAULT 0,
+    `kept_source`    tinyint(1)   NOT NULL DEFAULT 0,
     PRIMARY KEY (`id`),
-    KEY `metadata_godycdn_hash_index` (`godycdn_hash`)
+    KEY `metadata_godycdn_hash_index` (`godycdn_hash`),
+    KEY `metadata_source_sha256_index` (`source_sha256`),
+    KEY `metadata_last_served_at_index` (`last_served_at`),
+    KEY `metadata_object_hash_index` (`object_hash`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
+CREATE TABLE `blocklist`
+(
+    `id`         int(11)      NOT NULL AUTO_INCREMENT,
+    `kind`       varchar(16)  NOT NULL,
+    `value`      varchar(700) NOT NULL,
+    `reason`     text         NOT NULL,
+    `created_at` timestamp    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (`id`),
+    UNIQUE KEY `blocklist_kind_value_index` (`kind`, `value`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
+CREATE TABLE `source_info`
+(
+    `id`             int(11)      NOT NULL AUTO_INCREMENT,
+    `url`            text         NOT NULL,
+    `url_hash`       char(40)     NOT NULL,
+    `source_sha256`  varchar(64)  NOT NULL DEFAULT '',
+    `mime`           varchar(100) NOT NULL DEFAULT '',
+    `size`           bigint       NOT NULL DEFAULT 0,
+    `width`          int(11)      NOT NULL DEFAULT 0,
+    `height`         int(11)      NOT NULL DEFAULT 0,
+    `dominant_color` varchar(7)   NOT NULL DEFAULT '',
+    `blurhash`       varchar(64)  NOT NULL DEFAULT '',
+    `thumbhash`      varchar(64)  NOT NULL DEFAULT '',
+    `lqip`           text         NOT NULL,
+    `frames`         int(11)      NOT NULL DEFAULT 1,
+    `duration_ms`    int(11)      NOT NULL DEFAULT 0,
+    `has_alpha`      tinyint(1)   NOT NULL DEFAULT 0,
+    `orientation`    tinyint      NOT NULL DEFAULT 1,
+    `average_color`  varchar(7)   NOT NULL DEFAULT '',
+    `phash`          bigint unsigned NOT NULL DEFAULT 0,
+    `stale`          tinyint(1)   NOT NULL DEFAULT 0,
+    `created_at`     timestamp    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (`id`),
+    UNIQUE KEY `source_info_url_hash_index` (`url_hash`)
 ) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
\ No newline at end of file
@@ -0,0 +1,246 @@
+// Package icc converts images described by matrix/TRC RGB ICC profiles (Display P3, Adobe RGB, ProPhoto...) to sRGB.
+// LUT based profiles, which is what CMYK profiles are, are not supported.
+package icc
+
+import (
+	"encoding/binary"
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// Profile is a parsed matrix/TRC RGB profile
+type Profile struct {
+	// toXYZ maps linear RGB to the D50 XYZ profile connection space, one column per primary
+	toXYZ [3][3]float64
+	trc   [3]curve
+}
+
+type curve func(float64) float64
+
+// xyzToSRGB maps D50 XYZ to linear sRGB (Bradford adapted), the inverse of the sRGB profile matrix
+var xyzToSRGB = [3][3]float64{
+	{3.1338561, -1.6168667, -0.4906146},
+	{-0.9787684, 1.9161415, 0.0334540},
+	{0.0719453, -0.2289914, 1.4052427},
+}
+
+// srgbToXYZ is the sRGB profile matrix, as found in the rXYZ, gXYZ and bXYZ tags of sRGB profiles
+var srgbToXYZ = [3][3]float64{
+	{0.4360747, 0.3850649, 0.1430804},
+	{0.2225045, 0.7168786, 0.0606169},
+	{0.0139322, 0.0971045, 0.7141733},
+}
+
+// Parse reads an RGB matrix/TRC profile
+func Parse(data []byte) (*Profile, error) {
+	if len(data) < 132 {
+		return nil, errors.Err("icc profile is too short")
+	}
+	if string(data[16:20]) != "RGB " {
+		return nil, errors.Err("unsupported icc color space %q", data[16:20])
+	}
+	if string(data[20:24]) != "XYZ " {
+		return nil, errors.Err("unsupported icc connection space %q", data[20:24])
+	}
+	tags := make(map[string][]byte)
+	count := int(binary.BigEndian.Uint32(data[128:132]))
+	for i := 0; i < count; i++ {
+		entry := 132 + i*12
+		if entry+12 > len(data) {
+			return nil, errors.Err("icc tag table is truncated")
+		}
+		offset := int(binary.BigEndian.Uint32(data[entry+4 : entry+8]))
+		size := int(binary.BigEndian.Uint32(data[entry+8 : entry+12]))
+		if offset < 0 || size < 0 || offset+size > len(data) {
+			return nil, errors.Err("icc tag is out of bounds")
+		}
+		tags[string(data[entry:entry+4])] = data[offset : offset+size]
+	}
+	p := &Profile{}
+	for i, name := range []string{"r", "g", "b"} {
+		xyz, err := parseXYZ(tags[name+"XYZ"])
+		if err != nil {
+			return nil, err
+		}
+		for row := 0; row < 3; row++ {
+			p.toXYZ[row][i] = xyz[row]
+		}
+		p.trc[i], err = parseCurve(tags[name+"TRC"])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+func parseXYZ(tag []byte) ([3]float64, error) {
+	if len(tag) < 20 || string(tag[0:4]) != "XYZ " {
+		return [3]float64{}, errors.Err("missing or malformed icc primary")
+	}
+	return [3]float64{s15Fixed16(tag[8:12]), s15Fixed16(tag[12:16]), s15Fixed16(tag[16:20])}, nil
+}
+
+func parseCurve(tag []byte) (curve, error) {
+	if len(tag) < 12 {
+		return nil, errors.Err("missing or malformed icc tone curve")
+	}
+	switch string(tag[0:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(tag[8:12]))
+		if len(tag) < 12+2*n {
+			return nil, errors.Err("icc tone curve is truncated")
+		}
+		switch n {
+		case 0:
+			return func(x float64) float64 { return x }, nil
+		case 1:
+			gamma := float64(binary.BigEndian.Uint16(tag[12:14])) / 256
+			return func(x float64) float64 { return math.Pow(x, gamma) }, nil
+		}
+		table := make([]float64, n)
+		for i := range table {
+			table[i] = float64(binary.BigEndian.Uint16(tag[12+2*i:])) / 65535
+		}
+		return func(x float64) float64 {
+			pos := x * float64(n-1)
+			i := int(pos)
+			if i >= n-1 {
+				return table[n-1]
+			}
+			return table[i] + (table[i+1]-table[i])*(pos-float64(i))
+		}, nil
+	case "para":
+		kind := binary.BigEndian.Uint16(tag[8:10])
+		paramCount := map[uint16]int{0: 1, 1: 3, 2: 4, 3: 5, 4: 7}[kind]
+		if paramCount == 0 && kind != 0 || len(tag) < 12+4*paramCount {
+			return nil, errors.Err("unsupported icc parametric curve %d", kind)
+		}
+		var p [7]float64
+		for i := 0; i < paramCount; i++ {
+			p[i] = s15Fixed16(tag[12+4*i:])
+		}
+		g, a, b, c, d, e, f := p[0], p[1], p[2], p[3], p[4], p[5], p[6]
+		switch kind {
+		case 0:
+			return func(x float64) float64 { return math.Pow(x, g) }, nil
+		case 1:
+			return func(x float64) float64 {
+				if x >= -b/a {
+					return math.Pow(a*x+b, g)
+				}
+				return 0
+			}, nil
+		case 2:
+			return func(x float64) float64 {
+				if x >= -b/a {
+					return math.Pow(a*x+b, g) + c
+				}
+				return c
+			}, nil
+		case 3:
+			return func(x float64) float64 {
+				if x >= d {
+					return math.Pow(a*x+b, g)
+				}
+				return c * x
+			}, nil
+		default:
+			return func(x float64) float64 {
+				if x >= d {
+					return math.Pow(a*x+b, g) + e
+				}
+				return c*x + f
+			}, nil
+		}
+	}
+	return nil, errors.Err("unsupported icc tone curve type %q", tag[0:4])
+}
+
+// IsSRGB reports whether the profile is close enough to sRGB that converting is pointless
+func (p *Profile) IsSRGB() bool {
+	for row := 0; row < 3; row++ {
+		for col := 0; col < 3; col++ {
+			if math.Abs(p.toXYZ[row][col]-srgbToXYZ[row][col]) > 0.005 {
+				return false
+			}
+		}
+	}
+	for _, trc := range p.trc {
+		for _, x := range []float64{0.05, 0.25, 0.5, 0.75} {
+			if math.Abs(trc(x)-srgbToLinear(x)) > 0.01 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// lutSize is the resolution of the lookup tables the conversion goes through
+const lutSize = 4096
+
+// ToSRGB converts img from the profile's color space to sRGB, keeping its alpha channel
+func (p *Profile) ToSRGB(img image.Image) image.Image {
+	var toLinear [3][lutSize]float64
+	for c := 0; c < 3; c++ {
+		for i := 0; i < lutSize; i++ {
+			toLinear[c][i] = p.trc[c](float64(i) / (lutSize - 1))
+		}
+	}
+	var fromLinear [lutSize]uint16
+	for i := 0; i < lutSize; i++ {
+		fromLinear[i] = uint16(math.Round(linearToSRGB(float64(i)/(lutSize-1)) * 0xffff))
+	}
+	var m [3][3]float64
+	for row := 0; row < 3; row++ {
+		for col := 0; col < 3; col++ {
+			for k := 0; k < 3; k++ {
+				m[row][col] += xyzToSRGB[row][k] * p.toXYZ[k][col]
+			}
+		}
+	}
+
+	b := img.Bounds()
+	out := image.NewNRGBA64(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
+			in := [3]float64{
+				toLinear[0][int(c.R)*(lutSize-1)/0xffff],
+				toLinear[1][int(c.G)*(lutSize-1)/0xffff],
+				toLinear[2][int(c.B)*(lutSize-1)/0xffff],
+			}
+			var rgb [3]uint16
+			for row := 0; row < 3; row++ {
+				v := m[row][0]*in[0] + m[row][1]*in[1] + m[row][2]*in[2]
+				rgb[row] = fromLinear[int(math.Round(clamp(v)*(lutSize-1)))]
+			}
+			out.SetNRGBA64(x, y, color.NRGBA64{R: rgb[0], G: rgb[1], B: rgb[2], A: c.A})
+		}
+	}
+	return out
+}
+
+func clamp(v float64) float64 {
+	return math.Max(0, math.Min(1, v))
+}
+
+func srgbToLinear(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) float64 {
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
@@ -0,0 +1,66 @@
+package imagehash
+
+import (
+	"fmt"
+	"image"
+	"math/bits"
+	"strconv"
+
+	"github.com/nfnt/resize"
+)
+
+// Hash is a 64 bit perceptual hash. Zero means the hash is unknown.
+type Hash uint64
+
+// DHash computes the difference hash of img: it is downscaled to 9x8 grayscale and each bit records
+// whether a pixel is brighter than its right neighbour.
+//
+// It keeps downscaling with nfnt/resize rather than internal/resample: the stored phashes and the blocklist entries
+// were computed with it, and a kernel that rounds differently would move hashes away from their entries.
+func DHash(img image.Image) Hash {
+	small := resize.Resize(9, 8, img, resize.Bilinear)
+	var h Hash
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			h <<= 1
+			if luminance(small, x, y) > luminance(small, x+1, y) {
+				h |= 1
+			}
+		}
+	}
+	return h
+}
+
+func luminance(img image.Image, x, y int) uint32 {
+	b := img.Bounds()
+	r, g, bl, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+	return (299*r + 587*g + 114*bl) / 1000
+}
+
+// Distance is the hamming distance between two hashes
+func (h Hash) Distance(other Hash) int {
+	return bits.OnesCount64(uint64(h ^ other))
+}
+
+func (h Hash) String() string {
+	return fmt.Sprintf("%016x", uint64(h))
+}
+
+// Parse reads a hash formatted by String
+func Parse(s string) (Hash, error) {
+	v, err := strconv.ParseUint(s, 16, 64)
+	return Hash(v), err
+}
+
+func (h Hash) MarshalText() ([]byte, error) {
+	return []byte(h.String()), nil
+}
+
+func (h *Hash) UnmarshalText(text []byte) error {
+	v, err := Parse(string(text))
+	if err != nil {
+		return err
+	}
+	*h = v
+	return nil
+}
@@ -0,0 +1,303 @@
+// Package imagemeta reads the EXIF and ICC metadata embedded in JPEG, PNG and WebP files without decoding the pixels.
+package imagemeta
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"sort"
+)
+
+// Metadata is the subset of embedded metadata the optimizer cares about
+type Metadata struct {
+	// Orientation is the EXIF orientation (1 to 8), 1 when absent
+	Orientation int
+	// ICC is the raw embedded color profile, if any
+	ICC []byte
+	// Artist and Copyright are the matching EXIF tags
+	Artist    string
+	Copyright string
+}
+
+const (
+	tagOrientation = 0x0112
+	tagArtist      = 0x013b
+	tagCopyright   = 0x8298
+
+	typeASCII = 2
+	typeShort = 3
+)
+
+var exifHeader = []byte("Exif\x00\x00")
+
+// Read extracts the metadata of a JPEG, PNG or WebP file. Anything it can't parse is ignored.
+func Read(data []byte) Metadata {
+	var tiff, icc []byte
+	switch {
+	case bytes.HasPrefix(data, []byte{0xff, 0xd8}):
+		tiff, icc = readJPEG(data)
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		tiff, icc = readPNG(data)
+	case len(data) >= 12 && string(data[0:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		tiff, icc = readWebP(data)
+	}
+	md := ParseExif(tiff)
+	md.ICC = icc
+	return md
+}
+
+func readJPEG(data []byte) (tiff, icc []byte) {
+	iccChunks := make(map[byte][]byte)
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xff {
+			break
+		}
+		marker := data[i+1]
+		if marker == 0xff {
+			i++
+			continue
+		}
+		if marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+			i += 2
+			continue
+		}
+		// start of scan or end of image, no more metadata segments
+		if marker == 0xda || marker == 0xd9 {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2 : i+4]))
+		if length < 2 || i+2+length > len(data) {
+			break
+		}
+		segment := data[i+4 : i+2+length]
+		switch {
+		case marker == 0xe1 && tiff == nil && bytes.HasPrefix(segment, exifHeader):
+			tiff = segment[len(exifHeader):]
+		case marker == 0xe2 && bytes.HasPrefix(segment, []byte("ICC_PROFILE\x00")) && len(segment) > 14:
+			iccChunks[segment[12]] = segment[14:]
+		}
+		i += 2 + length
+	}
+	if len(iccChunks) > 0 {
+		seqs := make([]int, 0, len(iccChunks))
+		for seq := range iccChunks {
+			seqs = append(seqs, int(seq))
+		}
+		sort.Ints(seqs)
+		for _, seq := range seqs {
+			icc = append(icc, iccChunks[byte(seq)]...)
+		}
+	}
+	return tiff, icc
+}
+
+func readPNG(data []byte) (tiff, icc []byte) {
+	for i := 8; i+12 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[i : i+4]))
+		if length < 0 || i+12+length > len(data) {
+			break
+		}
+		chunk := data[i+8 : i+8+length]
+		switch string(data[i+4 : i+8]) {
+		case "eXIf":
+			tiff = chunk
+		case "iCCP":
+			// profile name, NUL, compression method, zlib stream
+			if nul := bytes.IndexByte(chunk, 0); nul >= 0 && nul+2 <= len(chunk) {
+				r, err := zlib.NewReader(bytes.NewReader(chunk[nul+2:]))
+				if err == nil {
+					icc, _ = io.ReadAll(r)
+				}
+			}
+		case "IDAT", "IEND":
+			return tiff, icc
+		}
+		i += 12 + length
+	}
+	return tiff, icc
+}
+
+func readWebP(data []byte) (tiff, icc []byte) {
+	for i := 12; i+8 <= len(data); {
+		size := int(binary.LittleEndian.Uint32(data[i+4 : i+8]))
+		if size < 0 || i+8+size > len(data) {
+			break
+		}
+		chunk := data[i+8 : i+8+size]
+		switch string(data[i : i+4]) {
+		case "EXIF":
+			tiff = bytes.TrimPrefix(chunk, exifHeader)
+		case "ICCP":
+			icc = chunk
+		}
+		i += 8 + size + size%2
+	}
+	return tiff, icc
+}
+
+// ParseExif reads the orientation, artist and copyright from the first IFD of a TIFF structured EXIF blob
+func ParseExif(tiff []byte) Metadata {
+	md := Metadata{Orientation: 1}
+	if len(tiff) < 8 {
+		return md
+	}
+	var order binary.ByteOrder
+	switch string(tiff[0:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return md
+	}
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return md
+	}
+	count := int(order.Uint16(tiff[ifd : ifd+2]))
+	for n := 0; n < count; n++ {
+		entry := ifd + 2 + n*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		tag := order.Uint16(tiff[entry : entry+2])
+		typ := order.Uint16(tiff[entry+2 : entry+4])
+		valueCount := int(order.Uint32(tiff[entry+4 : entry+8]))
+		value := tiff[entry+8 : entry+12]
+		switch {
+		case tag == tagOrientation && typ == typeShort:
+			if o := int(order.Uint16(value)); o >= 1 && o <= 8 {
+				md.Orientation = o
+			}
+		case (tag == tagArtist || tag == tagCopyright) && typ == typeASCII:
+			if valueCount > 4 {
+				offset := int(order.Uint32(value))
+				if offset < 0 || valueCount < 0 || offset+valueCount > len(tiff) {
+					continue
+				}
+				value = tiff[offset : offset+valueCount]
+			} else {
+				value = value[:valueCount]
+			}
+			s := string(bytes.TrimRight(value, "\x00"))
+			if tag == tagArtist {
+				md.Artist = s
+			} else {
+				md.Copyright = s
+			}
+		}
+	}
+	return md
+}
+
+// BuildExif returns a little endian TIFF structured EXIF blob holding only the artist and copyright tags,
+// or nil if both are empty
+func BuildExif(artist, copyright string) []byte {
+	type entry struct {
+		tag   uint16
+		value []byte
+	}
+	var entries []entry
+	if artist != "" {
+		entries = append(entries, entry{tagArtist, append([]byte(artist), 0)})
+	}
+	if copyright != "" {
+		entries = append(entries, entry{tagCopyright, append([]byte(copyright), 0)})
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	order := binary.LittleEndian
+	var buf bytes.Buffer
+	buf.WriteString("II")
+	_ = binary.Write(&buf, order, uint16(42))
+	_ = binary.Write(&buf, order, uint32(8))
+	_ = binary.Write(&buf, order, uint16(len(entries)))
+	dataOffset := 8 + 2 + 12*len(entries) + 4
+	var data []byte
+	for _, e := range entries {
+		_ = binary.Write(&buf, order, e.tag)
+		_ = binary.Write(&buf, order, uint16(typeASCII))
+		_ = binary.Write(&buf, order, uint32(len(e.value)))
+		if len(e.value) <= 4 {
+			buf.Write(append(e.value, make([]byte, 4-len(e.value))...))
+			continue
+		}
+		_ = binary.Write(&buf, order, uint32(dataOffset+len(data)))
+		data = append(data, e.value...)
+		if len(data)%2 == 1 {
+			data = append(data, 0)
+		}
+	}
+	_ = binary.Write(&buf, order, uint32(0))
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+// xmpHeader starts the APP1 segments of JPEGs holding XMP
+var xmpHeader = []byte("http://ns.adobe.com/xap/1.0/\x00")
+
+// HasIdentifying reports whether a JPEG, PNG or WebP file embeds EXIF, XMP, IPTC or text metadata, any of which can
+// name its author or tell where it was taken. Color profiles don't count.
+func HasIdentifying(data []byte) bool {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xff, 0xd8}):
+		for i := 2; i+4 <= len(data); {
+			if data[i] != 0xff {
+				return false
+			}
+			marker := data[i+1]
+			if marker == 0xff {
+				i++
+				continue
+			}
+			if marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+				i += 2
+				continue
+			}
+			if marker == 0xda || marker == 0xd9 {
+				return false
+			}
+			length := int(binary.BigEndian.Uint16(data[i+2 : i+4]))
+			if length < 2 || i+2+length > len(data) {
+				return false
+			}
+			segment := data[i+4 : i+2+length]
+			// EXIF and XMP, IPTC and comments
+			if marker == 0xe1 && (bytes.HasPrefix(segment, exifHeader) || bytes.HasPrefix(segment, xmpHeader)) ||
+				marker == 0xed || marker == 0xfe {
+				return true
+			}
+			i += 2 + length
+		}
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		// unlike the profile, text chunks can come after the image data
+		for i := 8; i+12 <= len(data); {
+			length := int(binary.BigEndian.Uint32(data[i : i+4]))
+			if length < 0 || i+12+length > len(data) {
+				return false
+			}
+			switch string(data[i+4 : i+8]) {
+			case "eXIf", "tEXt", "zTXt", "iTXt":
+				return true
+			case "IEND":
+				return false
+			}
+			i += 12 + length
+		}
+	case len(data) >= 12 && string(data[0:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		for i := 12; i+8 <= len(data); {
+			size := int(binary.LittleEndian.Uint32(data[i+4 : i+8]))
+			if size < 0 || i+8+size > len(data) {
+				return false
+			}
+			switch string(data[i : i+4]) {
+			case "EXIF", "XMP ":
+				return true
+			}
+			i += 8 + size + size%2
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package imagemeta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+func TestExifRoundTrip(t *testing.T) {
+	md := ParseExif(BuildExif("Jo", "(c) Jane Doe"))
+	if md.Artist != "Jo" || md.Copyright != "(c) Jane Doe" || md.Orientation != 1 {
+		t.Errorf("unexpected metadata %+v", md)
+	}
+	if BuildExif("", "") != nil {
+		t.Error("expected no EXIF without tags")
+	}
+	if md := ParseExif([]byte("garbage")); md.Orientation != 1 {
+		t.Errorf("unexpected metadata %+v", md)
+	}
+}
+
+func TestOrient(t *testing.T) {
+	// 3x2 image where every pixel is unique
+	src := image.NewGray(image.Rect(0, 0, 3, 2))
+	for i := range src.Pix {
+		src.Pix[i] = uint8(i)
+	}
+	// the pixel each orientation must bring to the top left corner, and the resulting size
+	tests := map[int]struct {
+		topLeft       uint8
+		width, height int
+	}{
+		1: {0, 3, 2},
+		2: {2, 3, 2},
+		3: {5, 3, 2},
+		4: {3, 3, 2},
+		5: {0, 2, 3},
+		6: {3, 2, 3},
+		7: {5, 2, 3},
+		8: {2, 2, 3},
+	}
+	for orientation, tt := range tests {
+		out := Orient(src, orientation)
+		if out.Bounds().Dx() != tt.width || out.Bounds().Dy() != tt.height {
+			t.Errorf("orientation %d: got %dx%d", orientation, out.Bounds().Dx(), out.Bounds().Dy())
+		}
+		if got := color.GrayModel.Convert(out.At(0, 0)).(color.Gray).Y; got != tt.topLeft {
+			t.Errorf("orientation %d: top left pixel is %d, want %d", orientation, got, tt.topLeft)
+		}
+	}
+}
+
+func TestHasIdentifying(t *testing.T) {
+	var buf bytes.Buffer
+	_ = png.Encode(&buf, image.NewGray(image.Rect(0, 0, 2, 2)))
+	plain := buf.Bytes()
+	if HasIdentifying(plain) {
+		t.Error("a bare PNG has no metadata")
+	}
+	// a tEXt chunk after the image data, right before IEND
+	text := []byte("tEXtAuthor\x00Jane Doe")
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(text)-4))
+	chunk = append(chunk, text...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(text))
+	tagged := append(append(append([]byte{}, plain[:len(plain)-12]...), chunk...), plain[len(plain)-12:]...)
+	if !HasIdentifying(tagged) {
+		t.Error("missed a PNG text chunk")
+	}
+	commented := []byte{0xff, 0xd8, 0xff, 0xfe, 0x00, 0x05, 'h', 'i', '!', 0xff, 0xd9}
+	if !HasIdentifying(commented) {
+		t.Error("missed a JPEG comment")
+	}
+}
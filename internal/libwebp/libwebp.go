@@ -0,0 +1,130 @@
+// Package libwebp encodes still WebPs with the settings of the advanced libwebp API that the chai2010/webp bindings
+// don't expose: the encoder method and near-lossless preprocessing. Images are handed over as 8 bit sRGB pixels, with
+// their color not premultiplied by alpha as libwebp expects, which the bindings get wrong both ways.
+package libwebp
+
+/*
+#cgo pkg-config: libwebp
+#include <stdlib.h>
+#include <webp/decode.h>
+#include <webp/encode.h>
+
+static int mirage_webp_encode(const uint8_t *rgba, int width, int height, int stride, float quality, int lossless,
+		int near_lossless, int method, int exact, uint8_t **out, size_t *size, int *error_code) {
+	WebPConfig config;
+	WebPPicture pic;
+	WebPMemoryWriter writer;
+	if (!WebPConfigInit(&config) || !WebPPictureInit(&pic)) {
+		*error_code = -1;
+		return 0;
+	}
+	config.quality = quality;
+	config.lossless = lossless;
+	config.near_lossless = near_lossless;
+	config.method = method;
+	config.exact = exact;
+	if (!WebPValidateConfig(&config)) {
+		*error_code = -1;
+		return 0;
+	}
+	// lossless encoding works on ARGB, lossy on YUV, which the import converts to
+	pic.use_argb = lossless;
+	pic.width = width;
+	pic.height = height;
+	WebPMemoryWriterInit(&writer);
+	pic.writer = WebPMemoryWrite;
+	pic.custom_ptr = &writer;
+	int ok = WebPPictureImportRGBA(&pic, rgba, stride) && WebPEncode(&config, &pic);
+	*error_code = pic.error_code;
+	WebPPictureFree(&pic);
+	if (!ok) {
+		WebPMemoryWriterClear(&writer);
+		return 0;
+	}
+	*out = writer.mem;
+	*size = writer.size;
+	return 1;
+}
+*/
+import "C"
+
+import (
+	"image"
+	"image/draw"
+	"unsafe"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// Options are the encoder settings
+type Options struct {
+	// Quality is from 0 to 100, it only matters to lossy encoding
+	Quality  float32
+	Lossless bool
+	// NearLossless is the level of near-lossless preprocessing of lossless encoding, from 0 (most preprocessing) to
+	// 100 (none)
+	NearLossless int
+	// Method trades encoding speed for size, from 0 (fastest) to 6 (smallest)
+	Method int
+	// Exact keeps the color of transparent pixels, which are otherwise changed to compress better
+	Exact bool
+}
+
+// Encode encodes img as a still WebP
+func Encode(img image.Image, opts Options) ([]byte, error) {
+	if opts.Quality < 0 || opts.Quality > 100 {
+		return nil, errors.Err("webp quality must be between 0 and 100")
+	}
+	if opts.NearLossless < 0 || opts.NearLossless > 100 {
+		return nil, errors.Err("webp near lossless level must be between 0 and 100")
+	}
+	if opts.Method < 0 || opts.Method > 6 {
+		return nil, errors.Err("webp method must be between 0 and 6")
+	}
+	b := img.Bounds()
+	if b.Empty() {
+		return nil, errors.Err("cannot encode an empty image")
+	}
+	nrgba, ok := img.(*image.NRGBA)
+	if !ok || b.Min != (image.Point{}) {
+		nrgba = image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(nrgba, nrgba.Rect, img, b.Min, draw.Src)
+	}
+	nearLossless := 100
+	if opts.Lossless {
+		nearLossless = opts.NearLossless
+	}
+	var out *C.uint8_t
+	var size C.size_t
+	var code C.int
+	if C.mirage_webp_encode((*C.uint8_t)(unsafe.Pointer(&nrgba.Pix[0])), C.int(b.Dx()), C.int(b.Dy()),
+		C.int(nrgba.Stride), C.float(opts.Quality), cBool(opts.Lossless), C.int(nearLossless), C.int(opts.Method),
+		cBool(opts.Exact), &out, &size, &code) == 0 {
+		return nil, errors.Err("webp encoding failed with error %d", int(code))
+	}
+	defer C.WebPFree(unsafe.Pointer(out))
+	return C.GoBytes(unsafe.Pointer(out), C.int(size)), nil
+}
+
+// Decode decodes a still WebP
+func Decode(data []byte) (*image.NRGBA, error) {
+	if len(data) == 0 {
+		return nil, errors.Err("cannot decode an empty webp")
+	}
+	var width, height C.int
+	pix := C.WebPDecodeRGBA((*C.uint8_t)(unsafe.Pointer(&data[0])), C.size_t(len(data)), &width, &height)
+	if pix == nil {
+		return nil, errors.Err("webp decoding failed")
+	}
+	defer C.WebPFree(unsafe.Pointer(pix))
+	img := image.NewNRGBA(image.Rect(0, 0, int(width), int(height)))
+	copy(img.Pix, unsafe.Slice((*byte)(unsafe.Pointer(pix)), len(img.Pix)))
+	return img, nil
+}
+
+func cBool(b bool) C.int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,54 @@
+package libwebp
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestEncode(t *testing.T) {
+	// semi-transparent pixels make sure the colors aren't premultiplied on the way in or out
+	img := image.NewNRGBA(image.Rect(0, 0, 96, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 96; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(x * 2), G: uint8(y * 4), B: 200, A: uint8(255 - y*2)})
+		}
+	}
+	lossless, err := Encode(img, Options{Lossless: true, NearLossless: 100, Method: 6, Exact: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := Decode(lossless)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Rect != img.Rect {
+		t.Fatalf("decoded as %v", decoded.Rect)
+	}
+	for i := range img.Pix {
+		if decoded.Pix[i] != img.Pix[i] {
+			t.Fatalf("lossless output differs at byte %d: %d instead of %d", i, decoded.Pix[i], img.Pix[i])
+		}
+	}
+
+	fast, err := Encode(img, Options{Quality: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	small, err := Encode(img, Options{Quality: 80, Method: 6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fast) <= len(small) {
+		t.Errorf("method 0 encoded %d bytes, method 6 %d", len(fast), len(small))
+	}
+
+	for _, opts := range []Options{{Quality: 101}, {Method: 7}, {Lossless: true, NearLossless: -1}} {
+		if _, err := Encode(img, opts); err == nil {
+			t.Errorf("%+v was accepted", opts)
+		}
+	}
+	if _, err := Decode([]byte("RIFF")); err == nil {
+		t.Error("a truncated webp was decoded")
+	}
+}
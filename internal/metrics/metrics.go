@@ -7,13 +7,18 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
-func InstallRoute(r *gin.Engine) {
+// InstallRoute instruments the routes of both r and exposed, and exposes /metrics on exposed.
+// Both can be the same engine. Only the routes added afterwards are instrumented.
+func InstallRoute(r *gin.Engine, exposed *gin.Engine) {
 	p := ginprom.New(
-		ginprom.Engine(r),
+		ginprom.Engine(exposed),
 		ginprom.Subsystem("gin"),
 		ginprom.Path("/metrics"),
 	)
 	r.Use(p.Instrument())
+	if exposed != r {
+		exposed.Use(p.Instrument())
+	}
 }
 
 const (
@@ -39,16 +44,66 @@ var (
 		Name:      "requests_cached",
 		Help:      "Total number of requested images found in cache",
 	})
+	DuplicateSources = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: "http",
+		Name:      "duplicate_sources_total",
+		Help:      "Total number of sources found byte-identical to an already cached one",
+	})
 	OptimizedImages = promauto.NewCounter(prometheus.CounterOpts{
 		Namespace: ns,
 		Subsystem: "optimizer",
 		Name:      "webp_total",
 		Help:      "Total number of webp optimized images",
 	})
+	InputFormats = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: "optimizer",
+		Name:      "input_formats_total",
+		Help:      "Total number of images optimized by detected source mime type",
+	}, []string{"mime"})
+	ColorConversions = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: "optimizer",
+		Name:      "color_conversions_total",
+		Help:      "Total number of images converted from an embedded color profile to sRGB",
+	})
 	JpegOptimizedImages = promauto.NewCounter(prometheus.CounterOpts{
 		Namespace: ns,
 		Subsystem: "optimizer",
 		Name:      "jpeg_total",
 		Help:      "Total number of jpeg optimized images",
 	})
+	PngEncodings = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: "optimizer",
+		Name:      "png_encodings_total",
+		Help:      "Total number of images encoded to PNG, by quantized, palette or truecolor output",
+	}, []string{"type"})
+	SizeComparisons = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: "optimizer",
+		Name:      "size_comparisons_total",
+		Help:      "Total number of outputs compared with their source, by which of the two was kept",
+	}, []string{"kept"})
+	WebPEncodings = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: "optimizer",
+		Name:      "webp_encodings_total",
+		Help:      "Total number of still images encoded to WebP, by lossy, near-lossless or lossless encoding",
+	}, []string{"encoding"})
+	AutoQuality = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: "optimizer",
+		Name:      "auto_quality",
+		Help:      "Qualities picked by the auto quality search",
+		Buckets:   prometheus.LinearBuckets(40, 5, 12),
+	})
+	ProcessorDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: "optimizer",
+		Name:      "processor_load_seconds",
+		Help:      "Time taken to decode and resize still sources, by processor",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+	}, []string{"processor"})
 )
@@ -0,0 +1,33 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestInstallRouteInstrumentsBothEngines(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	public, admin := gin.New(), gin.New()
+	InstallRoute(public, admin)
+	public.GET("/optimize", func(c *gin.Context) { c.Status(http.StatusOK) })
+	admin.POST("/admin/purge", func(c *gin.Context) { c.Status(http.StatusAccepted) })
+
+	for _, r := range []struct {
+		engine *gin.Engine
+		method string
+		path   string
+	}{{public, http.MethodGet, "/optimize"}, {admin, http.MethodPost, "/admin/purge"}} {
+		r.engine.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(r.method, r.path, nil))
+	}
+	rec := httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, path := range []string{`path="/optimize"`, `path="/admin/purge"`} {
+		if !strings.Contains(rec.Body.String(), path) {
+			t.Errorf("no gin metrics for %s", path)
+		}
+	}
+}
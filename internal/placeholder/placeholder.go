@@ -0,0 +1,305 @@
+// Package placeholder computes the compact representations clients render while an image loads
+package placeholder
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"strings"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+const base83 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+func encode83(value, length int) string {
+	var sb strings.Builder
+	for i := 1; i <= length; i++ {
+		digit := (value / int(math.Pow(83, float64(length-i)))) % 83
+		sb.WriteByte(base83[digit])
+	}
+	return sb.String()
+}
+
+// BlurHash encodes img (which should already be small, e.g. 32px, since every pixel is visited once per
+// component) with xComponents by yComponents components, see https://blurha.sh
+func BlurHash(img image.Image, xComponents, yComponents int) (string, error) {
+	if xComponents < 1 || xComponents > 9 || yComponents < 1 || yComponents > 9 {
+		return "", errors.Err("blurhash components must be between 1 and 9")
+	}
+	b := img.Bounds()
+	width, height := b.Dx(), b.Dy()
+	if width == 0 || height == 0 {
+		return "", errors.Err("empty image")
+	}
+	linear := make([][3]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color.NRGBAModel.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.NRGBA)
+			linear[y*width+x] = [3]float64{srgbToLinear(c.R), srgbToLinear(c.G), srgbToLinear(c.B)}
+		}
+	}
+	factors := make([][3]float64, 0, xComponents*yComponents)
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+			var f [3]float64
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					basis := normalisation * math.Cos(math.Pi*float64(i*x)/float64(width)) * math.Cos(math.Pi*float64(j*y)/float64(height))
+					for c := range f {
+						f[c] += basis * linear[y*width+x][c]
+					}
+				}
+			}
+			for c := range f {
+				f[c] /= float64(width * height)
+			}
+			factors = append(factors, f)
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString(encode83((xComponents-1)+(yComponents-1)*9, 1))
+	maxValue := 1.0
+	if len(factors) > 1 {
+		var actualMax float64
+		for _, f := range factors[1:] {
+			for _, v := range f {
+				actualMax = math.Max(actualMax, math.Abs(v))
+			}
+		}
+		quantisedMax := int(math.Max(0, math.Min(82, math.Floor(actualMax*166-0.5))))
+		maxValue = float64(quantisedMax+1) / 166
+		sb.WriteString(encode83(quantisedMax, 1))
+	} else {
+		sb.WriteString(encode83(0, 1))
+	}
+	dc := factors[0]
+	sb.WriteString(encode83(int(linearToSRGB(dc[0]))<<16+int(linearToSRGB(dc[1]))<<8+int(linearToSRGB(dc[2])), 4))
+	for _, f := range factors[1:] {
+		quantise := func(v float64) int {
+			return int(math.Max(0, math.Min(18, math.Floor(signPow(v/maxValue, 0.5)*9+9.5))))
+		}
+		sb.WriteString(encode83(quantise(f[0])*19*19+quantise(f[1])*19+quantise(f[2]), 2))
+	}
+	return sb.String(), nil
+}
+
+// ThumbHash encodes img, which must be at most 100x100, see https://evanw.github.io/thumbhash/
+func ThumbHash(img image.Image) ([]byte, error) {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w == 0 || h == 0 || w > 100 || h > 100 {
+		return nil, errors.Err("thumbhash needs an image of at most 100x100, got %dx%d", w, h)
+	}
+	rgba := make([]color.NRGBA, w*h)
+	var avgR, avgG, avgB, avgA float64
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.NRGBAModel.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.NRGBA)
+			rgba[y*w+x] = c
+			alpha := float64(c.A) / 255
+			avgR += alpha / 255 * float64(c.R)
+			avgG += alpha / 255 * float64(c.G)
+			avgB += alpha / 255 * float64(c.B)
+			avgA += alpha
+		}
+	}
+	if avgA > 0 {
+		avgR /= avgA
+		avgG /= avgA
+		avgB /= avgA
+	}
+	hasAlpha := avgA < float64(w*h)
+	lLimit := 7.0
+	// fewer luminance bits when there's alpha
+	if hasAlpha {
+		lLimit = 5
+	}
+	maxSide := float64(max(w, h))
+	lx := max(1, int(round(lLimit*float64(w)/maxSide)))
+	ly := max(1, int(round(lLimit*float64(h)/maxSide)))
+	// luminance, yellow - blue, red - green and alpha, composited atop the average color
+	l := make([]float64, w*h)
+	p := make([]float64, w*h)
+	q := make([]float64, w*h)
+	a := make([]float64, w*h)
+	for i, c := range rgba {
+		alpha := float64(c.A) / 255
+		r := avgR*(1-alpha) + alpha/255*float64(c.R)
+		g := avgG*(1-alpha) + alpha/255*float64(c.G)
+		bl := avgB*(1-alpha) + alpha/255*float64(c.B)
+		l[i] = (r + g + bl) / 3
+		p[i] = (r+g)/2 - bl
+		q[i] = r - g
+		a[i] = alpha
+	}
+	// DCT into the DC (constant) term and the AC (varying) ones, normalized to 0-1
+	encodeChannel := func(channel []float64, nx, ny int) (dc float64, ac []float64, scale float64) {
+		fx := make([]float64, w)
+		for cy := 0; cy < ny; cy++ {
+			for cx := 0; cx*ny < nx*(ny-cy); cx++ {
+				var f float64
+				for x := 0; x < w; x++ {
+					fx[x] = math.Cos(math.Pi / float64(w) * float64(cx) * (float64(x) + 0.5))
+				}
+				for y := 0; y < h; y++ {
+					fy := math.Cos(math.Pi / float64(h) * float64(cy) * (float64(y) + 0.5))
+					for x := 0; x < w; x++ {
+						f += channel[x+y*w] * fx[x] * fy
+					}
+				}
+				f /= float64(w * h)
+				if cx > 0 || cy > 0 {
+					ac = append(ac, f)
+					scale = math.Max(scale, math.Abs(f))
+				} else {
+					dc = f
+				}
+			}
+		}
+		if scale > 0 {
+			for i := range ac {
+				ac[i] = 0.5 + 0.5/scale*ac[i]
+			}
+		}
+		return dc, ac, scale
+	}
+	lDC, lAC, lScale := encodeChannel(l, max(3, lx), max(3, ly))
+	pDC, pAC, pScale := encodeChannel(p, 3, 3)
+	qDC, qAC, qScale := encodeChannel(q, 3, 3)
+	var aDC, aScale float64
+	var aAC []float64
+	if hasAlpha {
+		aDC, aAC, aScale = encodeChannel(a, 5, 5)
+	}
+
+	isLandscape := w > h
+	header24 := int(round(63*lDC)) | int(round(31.5+31.5*pDC))<<6 | int(round(31.5+31.5*qDC))<<12 | int(round(31*lScale))<<18
+	if hasAlpha {
+		header24 |= 1 << 23
+	}
+	header16 := lx
+	if isLandscape {
+		header16 = ly
+	}
+	header16 |= int(round(63*pScale))<<3 | int(round(63*qScale))<<9
+	if isLandscape {
+		header16 |= 1 << 15
+	}
+	hash := []byte{byte(header24), byte(header24 >> 8), byte(header24 >> 16), byte(header16), byte(header16 >> 8)}
+	channels := [][]float64{lAC, pAC, qAC}
+	if hasAlpha {
+		hash = append(hash, byte(int(round(15*aDC))|int(round(15*aScale))<<4))
+		channels = append(channels, aAC)
+	}
+	acStart := len(hash)
+	acIndex := 0
+	for _, ac := range channels {
+		for _, f := range ac {
+			i := acStart + acIndex>>1
+			if i >= len(hash) {
+				hash = append(hash, 0)
+			}
+			hash[i] |= byte(int(round(15*f)) << ((acIndex & 1) << 2))
+			acIndex++
+		}
+	}
+	return hash, nil
+}
+
+// DominantColor returns the average of the most common color, bucketed at 4 bits per channel.
+// Transparent pixels are ignored.
+func DominantColor(img image.Image) color.NRGBA {
+	type bucket struct {
+		count   int
+		r, g, b int
+	}
+	buckets := make(map[int]*bucket)
+	var best *bucket
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if c.A < 128 {
+				continue
+			}
+			key := int(c.R>>4)<<8 | int(c.G>>4)<<4 | int(c.B>>4)
+			bk := buckets[key]
+			if bk == nil {
+				bk = &bucket{}
+				buckets[key] = bk
+			}
+			bk.count++
+			bk.r += int(c.R)
+			bk.g += int(c.G)
+			bk.b += int(c.B)
+			if best == nil || bk.count > best.count {
+				best = bk
+			}
+		}
+	}
+	if best == nil {
+		return color.NRGBA{}
+	}
+	return color.NRGBA{
+		R: uint8(best.r / best.count),
+		G: uint8(best.g / best.count),
+		B: uint8(best.b / best.count),
+		A: 255,
+	}
+}
+
+// AverageColor returns the mean color of img, weighing pixels by their opacity
+func AverageColor(img image.Image) color.NRGBA {
+	var r, g, bl, weight float64
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			alpha := float64(c.A) / 255
+			r += alpha * float64(c.R)
+			g += alpha * float64(c.G)
+			bl += alpha * float64(c.B)
+			weight += alpha
+		}
+	}
+	if weight == 0 {
+		return color.NRGBA{}
+	}
+	return color.NRGBA{
+		R: uint8(math.Round(r / weight)),
+		G: uint8(math.Round(g / weight)),
+		B: uint8(math.Round(bl / weight)),
+		A: 255,
+	}
+}
+
+// round rounds half up like JavaScript's Math.round, which the ThumbHash reference uses
+func round(v float64) float64 {
+	return math.Floor(v + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
+
+func srgbToLinear(v uint8) float64 {
+	f := float64(v) / 255
+	if f <= 0.04045 {
+		return f / 12.92
+	}
+	return math.Pow((f+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) int {
+	v = math.Max(0, math.Min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
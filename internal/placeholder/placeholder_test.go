@@ -0,0 +1,45 @@
+package placeholder
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+func TestUniformImage(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 20, 10))
+	draw.Draw(img, img.Bounds(), &image.Uniform{C: color.NRGBA{R: 200, G: 40, B: 40, A: 255}}, image.Point{}, draw.Src)
+
+	hash, err := BlurHash(img, 4, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the DC component is the average color
+	if len(hash) != 28 || hash[2:6] != encode83(200<<16|40<<8|40, 4) {
+		t.Errorf("unexpected blurhash %q", hash)
+	}
+
+	thumb, err := ThumbHash(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(thumb) < 5 || thumb[4]&0x80 == 0 {
+		t.Errorf("landscape flag not set in thumbhash %x", thumb)
+	}
+
+	if c := DominantColor(img); c != (color.NRGBA{R: 200, G: 40, B: 40, A: 255}) {
+		t.Errorf("dominant color is %v", c)
+	}
+}
+
+func TestDominantColorIgnoresTransparency(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+	draw.Draw(img, image.Rect(0, 0, 3, 3), &image.Uniform{C: color.NRGBA{G: 255, A: 255}}, image.Point{}, draw.Src)
+	if c := DominantColor(img); c != (color.NRGBA{G: 255, A: 255}) {
+		t.Errorf("dominant color is %v", c)
+	}
+	if _, err := ThumbHash(image.NewNRGBA(image.Rect(0, 0, 101, 10))); err == nil {
+		t.Errorf("thumbhash accepted an image over 100px")
+	}
+}
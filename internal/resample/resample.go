@@ -0,0 +1,231 @@
+// Package resample resizes images with a choice of kernels, optionally in linear light. Pixels are resampled
+// premultiplied, so that transparent areas don't bleed their color into the opaque ones.
+package resample
+
+import (
+	"image"
+	"image/draw"
+	"math"
+	"runtime"
+	"sync"
+)
+
+// Filter is a resampling kernel
+type Filter struct {
+	// Support is how far from its center the kernel reaches, in source pixels when upscaling
+	Support float64
+	At      func(x float64) float64
+}
+
+var (
+	// Nearest picks the closest source pixel
+	Nearest = Filter{Support: 0}
+	// Bilinear is the triangle kernel
+	Bilinear = Filter{Support: 1, At: func(x float64) float64 {
+		return 1 - math.Abs(x)
+	}}
+	// CatmullRom is the cubic kernel with B = 0 and C = 0.5, sharper than bilinear with little ringing
+	CatmullRom = Filter{Support: 2, At: func(x float64) float64 {
+		x = math.Abs(x)
+		if x < 1 {
+			return 1.5*x*x*x - 2.5*x*x + 1
+		}
+		return -0.5*x*x*x + 2.5*x*x - 4*x + 2
+	}}
+	// Lanczos3 is the windowed sinc of three lobes, the sharpest of them
+	Lanczos3 = Filter{Support: 3, At: func(x float64) float64 {
+		if x == 0 {
+			return 1
+		}
+		x *= math.Pi
+		return 3 * math.Sin(x) * math.Sin(x/3) / (x * x)
+	}}
+)
+
+// Size returns the output size for the requested one: a zero keeps the aspect ratio, both keep the source size.
+// It rounds like nfnt/resize did, so that existing variants keep their size.
+func Size(srcWidth, srcHeight, width, height int) (int, int) {
+	switch {
+	case width == 0 && height == 0:
+		return srcWidth, srcHeight
+	case width == 0:
+		width = int(0.7 + float64(srcWidth)*float64(height)/float64(srcHeight))
+	case height == 0:
+		height = int(0.7 + float64(srcHeight)*float64(width)/float64(srcWidth))
+	}
+	return max(width, 1), max(height, 1)
+}
+
+// Thumbnail returns img downscaled to fit in maxWidth by maxHeight, keeping its aspect ratio. Images that already fit
+// are returned as they are.
+func Thumbnail(img image.Image, maxWidth, maxHeight int, filter Filter) image.Image {
+	b := img.Bounds()
+	if b.Dx() <= maxWidth && b.Dy() <= maxHeight {
+		return img
+	}
+	if b.Dx()*maxHeight >= b.Dy()*maxWidth {
+		return Resize(img, maxWidth, 0, filter, false)
+	}
+	return Resize(img, 0, maxHeight, filter, false)
+}
+
+// Resize returns img resized to width and height as computed by Size. The image is returned as is when its size
+// doesn't change.
+func Resize(img image.Image, width, height int, filter Filter, linear bool) image.Image {
+	b := img.Bounds()
+	width, height = Size(b.Dx(), b.Dy(), width, height)
+	if b.Empty() || width == b.Dx() && height == b.Dy() {
+		return img
+	}
+	src := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Rect, img, b.Min, draw.Src)
+	toFloat, toByte := gammaTables(linear)
+
+	// premultiplied float pixels, then resized horizontally, then vertically
+	in := make([]float32, 4*b.Dx()*b.Dy())
+	parallel(b.Dy(), func(y int) {
+		for x := 0; x < b.Dx(); x++ {
+			i := 4 * (y*b.Dx() + x)
+			p := src.Pix[y*src.Stride+4*x:]
+			a := float32(p[3]) / 255
+			in[i], in[i+1], in[i+2], in[i+3] = toFloat[p[0]]*a, toFloat[p[1]]*a, toFloat[p[2]]*a, a
+		}
+	})
+	horizontal := make([]float32, 4*width*b.Dy())
+	columns := contributions(b.Dx(), width, filter)
+	parallel(b.Dy(), func(y int) {
+		for x, c := range columns {
+			var sum [4]float32
+			for k, w := range c.weights {
+				i := 4 * (y*b.Dx() + c.start + k)
+				sum[0] += in[i] * w
+				sum[1] += in[i+1] * w
+				sum[2] += in[i+2] * w
+				sum[3] += in[i+3] * w
+			}
+			copy(horizontal[4*(y*width+x):], sum[:])
+		}
+	})
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	rows := contributions(b.Dy(), height, filter)
+	parallel(height, func(y int) {
+		c := rows[y]
+		for x := 0; x < width; x++ {
+			var sum [4]float32
+			for k, w := range c.weights {
+				i := 4 * ((c.start+k)*width + x)
+				sum[0] += horizontal[i] * w
+				sum[1] += horizontal[i+1] * w
+				sum[2] += horizontal[i+2] * w
+				sum[3] += horizontal[i+3] * w
+			}
+			p := dst.Pix[y*dst.Stride+4*x:]
+			a := min(max(sum[3], 0), 1)
+			p[3] = uint8(a*255 + 0.5)
+			if p[3] == 0 {
+				continue
+			}
+			for k := 0; k < 3; k++ {
+				v := min(max(sum[k]/a, 0), 1)
+				p[k] = toByte[int(v*float32(len(toByte)-1)+0.5)]
+			}
+		}
+	})
+	return dst
+}
+
+// contribution is the weights of the source pixels, from start on, making up an output pixel
+type contribution struct {
+	start   int
+	weights []float32
+}
+
+func contributions(in, out int, filter Filter) []contribution {
+	scale := float64(in) / float64(out)
+	c := make([]contribution, out)
+	if filter.At == nil {
+		for i := range c {
+			c[i] = contribution{start: min(int((float64(i)+0.5)*scale), in-1), weights: []float32{1}}
+		}
+		return c
+	}
+	// downscaling stretches the kernel over as many source pixels as an output pixel covers
+	stretch := max(scale, 1)
+	support := filter.Support * stretch
+	for i := range c {
+		center := (float64(i)+0.5)*scale - 0.5
+		start := max(int(math.Ceil(center-support)), 0)
+		end := min(int(math.Floor(center+support)), in-1)
+		weights := make([]float32, 0, end-start+1)
+		var total float64
+		for j := start; j <= end; j++ {
+			w := filter.At((float64(j) - center) / stretch)
+			if math.Abs(float64(j)-center) >= support {
+				w = 0
+			}
+			weights = append(weights, float32(w))
+			total += w
+		}
+		if total != 0 {
+			for k := range weights {
+				weights[k] = float32(float64(weights[k]) / total)
+			}
+		}
+		c[i] = contribution{start: start, weights: weights}
+	}
+	return c
+}
+
+var (
+	tablesOnce              sync.Once
+	gammaFloat, linearFloat [256]float32
+	gammaByte, encodeByte   []uint8
+)
+
+// gammaTables returns the conversions of a byte to a float in the space resizing happens in, and of such a float
+// (as an index in steps of 1/(len-1)) back to a byte
+func gammaTables(linear bool) (*[256]float32, []uint8) {
+	tablesOnce.Do(func() {
+		gammaByte = make([]uint8, 256)
+		encodeByte = make([]uint8, 4096)
+		for i := 0; i < 256; i++ {
+			gammaFloat[i] = float32(i) / 255
+			gammaByte[i] = uint8(i)
+			v := float64(i) / 255
+			if v <= 0.04045 {
+				linearFloat[i] = float32(v / 12.92)
+			} else {
+				linearFloat[i] = float32(math.Pow((v+0.055)/1.055, 2.4))
+			}
+		}
+		for i := range encodeByte {
+			v := float64(i) / float64(len(encodeByte)-1)
+			if v <= 0.0031308 {
+				v *= 12.92
+			} else {
+				v = 1.055*math.Pow(v, 1/2.4) - 0.055
+			}
+			encodeByte[i] = uint8(v*255 + 0.5)
+		}
+	})
+	if linear {
+		return &linearFloat, encodeByte
+	}
+	return &gammaFloat, gammaByte
+}
+
+// parallel calls f for every row, spread over the available CPUs
+func parallel(rows int, f func(y int)) {
+	workers := min(runtime.GOMAXPROCS(0), rows)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for y := w; y < rows; y += workers {
+				f(y)
+			}
+		}(w)
+	}
+	wg.Wait()
+}
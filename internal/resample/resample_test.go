@@ -0,0 +1,123 @@
+package resample
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestSize(t *testing.T) {
+	tests := []struct {
+		srcW, srcH, w, h int
+		wantW, wantH     int
+	}{
+		{1000, 500, 0, 0, 1000, 500},
+		{1000, 500, 300, 0, 300, 150},
+		{1000, 500, 0, 100, 200, 100},
+		{1000, 667, 150, 0, 150, 100},
+		{100, 3, 10, 0, 10, 1},
+		{1000, 500, 40, 40, 40, 40},
+	}
+	for _, tt := range tests {
+		if w, h := Size(tt.srcW, tt.srcH, tt.w, tt.h); w != tt.wantW || h != tt.wantH {
+			t.Errorf("%dx%d to %dx%d: got %dx%d", tt.srcW, tt.srcH, tt.w, tt.h, w, h)
+		}
+	}
+}
+
+func TestResize(t *testing.T) {
+	flat := image.NewNRGBA(image.Rect(0, 0, 97, 61))
+	for i := 0; i < len(flat.Pix); i += 4 {
+		copy(flat.Pix[i:], []uint8{200, 90, 30, 255})
+	}
+	filters := map[string]Filter{"nearest": Nearest, "bilinear": Bilinear, "catmullrom": CatmullRom, "lanczos3": Lanczos3}
+	for name, filter := range filters {
+		for _, linear := range []bool{false, true} {
+			for _, size := range [][2]int{{40, 0}, {200, 130}} {
+				img := Resize(flat, size[0], size[1], filter, linear)
+				if got := img.Bounds().Dx(); got != size[0] {
+					t.Errorf("%s: %d pixels wide instead of %d", name, got, size[0])
+				}
+				// a flat image stays flat whatever the kernel
+				b := img.Bounds()
+				for y := b.Min.Y; y < b.Max.Y; y++ {
+					for x := b.Min.X; x < b.Max.X; x++ {
+						if c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA); c != (color.NRGBA{R: 200, G: 90, B: 30, A: 255}) {
+							t.Fatalf("%s, linear %t, %v: %v at %d,%d", name, linear, size, c, x, y)
+						}
+					}
+				}
+			}
+		}
+	}
+	if Resize(flat, 97, 0, Lanczos3, false) != image.Image(flat) {
+		t.Error("resizing to the same size made a copy")
+	}
+
+	// nearest upscaling by an integer factor repeats the pixels
+	small := image.NewGray(image.Rect(0, 0, 2, 2))
+	copy(small.Pix, []uint8{0, 80, 160, 240})
+	big := Resize(small, 4, 4, Nearest, false)
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			r, _, _, _ := big.At(x, y).RGBA()
+			if want := small.Pix[y/2*2+x/2]; uint8(r>>8) != want {
+				t.Errorf("nearest %d,%d: %d instead of %d", x, y, r>>8, want)
+			}
+		}
+	}
+}
+
+func TestLinear(t *testing.T) {
+	// a black and white checkerboard averages to 50% of the light, which is 188 in sRGB rather than 128
+	checker := image.NewGray(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			if (x+y)%2 == 0 {
+				checker.Pix[y*checker.Stride+x] = 255
+			}
+		}
+	}
+	for linear, want := range map[bool]uint32{false: 128, true: 188} {
+		img := Resize(checker, 8, 8, Bilinear, linear)
+		r, _, _, _ := img.At(4, 4).RGBA()
+		if got := r >> 8; got+2 < want || got > want+2 {
+			t.Errorf("linear %t: %d instead of %d", linear, got, want)
+		}
+	}
+}
+
+func TestTransparency(t *testing.T) {
+	// the color of transparent pixels doesn't bleed into the opaque ones
+	img := image.NewNRGBA(image.Rect(0, 0, 32, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			c := color.NRGBA{R: 255, A: 0}
+			if x >= 16 {
+				c = color.NRGBA{B: 255, A: 255}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	resized := Resize(img, 8, 8, Lanczos3, false)
+	for x := 0; x < 8; x++ {
+		c := color.NRGBAModel.Convert(resized.At(x, 4)).(color.NRGBA)
+		if c.A > 0 && c.R > 2 {
+			t.Errorf("red bled into %v at %d", c, x)
+		}
+	}
+}
+
+func TestThumbnail(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 90, 30))
+	if got := Thumbnail(img, 32, 32, Bilinear).Bounds(); got != image.Rect(0, 0, 32, 11) {
+		t.Errorf("wide image thumbnailed to %v", got)
+	}
+	tall := image.NewGray(image.Rect(0, 0, 30, 90))
+	if got := Thumbnail(tall, 32, 32, Bilinear).Bounds(); got != image.Rect(0, 0, 11, 32) {
+		t.Errorf("tall image thumbnailed to %v", got)
+	}
+	if Thumbnail(img, 100, 100, Bilinear) != image.Image(img) {
+		t.Error("an image that fits was resized")
+	}
+}
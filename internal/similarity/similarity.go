@@ -0,0 +1,104 @@
+package similarity
+
+import (
+	"image"
+	"math"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+const (
+	// window is the side of the square blocks SSIM statistics are computed over
+	window = 8
+	// stride is how far apart consecutive windows start
+	stride = 4
+
+	c1 = (0.01 * 255) * (0.01 * 255)
+	c2 = (0.03 * 255) * (0.03 * 255)
+)
+
+// SSIM returns the mean structural similarity of the luma of two images of the same size, from -1 to 1 (identical)
+func SSIM(a, b image.Image) (float64, error) {
+	if a.Bounds().Dx() != b.Bounds().Dx() || a.Bounds().Dy() != b.Bounds().Dy() {
+		return 0, errors.Err("cannot compare a %dx%d image with a %dx%d one", a.Bounds().Dx(), a.Bounds().Dy(), b.Bounds().Dx(), b.Bounds().Dy())
+	}
+	la, lb := luma(a), luma(b)
+	width, height := a.Bounds().Dx(), a.Bounds().Dy()
+	w, h := min(window, width), min(window, height)
+	if w == 0 || h == 0 {
+		return 0, errors.Err("cannot compare empty images")
+	}
+	var total float64
+	var windows int
+	for y := 0; y+h <= height; y += stride {
+		for x := 0; x+w <= width; x += stride {
+			total += windowSSIM(la, lb, width, x, y, w, h)
+			windows++
+		}
+	}
+	return total / float64(windows), nil
+}
+
+func windowSSIM(a, b []float64, stride, x0, y0, w, h int) float64 {
+	n := float64(w * h)
+	var sumA, sumB float64
+	for y := y0; y < y0+h; y++ {
+		for x := x0; x < x0+w; x++ {
+			sumA += a[y*stride+x]
+			sumB += b[y*stride+x]
+		}
+	}
+	meanA, meanB := sumA/n, sumB/n
+	var varA, varB, covar float64
+	for y := y0; y < y0+h; y++ {
+		for x := x0; x < x0+w; x++ {
+			da, db := a[y*stride+x]-meanA, b[y*stride+x]-meanB
+			varA += da * da
+			varB += db * db
+			covar += da * db
+		}
+	}
+	varA, varB, covar = varA/n, varB/n, covar/n
+	return ((2*meanA*meanB + c1) * (2*covar + c2)) / ((meanA*meanA + meanB*meanB + c1) * (varA + varB + c2))
+}
+
+// PSNR returns the peak signal to noise ratio in dB between the RGB channels of two images of the same size.
+// Identical images return +Inf.
+func PSNR(a, b image.Image) (float64, error) {
+	if a.Bounds().Dx() != b.Bounds().Dx() || a.Bounds().Dy() != b.Bounds().Dy() {
+		return 0, errors.Err("cannot compare a %dx%d image with a %dx%d one", a.Bounds().Dx(), a.Bounds().Dy(), b.Bounds().Dx(), b.Bounds().Dy())
+	}
+	ba, bb := a.Bounds(), b.Bounds()
+	var sum float64
+	for y := 0; y < ba.Dy(); y++ {
+		for x := 0; x < ba.Dx(); x++ {
+			r1, g1, b1, _ := a.At(ba.Min.X+x, ba.Min.Y+y).RGBA()
+			r2, g2, b2, _ := b.At(bb.Min.X+x, bb.Min.Y+y).RGBA()
+			for _, d := range []float64{diff8(r1, r2), diff8(g1, g2), diff8(b1, b2)} {
+				sum += d * d
+			}
+		}
+	}
+	mse := sum / float64(3*ba.Dx()*ba.Dy())
+	if mse == 0 {
+		return math.Inf(1), nil
+	}
+	return 10 * math.Log10(255*255/mse), nil
+}
+
+func diff8(a, b uint32) float64 {
+	return float64(a>>8) - float64(b>>8)
+}
+
+// luma flattens img to row-major BT.601 luma on a 0-255 scale. Transparent pixels count as black.
+func luma(img image.Image) []float64 {
+	bounds := img.Bounds()
+	out := make([]float64, 0, bounds.Dx()*bounds.Dy())
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			out = append(out, (0.299*float64(r)+0.587*float64(g)+0.114*float64(b))/257)
+		}
+	}
+	return out
+}
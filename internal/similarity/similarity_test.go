@@ -0,0 +1,62 @@
+package similarity
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+func gradient(width, height int, offset uint8) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetGray(x, y, color.Gray{Y: uint8(x*4+y) + offset})
+		}
+	}
+	return img
+}
+
+func TestIdentical(t *testing.T) {
+	img := gradient(40, 30, 0)
+	ssim, err := SSIM(img, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(ssim-1) > 1e-9 {
+		t.Errorf("SSIM of identical images is %f", ssim)
+	}
+	psnr, err := PSNR(img, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !math.IsInf(psnr, 1) {
+		t.Errorf("PSNR of identical images is %f", psnr)
+	}
+}
+
+func TestDegraded(t *testing.T) {
+	ssim, err := SSIM(gradient(40, 30, 0), gradient(40, 30, 20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ssim >= 1 || ssim <= 0 {
+		t.Errorf("SSIM of shifted images is %f", ssim)
+	}
+	psnr, err := PSNR(gradient(40, 30, 0), gradient(40, 30, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(psnr-10*math.Log10(255.0*255.0/4)) > 1e-9 {
+		t.Errorf("PSNR of images off by 2 is %f", psnr)
+	}
+}
+
+func TestSizeMismatch(t *testing.T) {
+	if _, err := SSIM(gradient(40, 30, 0), gradient(30, 40, 0)); err == nil {
+		t.Error("expected an error comparing images of different sizes")
+	}
+	if _, err := PSNR(gradient(40, 30, 0), gradient(30, 40, 0)); err == nil {
+		t.Error("expected an error comparing images of different sizes")
+	}
+}
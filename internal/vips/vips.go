@@ -0,0 +1,292 @@
+// Package vips encodes images with the settings of the libvips savers that bimg doesn't expose, and decodes JPEGs
+// shrunk on load. Images are handed over as 8 bit sRGB pixels.
+package vips
+
+/*
+#cgo pkg-config: vips
+#include <stdlib.h>
+#include <vips/vips.h>
+
+static int mirage_vips_init(void) {
+	return VIPS_INIT("mirage");
+}
+
+static int mirage_vips_srgb(void *pixels, size_t size, int width, int height, int bands, VipsImage **out) {
+	VipsImage *in = vips_image_new_from_memory_copy(pixels, size, width, height, bands, VIPS_FORMAT_UCHAR);
+	if (in == NULL) {
+		return -1;
+	}
+	int err = vips_copy(in, out, "interpretation", VIPS_INTERPRETATION_sRGB, NULL);
+	g_object_unref(in);
+	return err;
+}
+
+static int mirage_vips_jpegsave(VipsImage *in, void **buf, size_t *len, int quality, int interlace, int subsample,
+		int trellis, int optimize_coding, int quant_table) {
+	return vips_jpegsave_buffer(in, buf, len,
+		"strip", TRUE,
+		"Q", quality,
+		"interlace", interlace,
+		"subsample_mode", subsample,
+		"trellis_quant", trellis,
+		"overshoot_deringing", trellis,
+		"optimize_scans", interlace && trellis,
+		"optimize_coding", optimize_coding,
+		"quant_table", quant_table,
+		NULL);
+}
+
+static int mirage_vips_pngsave(VipsImage *in, void **buf, size_t *len, int compression, int palette, int bitdepth,
+		int quality, double dither, int strip) {
+	return vips_pngsave_buffer(in, buf, len,
+		"strip", strip,
+		"compression", compression,
+		"palette", palette,
+		"bitdepth", bitdepth,
+		"Q", quality,
+		"dither", dither,
+		NULL);
+}
+
+static int mirage_vips_jpegload_shrink(void *buf, size_t len, int shrink, VipsImage **out) {
+	return vips_jpegload_buffer(buf, len, out, "shrink", shrink, "fail", TRUE, NULL);
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+var (
+	initOnce sync.Once
+	initErr  error
+)
+
+func initialize() error {
+	initOnce.Do(func() {
+		if C.mirage_vips_init() != 0 {
+			initErr = lastError()
+		}
+	})
+	return initErr
+}
+
+// lastError returns the error libvips reported last
+func lastError() error {
+	err := errors.Err(strings.TrimSpace(C.GoString(C.vips_error_buffer())))
+	C.vips_error_clear()
+	return err
+}
+
+// Subsampling is how JPEG chroma is sampled
+type Subsampling int
+
+const (
+	// Subsampling420 halves the chroma resolution both ways
+	Subsampling420 Subsampling = iota
+	// Subsampling444 keeps chroma at full resolution, which keeps text and thin colored lines sharp
+	Subsampling444
+)
+
+// JpegOptions are the jpegsave settings
+type JpegOptions struct {
+	// Quality is from 1 to 100
+	Quality     int
+	Progressive bool
+	Subsampling Subsampling
+	// Trellis turns on trellis quantization and overshoot deringing, and optimizes the scans of progressive JPEGs.
+	// libvips only applies them when it's built with mozjpeg.
+	Trellis bool
+	// OptimizeCoding fits the Huffman tables to the image
+	OptimizeCoding bool
+	// QuantTable is one of the quantization tables of mozjpeg, 0 for the standard ones
+	QuantTable int
+}
+
+// JpegSave encodes img as a JPEG. Transparency is dropped, it's up to the caller to flatten it first.
+func JpegSave(img image.Image, opts JpegOptions) ([]byte, error) {
+	if opts.Quality < 1 || opts.Quality > 100 {
+		return nil, errors.Err("jpeg quality must be between 1 and 100")
+	}
+	if opts.QuantTable < 0 || opts.QuantTable > 8 {
+		return nil, errors.Err("jpeg quant table must be between 0 and 8")
+	}
+	subsample := C.VIPS_FOREIGN_SUBSAMPLE_ON
+	if opts.Subsampling == Subsampling444 {
+		subsample = C.VIPS_FOREIGN_SUBSAMPLE_OFF
+	}
+	in, err := newImage(img, false)
+	if err != nil {
+		return nil, err
+	}
+	defer C.g_object_unref(C.gpointer(in))
+	var buf unsafe.Pointer
+	var length C.size_t
+	if C.mirage_vips_jpegsave(in, &buf, &length, C.int(opts.Quality), cBool(opts.Progressive), C.int(subsample),
+		cBool(opts.Trellis), cBool(opts.OptimizeCoding), C.int(opts.QuantTable)) != 0 {
+		return nil, lastError()
+	}
+	defer C.g_free(C.gpointer(buf))
+	return C.GoBytes(buf, C.int(length)), nil
+}
+
+// Text is a PNG text chunk
+type Text struct {
+	Keyword string
+	Value   string
+}
+
+// PngOptions are the pngsave settings
+type PngOptions struct {
+	// Palette quantizes the image to a palette of up to 2^Bitdepth colors with libimagequant
+	Palette bool
+	// Bitdepth is 1, 2, 4 or 8, palettes are the only output written at less than 8 bits
+	Bitdepth int
+	// Quality is from 0 to 100, how close the palette has to get to the image
+	Quality int
+	// Dither is the amount of error diffusion of palettes, from 0 to 1
+	Dither float64
+	// Compression is the zlib level, from 0 to 9
+	Compression int
+	Text        []Text
+}
+
+// PngSave encodes img as a PNG, keeping its transparency
+func PngSave(img image.Image, opts PngOptions) ([]byte, error) {
+	switch opts.Bitdepth {
+	case 1, 2, 4:
+		if !opts.Palette {
+			return nil, errors.Err("png bit depths below 8 need a palette")
+		}
+	case 8:
+	default:
+		return nil, errors.Err("png bit depth must be 1, 2, 4 or 8")
+	}
+	if opts.Quality < 0 || opts.Quality > 100 {
+		return nil, errors.Err("png quality must be between 0 and 100")
+	}
+	if opts.Compression < 0 || opts.Compression > 9 {
+		return nil, errors.Err("png compression must be between 0 and 9")
+	}
+	in, err := newImage(img, true)
+	if err != nil {
+		return nil, err
+	}
+	defer C.g_object_unref(C.gpointer(in))
+	// pngsave writes the png-comment fields as text chunks, which stripping would leave out. Images made from pixels
+	// have nothing else to strip.
+	for i, text := range opts.Text {
+		name := C.CString(fmt.Sprintf("png-comment-%d-%s", i, text.Keyword))
+		value := C.CString(text.Value)
+		C.vips_image_set_string(in, name, value)
+		C.free(unsafe.Pointer(name))
+		C.free(unsafe.Pointer(value))
+	}
+	var buf unsafe.Pointer
+	var length C.size_t
+	if C.mirage_vips_pngsave(in, &buf, &length, C.int(opts.Compression), cBool(opts.Palette), C.int(opts.Bitdepth),
+		C.int(opts.Quality), C.double(opts.Dither), cBool(len(opts.Text) == 0)) != 0 {
+		return nil, lastError()
+	}
+	defer C.g_free(C.gpointer(buf))
+	return C.GoBytes(buf, C.int(length)), nil
+}
+
+// JpegShrink decodes a JPEG at 1/shrink of its size, shrink being 2, 4 or 8. libjpeg scales the DCT down rather than
+// decoding every pixel, which is much faster. Orientation is left to the caller, and CMYK JPEGs are an error for the
+// caller to decode them in full.
+func JpegShrink(data []byte, shrink int) (image.Image, error) {
+	if shrink != 2 && shrink != 4 && shrink != 8 {
+		return nil, errors.Err("jpeg shrink must be 2, 4 or 8")
+	}
+	if len(data) == 0 {
+		return nil, errors.Err("empty jpeg")
+	}
+	err := initialize()
+	if err != nil {
+		return nil, err
+	}
+	// libvips reads the buffer lazily, up until the pixels are written out
+	buf := C.CBytes(data)
+	defer C.free(buf)
+	var in *C.VipsImage
+	if C.mirage_vips_jpegload_shrink(buf, C.size_t(len(data)), C.int(shrink), &in) != 0 {
+		return nil, lastError()
+	}
+	defer C.g_object_unref(C.gpointer(in))
+	width, height, bands := int(C.vips_image_get_width(in)), int(C.vips_image_get_height(in)), int(C.vips_image_get_bands(in))
+	if C.vips_image_get_format(in) != C.VIPS_FORMAT_UCHAR {
+		return nil, errors.Err("unsupported jpeg sample format")
+	}
+	interpretation := C.vips_image_get_interpretation(in)
+	gray := bands == 1 && interpretation == C.VIPS_INTERPRETATION_B_W
+	if !gray && (bands != 3 || interpretation != C.VIPS_INTERPRETATION_sRGB) {
+		return nil, errors.Err("unsupported jpeg with %d bands", bands)
+	}
+	var size C.size_t
+	pixels := C.vips_image_write_to_memory(in, &size)
+	if pixels == nil {
+		return nil, lastError()
+	}
+	defer C.g_free(C.gpointer(pixels))
+	if int(size) != width*height*bands {
+		return nil, errors.Err("jpeg decoded to %d bytes for %dx%d", size, width, height)
+	}
+	src := unsafe.Slice((*byte)(pixels), int(size))
+	if gray {
+		img := image.NewGray(image.Rect(0, 0, width, height))
+		copy(img.Pix, src)
+		return img, nil
+	}
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i, j := 0, 0; i < len(src); i, j = i+3, j+4 {
+		copy(img.Pix[j:j+3], src[i:i+3])
+		img.Pix[j+3] = 0xff
+	}
+	return img, nil
+}
+
+// newImage copies img into a libvips image, with an alpha band if withAlpha is set and img isn't opaque
+func newImage(img image.Image, withAlpha bool) (*C.VipsImage, error) {
+	err := initialize()
+	if err != nil {
+		return nil, err
+	}
+	b := img.Bounds()
+	if b.Empty() {
+		return nil, errors.Err("can't encode an empty image")
+	}
+	nrgba, ok := img.(*image.NRGBA)
+	if !ok || nrgba.Stride != 4*b.Dx() {
+		nrgba = image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(nrgba, nrgba.Rect, img, b.Min, draw.Src)
+	}
+	pixels, bands := nrgba.Pix[:4*b.Dx()*b.Dy()], 4
+	if !withAlpha || nrgba.Opaque() {
+		rgb := make([]byte, 3*b.Dx()*b.Dy())
+		for i, j := 0, 0; j < len(rgb); i, j = i+4, j+3 {
+			copy(rgb[j:j+3], pixels[i:i+3])
+		}
+		pixels, bands = rgb, 3
+	}
+	var out *C.VipsImage
+	if C.mirage_vips_srgb(unsafe.Pointer(&pixels[0]), C.size_t(len(pixels)), C.int(b.Dx()), C.int(b.Dy()), C.int(bands), &out) != 0 {
+		return nil, lastError()
+	}
+	return out, nil
+}
+
+func cBool(b bool) C.int {
+	if b {
+		return 1
+	}
+	return 0
+}
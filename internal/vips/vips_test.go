@@ -0,0 +1,198 @@
+package vips
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"testing"
+
+	"github.com/h2non/bimg"
+)
+
+// testImage has smooth gradients and, on its right half, red text-like strokes which chroma subsampling blurs
+func testImage() *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, 123, 77))
+	for y := 0; y < 77; y++ {
+		for x := 0; x < 123; x++ {
+			c := color.NRGBA{R: uint8(x * 2), G: uint8(y * 3), B: uint8(128 + 100*math.Sin(float64(x+y)/9)), A: 255}
+			if x > 61 && (x%4 == 0 || y%6 == 0) {
+				c = color.NRGBA{R: 220, A: 255}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+func psnr(t *testing.T, a, b image.Image) float64 {
+	if a.Bounds().Size() != b.Bounds().Size() {
+		t.Fatalf("sizes differ: %v and %v", a.Bounds(), b.Bounds())
+	}
+	var sum float64
+	for y := 0; y < a.Bounds().Dy(); y++ {
+		for x := 0; x < a.Bounds().Dx(); x++ {
+			r1, g1, b1, _ := a.At(x+a.Bounds().Min.X, y+a.Bounds().Min.Y).RGBA()
+			r2, g2, b2, _ := b.At(x+b.Bounds().Min.X, y+b.Bounds().Min.Y).RGBA()
+			for _, d := range []float64{float64(r1>>8) - float64(r2>>8), float64(g1>>8) - float64(g2>>8), float64(b1>>8) - float64(b2>>8)} {
+				sum += d * d
+			}
+		}
+	}
+	return 10 * math.Log10(255*255/(sum/float64(3*a.Bounds().Dx()*a.Bounds().Dy())))
+}
+
+func requireVips(t *testing.T) {
+	if !bimg.IsTypeSupported(bimg.JPEG) {
+		t.Skip("libvips is not available")
+	}
+}
+
+func TestJpegSave(t *testing.T) {
+	requireVips(t)
+	src := testImage()
+	encode := func(opts JpegOptions) ([]byte, image.Image) {
+		data, err := JpegSave(src, opts)
+		if err != nil {
+			t.Fatalf("%+v: %s", opts, err)
+		}
+		decoded, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%+v: %s", opts, err)
+		}
+		return data, decoded
+	}
+	for _, progressive := range []bool{false, true} {
+		for _, subsampling := range []Subsampling{Subsampling420, Subsampling444} {
+			for _, trellis := range []bool{false, true} {
+				opts := JpegOptions{Quality: 85, Progressive: progressive, Subsampling: subsampling, Trellis: trellis, OptimizeCoding: true}
+				data, decoded := encode(opts)
+				// the strokes take 4:2:0 down a lot
+				minPSNR := 19.0
+				if subsampling == Subsampling444 {
+					minPSNR = 28
+				}
+				if p := psnr(t, src, decoded); p < minPSNR {
+					t.Errorf("%+v: PSNR of %.2f", opts, p)
+				}
+				if marker := bytes.Contains(data, []byte{0xff, 0xc2}); marker != progressive {
+					t.Errorf("%+v: progressive marker is %t", opts, marker)
+				}
+			}
+		}
+	}
+
+	standard, _ := encode(JpegOptions{Quality: 85})
+	optimized, _ := encode(JpegOptions{Quality: 85, OptimizeCoding: true})
+	if len(optimized) >= len(standard) {
+		t.Errorf("sizes: %d standard, %d with optimized tables", len(standard), len(optimized))
+	}
+	_, subsampled := encode(JpegOptions{Quality: 90})
+	_, full := encode(JpegOptions{Quality: 90, Subsampling: Subsampling444})
+	if psnr(t, src, full) <= psnr(t, src, subsampled) {
+		t.Errorf("4:4:4 is no better than 4:2:0")
+	}
+	if _, err := JpegSave(src, JpegOptions{Quality: 0}); err == nil {
+		t.Errorf("quality 0 was accepted")
+	}
+	if _, err := JpegSave(src, JpegOptions{Quality: 85, QuantTable: 9}); err == nil {
+		t.Errorf("quant table 9 was accepted")
+	}
+}
+
+func TestPngSave(t *testing.T) {
+	requireVips(t)
+	src := testImage()
+	data, err := PngSave(src, PngOptions{Bitdepth: 8, Compression: 9})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := psnr(t, src, decoded); !math.IsInf(p, 1) {
+		t.Errorf("truecolor output is lossy, PSNR of %.2f", p)
+	}
+
+	data, err = PngSave(src, PngOptions{Palette: true, Bitdepth: 4, Quality: 100, Dither: 1, Compression: 9,
+		Text: []Text{{Keyword: "Copyright", Value: "mirage"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err = png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, ok := decoded.(*image.Paletted); !ok || len(p.Palette) > 16 {
+		t.Errorf("decoded as %T", decoded)
+	}
+	if !bytes.Contains(data, []byte("Copyright")) {
+		t.Errorf("text chunk is missing")
+	}
+	if _, err := PngSave(src, PngOptions{Bitdepth: 4}); err == nil {
+		t.Errorf("bit depth 4 was accepted without a palette")
+	}
+}
+
+func TestJpegShrink(t *testing.T) {
+	requireVips(t)
+	src := testImage()
+	gray := image.NewGray(src.Rect)
+	draw.Draw(gray, gray.Rect, src, image.Point{}, draw.Src)
+	for _, img := range []image.Image{src, gray} {
+		data, err := JpegSave(img, JpegOptions{Quality: 95, Subsampling: Subsampling444})
+		if err != nil {
+			t.Fatal(err)
+		}
+		full, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, shrink := range []int{2, 8} {
+			shrunk, err := JpegShrink(data, shrink)
+			if err != nil {
+				t.Fatalf("%T by %d: %s", img, shrink, err)
+			}
+			want := image.Rect(0, 0, (123+shrink-1)/shrink, (77+shrink-1)/shrink)
+			if shrunk.Bounds() != want {
+				t.Errorf("%T by %d: decoded as %v", img, shrink, shrunk.Bounds())
+				continue
+			}
+			// the scaled DCT averages blocks, which a box filter of the full decode comes close to
+			if p := psnr(t, shrunk, boxShrink(full, shrink)); p < 25 {
+				t.Errorf("%T by %d: PSNR %.2f with the full decode", img, shrink, p)
+			}
+		}
+	}
+	if _, err := JpegShrink([]byte("GIF89a"), 8); err == nil {
+		t.Error("decoded a gif")
+	}
+	if _, err := JpegShrink(nil, 3); err == nil {
+		t.Error("shrink 3 was accepted")
+	}
+}
+
+// boxShrink averages the shrink by shrink blocks of img
+func boxShrink(img image.Image, shrink int) image.Image {
+	b := img.Bounds()
+	out := image.NewRGBA(image.Rect(0, 0, (b.Dx()+shrink-1)/shrink, (b.Dy()+shrink-1)/shrink))
+	for by := 0; by < out.Rect.Dy(); by++ {
+		for bx := 0; bx < out.Rect.Dx(); bx++ {
+			var sum [3]uint32
+			n := uint32(0)
+			for y := by * shrink; y < min(by*shrink+shrink, b.Dy()); y++ {
+				for x := bx * shrink; x < min(bx*shrink+shrink, b.Dx()); x++ {
+					r, g, bl, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+					sum[0], sum[1], sum[2] = sum[0]+r>>8, sum[1]+g>>8, sum[2]+bl>>8
+					n++
+				}
+			}
+			out.SetRGBA(bx, by, color.RGBA{R: uint8(sum[0] / n), G: uint8(sum[1] / n), B: uint8(sum[2] / n), A: 255})
+		}
+	}
+	return out
+}
@@ -0,0 +1,181 @@
+package metadata
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OdyseeTeam/mirage/internal/imagehash"
+)
+
+// MemoryStore is a Store that keeps everything in memory, for tests and tools that run without a database
+type MemoryStore struct {
+	mu         sync.RWMutex
+	entries    map[string]ImageMetadata
+	lastServed map[string]time.Time
+	sourceInfo map[string]SourceInfo
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		entries:    make(map[string]ImageMetadata),
+		lastServed: make(map[string]time.Time),
+		sourceInfo: make(map[string]SourceInfo),
+	}
+}
+
+func (m *MemoryStore) Persist(md *ImageMetadata) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries[md.GodycdnHash] = *md
+	return nil
+}
+
+func (m *MemoryStore) Retrieve(godyCdnHash string) (*ImageMetadata, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	md, ok := m.entries[godyCdnHash]
+	if !ok {
+		return nil, nil
+	}
+	return &md, nil
+}
+
+func (m *MemoryStore) RetrieveAllForUrl(originalUrl string) ([]*ImageMetadata, error) {
+	return m.filter(func(md *ImageMetadata) bool { return md.OriginalURL == originalUrl }), nil
+}
+
+func (m *MemoryStore) RetrieveAllForUrlPrefix(prefix string) ([]*ImageMetadata, error) {
+	return m.filter(func(md *ImageMetadata) bool { return strings.HasPrefix(md.OriginalURL, prefix) }), nil
+}
+
+func (m *MemoryStore) RetrieveAllForHost(host string) ([]*ImageMetadata, error) {
+	return m.filter(func(md *ImageMetadata) bool { return servedBy(md.OriginalURL, host) }), nil
+}
+
+// servedBy reports whether sourceURL is an http or https url of host
+func servedBy(sourceURL, host string) bool {
+	u, err := url.Parse(sourceURL)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host == host
+}
+
+func (m *MemoryStore) RetrieveAllForSourceHash(sourceSHA256 string) ([]*ImageMetadata, error) {
+	return m.filter(func(md *ImageMetadata) bool { return md.SourceSHA256 == sourceSHA256 }), nil
+}
+
+func (m *MemoryStore) RetrieveAllForSourceVariant(sourceSHA256, variant string) ([]*ImageMetadata, error) {
+	return m.filter(func(md *ImageMetadata) bool { return md.SourceSHA256 == sourceSHA256 && md.Variant == variant }), nil
+}
+
+func (m *MemoryStore) RetrieveAllForObjectHash(objectHash string) ([]*ImageMetadata, error) {
+	return m.filter(func(md *ImageMetadata) bool { return md.ObjectHash == objectHash }), nil
+}
+
+func (m *MemoryStore) RetrieveAllForPHash(phash imagehash.Hash, maxDistance int) ([]*ImageMetadata, error) {
+	return m.filter(func(md *ImageMetadata) bool { return md.PHash != 0 && md.PHash.Distance(phash) <= maxDistance }), nil
+}
+
+func (m *MemoryStore) CountUnfingerprinted() (int, error) {
+	return len(m.filter(func(md *ImageMetadata) bool { return md.SourceSHA256 == "" })), nil
+}
+
+func (m *MemoryStore) Touch(godyCdnHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.entries[godyCdnHash]; ok {
+		m.lastServed[godyCdnHash] = time.Now()
+	}
+	return nil
+}
+
+func (m *MemoryStore) RetrieveRecentlyServed(n int) ([]*ImageMetadata, error) {
+	served := m.filter(func(md *ImageMetadata) bool {
+		_, ok := m.lastServed[md.GodycdnHash]
+		return ok
+	})
+	m.mu.RLock()
+	sort.Slice(served, func(i, j int) bool {
+		return m.lastServed[served[i].GodycdnHash].After(m.lastServed[served[j].GodycdnHash])
+	})
+	m.mu.RUnlock()
+	if len(served) > n {
+		served = served[:n]
+	}
+	return served, nil
+}
+
+func (m *MemoryStore) Delete(md *ImageMetadata) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.entries, md.GodycdnHash)
+	delete(m.lastServed, md.GodycdnHash)
+	return nil
+}
+
+func (m *MemoryStore) PersistSourceInfo(info *SourceInfo) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sourceInfo[info.URL] = *info
+	return nil
+}
+
+func (m *MemoryStore) RetrieveSourceInfo(url string) (*SourceInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	info, ok := m.sourceInfo[url]
+	if !ok {
+		return nil, nil
+	}
+	return &info, nil
+}
+
+func (m *MemoryStore) DeleteSourceInfo(url string) (int64, error) {
+	return m.deleteSourceInfo(func(info SourceInfo) bool { return info.URL == url }), nil
+}
+
+func (m *MemoryStore) DeleteSourceInfoForUrlPrefix(prefix string) (int64, error) {
+	return m.deleteSourceInfo(func(info SourceInfo) bool { return strings.HasPrefix(info.URL, prefix) }), nil
+}
+
+func (m *MemoryStore) DeleteSourceInfoForHost(host string) (int64, error) {
+	return m.deleteSourceInfo(func(info SourceInfo) bool { return servedBy(info.URL, host) }), nil
+}
+
+func (m *MemoryStore) DeleteSourceInfoForSourceHash(sourceSHA256 string) (int64, error) {
+	return m.deleteSourceInfo(func(info SourceInfo) bool { return info.SourceSHA256 == sourceSHA256 }), nil
+}
+
+func (m *MemoryStore) DeleteSourceInfoForPHash(phash imagehash.Hash, maxDistance int) (int64, error) {
+	return m.deleteSourceInfo(func(info SourceInfo) bool { return info.PHash != 0 && info.PHash.Distance(phash) <= maxDistance }), nil
+}
+
+func (m *MemoryStore) deleteSourceInfo(match func(info SourceInfo) bool) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var deleted int64
+	for url, info := range m.sourceInfo {
+		if match(info) {
+			delete(m.sourceInfo, url)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+// filter returns copies of the entries matching keep, sorted by hash so that results are stable
+func (m *MemoryStore) filter(keep func(md *ImageMetadata) bool) []*ImageMetadata {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	matching := make([]*ImageMetadata, 0, 1)
+	for _, md := range m.entries {
+		md := md
+		if keep(&md) {
+			matching = append(matching, &md)
+		}
+	}
+	sort.Slice(matching, func(i, j int) bool { return matching[i].GodycdnHash < matching[j].GodycdnHash })
+	return matching
+}
@@ -2,8 +2,11 @@ package metadata
 
 import (
 	"database/sql"
+	"strings"
 	"time"
 
+	"github.com/OdyseeTeam/mirage/internal/imagehash"
+
 	"github.com/bluele/gcache"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/lbryio/lbry.go/v2/extras/errors"
@@ -19,14 +22,54 @@ CREATE TABLE `metadata` (
   `original_size` int(11) NOT NULL,
   `optimized_size` int(11) NOT NULL,
   `original_mime` varchar(100) NOT NULL,
+  `optimized_mime` varchar(100) NOT NULL DEFAULT '',
+  `width` int(11) NOT NULL DEFAULT 0,
+  `height` int(11) NOT NULL DEFAULT 0,
+  `variant` varchar(255) NOT NULL DEFAULT '',
+  `source_sha256` varchar(64) NOT NULL DEFAULT '',
+  `phash` bigint unsigned NOT NULL DEFAULT 0,
+  `object_hash` varchar(64) NOT NULL DEFAULT '',
+  `last_served_at` timestamp NULL DEFAULT NULL,
+  `quality` int(11) NOT NULL DEFAULT 0,
+  `kept_source` tinyint(1) NOT NULL DEFAULT 0,
   PRIMARY KEY (`id`),
-  KEY `metadata_godycdn_hash_index` (`godycdn_hash`)
+  KEY `metadata_godycdn_hash_index` (`godycdn_hash`),
+  KEY `metadata_source_sha256_index` (`source_sha256`),
+  KEY `metadata_last_served_at_index` (`last_served_at`),
+  KEY `metadata_object_hash_index` (`object_hash`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4
 */
 
+// Store persists the metadata of cached variants. Manager keeps it in MySQL, MemoryStore in memory.
+type Store interface {
+	Persist(md *ImageMetadata) error
+	Retrieve(godyCdnHash string) (*ImageMetadata, error)
+	RetrieveAllForUrl(originalUrl string) ([]*ImageMetadata, error)
+	RetrieveAllForUrlPrefix(prefix string) ([]*ImageMetadata, error)
+	RetrieveAllForHost(host string) ([]*ImageMetadata, error)
+	RetrieveAllForSourceHash(sourceSHA256 string) ([]*ImageMetadata, error)
+	RetrieveAllForSourceVariant(sourceSHA256, variant string) ([]*ImageMetadata, error)
+	RetrieveAllForObjectHash(objectHash string) ([]*ImageMetadata, error)
+	RetrieveAllForPHash(phash imagehash.Hash, maxDistance int) ([]*ImageMetadata, error)
+	CountUnfingerprinted() (int, error)
+	Touch(godyCdnHash string) error
+	RetrieveRecentlyServed(n int) ([]*ImageMetadata, error)
+	Delete(md *ImageMetadata) error
+	PersistSourceInfo(info *SourceInfo) error
+	RetrieveSourceInfo(url string) (*SourceInfo, error)
+	// DeleteSourceInfo and the bulk variants return how many sources they deleted the information of
+	DeleteSourceInfo(url string) (int64, error)
+	DeleteSourceInfoForUrlPrefix(prefix string) (int64, error)
+	DeleteSourceInfoForHost(host string) (int64, error)
+	DeleteSourceInfoForSourceHash(sourceSHA256 string) (int64, error)
+	DeleteSourceInfoForPHash(phash imagehash.Hash, maxDistance int) (int64, error)
+}
+
 type Manager struct {
-	dbConn *sql.DB
-	cache  gcache.Cache
+	dbConn     *sql.DB
+	cache      gcache.Cache
+	touched    gcache.Cache
+	sourceInfo gcache.Cache
 }
 
 var instance *Manager
@@ -40,8 +83,10 @@ func Init(dsn string) (*Manager, error) {
 		return nil, err
 	}
 	instance = &Manager{
-		dbConn: db,
-		cache:  gcache.New(10000).Expiration(24 * time.Hour).LRU().Build(),
+		dbConn:     db,
+		cache:      gcache.New(10000).Expiration(24 * time.Hour).LRU().Build(),
+		touched:    gcache.New(100000).Expiration(touchInterval).LRU().Build(),
+		sourceInfo: gcache.New(10000).Expiration(24 * time.Hour).LRU().Build(),
 	}
 	return instance, nil
 }
@@ -53,22 +98,72 @@ func connect(dsn string) (*sql.DB, error) {
 
 type ImageMetadata struct {
 	OriginalURL       string `json:"original_url"`
-	GodycdnHash       string `json:"godycdn_ash"`
+	GodycdnHash       string `json:"godycdn_hash"`
 	Checksum          string `json:"checksum"`
 	OriginalMimeType  string `json:"original_mime_type"`
 	OriginalSize      int    `json:"original_size"`
 	OptimizedSize     int    `json:"optimized_size"`
 	OptimizedMimeType string `json:"optimized_mime_type"`
+	Width             int    `json:"width"`
+	Height            int    `json:"height"`
+	// Variant is the path the object is publicly served under, minus the /plain/<url> suffix
+	Variant string `json:"variant"`
+	// SourceSHA256 and PHash fingerprint the source image the variant was generated from
+	SourceSHA256 string         `json:"source_sha256"`
+	PHash        imagehash.Hash `json:"phash"`
+	// ObjectHash is set when the variant shares the stored object of a byte-identical source served from another url
+	ObjectHash string `json:"object_hash,omitempty"`
+	// Quality is what the variant was encoded with, the one picked by the search for auto quality variants
+	Quality int64 `json:"quality"`
+	// KeptSource is set when re-encoding didn't make the source smaller, so that it's served in its own format
+	KeptSource bool `json:"kept_source"`
+}
+
+// StorageHash is the hash the variant's object is stored under
+func (md *ImageMetadata) StorageHash() string {
+	if md.ObjectHash != "" {
+		return md.ObjectHash
+	}
+	return md.GodycdnHash
+}
+
+// IsAlias reports whether the variant reuses the object of another variant
+func (md *ImageMetadata) IsAlias() bool {
+	return md.StorageHash() != md.GodycdnHash
+}
+
+const selectColumns = "SELECT original_url, godycdn_hash, checksum, original_size, optimized_size, original_mime, optimized_mime, width, height, variant, source_sha256, phash, object_hash, quality, kept_source FROM metadata"
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scan(row scanner) (*ImageMetadata, error) {
+	var md ImageMetadata
+	err := row.Scan(&md.OriginalURL, &md.GodycdnHash, &md.Checksum, &md.OriginalSize, &md.OptimizedSize, &md.OriginalMimeType, &md.OptimizedMimeType, &md.Width, &md.Height, &md.Variant, &md.SourceSHA256, &md.PHash, &md.ObjectHash, &md.Quality, &md.KeptSource)
+	if err != nil {
+		return nil, err
+	}
+	return &md, nil
 }
 
 func (m *Manager) Persist(md *ImageMetadata) error {
-	query := `INSERT INTO mirage.metadata (original_url, godycdn_hash, checksum, original_size, optimized_size, original_mime) VALUES (?, ?, ?, ?, ?, ?)
+	query := `INSERT INTO mirage.metadata (original_url, godycdn_hash, checksum, original_size, optimized_size, original_mime, optimized_mime, width, height, variant, source_sha256, phash, object_hash, quality, kept_source) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 ON DUPLICATE KEY UPDATE original_url=values(original_url),
                         original_size=values(original_size),
                         checksum=values(checksum),
                         optimized_size=values(optimized_size),
-                        original_mime=values(original_mime)`
-	r, err := m.dbConn.Query(query, md.OriginalURL, md.GodycdnHash, md.Checksum, md.OriginalSize, md.OptimizedSize, md.OriginalMimeType)
+                        original_mime=values(original_mime),
+                        optimized_mime=values(optimized_mime),
+                        width=values(width),
+                        height=values(height),
+                        variant=values(variant),
+                        source_sha256=values(source_sha256),
+                        phash=values(phash),
+                        object_hash=values(object_hash),
+                        quality=values(quality),
+                        kept_source=values(kept_source)`
+	r, err := m.dbConn.Query(query, md.OriginalURL, md.GodycdnHash, md.Checksum, md.OriginalSize, md.OptimizedSize, md.OriginalMimeType, md.OptimizedMimeType, md.Width, md.Height, md.Variant, md.SourceSHA256, uint64(md.PHash), md.ObjectHash, md.Quality, md.KeptSource)
 	if err != nil {
 		return errors.Err(err)
 	}
@@ -86,26 +181,39 @@ func (m *Manager) Retrieve(godyCdnHash string) (*ImageMetadata, error) {
 		md := cached.(ImageMetadata)
 		return &md, nil
 	}
-	query := "SELECT original_url, godycdn_hash, checksum, original_size, optimized_size, original_mime FROM metadata WHERE godycdn_hash = ?"
-	row := m.dbConn.QueryRow(query, godyCdnHash)
-	var md ImageMetadata
-	err = row.Scan(&md.OriginalURL, &md.GodycdnHash, &md.Checksum, &md.OriginalSize, &md.OptimizedSize, &md.OriginalMimeType)
+	query := selectColumns + " WHERE godycdn_hash = ?"
+	md, err := scan(m.dbConn.QueryRow(query, godyCdnHash))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
 		}
 		return nil, errors.Err(err)
 	}
-	err = m.cache.Set(md.GodycdnHash, md)
+	err = m.cache.Set(md.GodycdnHash, *md)
 	if err != nil {
 		logrus.Errorf("failed to cache metadata %s", errors.FullTrace(err))
 	}
-	return &md, nil
+	return md, nil
 }
 
 func (m *Manager) RetrieveAllForUrl(originalUrl string) ([]*ImageMetadata, error) {
-	query := "SELECT original_url, godycdn_hash, checksum, original_size, optimized_size, original_mime FROM metadata WHERE original_url = ?"
-	rows, err := m.dbConn.Query(query, originalUrl)
+	return m.retrieveAll(selectColumns+" WHERE original_url = ?", originalUrl)
+}
+
+// RetrieveAllForUrlPrefix returns the metadata of every object whose original url starts with prefix
+func (m *Manager) RetrieveAllForUrlPrefix(prefix string) ([]*ImageMetadata, error) {
+	return m.retrieveAll(selectColumns+" WHERE original_url LIKE ?", escapeLike(prefix)+"%")
+}
+
+// RetrieveAllForHost returns the metadata of every object whose original url is served by host (either scheme)
+func (m *Manager) RetrieveAllForHost(host string) ([]*ImageMetadata, error) {
+	host = escapeLike(host)
+	query := selectColumns + " WHERE original_url LIKE ? OR original_url LIKE ? OR original_url LIKE ? OR original_url LIKE ?"
+	return m.retrieveAll(query, "http://"+host+"/%", "https://"+host+"/%", "http://"+host+"?%", "https://"+host+"?%")
+}
+
+func (m *Manager) retrieveAll(query string, args ...interface{}) ([]*ImageMetadata, error) {
+	rows, err := m.dbConn.Query(query, args...)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
@@ -118,16 +226,72 @@ func (m *Manager) RetrieveAllForUrl(originalUrl string) ([]*ImageMetadata, error
 
 	mdSlice := make([]*ImageMetadata, 0, 1)
 	for rows.Next() {
-		var md ImageMetadata
-		err = rows.Scan(&md.OriginalURL, &md.GodycdnHash, &md.Checksum, &md.OriginalSize, &md.OptimizedSize, &md.OriginalMimeType)
+		md, err := scan(rows)
 		if err != nil {
 			return nil, errors.Err(err)
 		}
-		mdSlice = append(mdSlice, &md)
+		mdSlice = append(mdSlice, md)
+	}
+
+	return mdSlice, errors.Err(rows.Err())
+}
+
+// RetrieveAllForSourceHash returns the metadata of every object generated from a source with the given SHA-256
+func (m *Manager) RetrieveAllForSourceHash(sourceSHA256 string) ([]*ImageMetadata, error) {
+	return m.retrieveAll(selectColumns+" WHERE source_sha256 = ?", sourceSHA256)
+}
+
+// RetrieveAllForSourceVariant returns the metadata of the given variant of every source with the given SHA-256
+func (m *Manager) RetrieveAllForSourceVariant(sourceSHA256, variant string) ([]*ImageMetadata, error) {
+	return m.retrieveAll(selectColumns+" WHERE source_sha256 = ? AND variant = ?", sourceSHA256, variant)
+}
+
+// RetrieveAllForObjectHash returns the metadata of every alias sharing the object stored as objectHash
+func (m *Manager) RetrieveAllForObjectHash(objectHash string) ([]*ImageMetadata, error) {
+	return m.retrieveAll(selectColumns+" WHERE object_hash = ?", objectHash)
+}
+
+// RetrieveAllForPHash returns the metadata of every object whose source perceptual hash is within maxDistance bits of phash
+func (m *Manager) RetrieveAllForPHash(phash imagehash.Hash, maxDistance int) ([]*ImageMetadata, error) {
+	return m.retrieveAll(selectColumns+" WHERE phash != 0 AND BIT_COUNT(phash ^ ?) <= ?", uint64(phash), maxDistance)
+}
+
+// CountUnfingerprinted returns how many objects were cached before their sources were fingerprinted
+func (m *Manager) CountUnfingerprinted() (int, error) {
+	var count int
+	err := m.dbConn.QueryRow("SELECT COUNT(*) FROM metadata WHERE source_sha256 = ''").Scan(&count)
+	if err != nil {
+		return 0, errors.Err(err)
 	}
+	return count, nil
+}
 
-	return mdSlice, nil
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
 }
+
+// touchInterval is how stale last_served_at is allowed to get, so that popular objects don't cause a write per request
+const touchInterval = time.Hour
+
+// Touch records that the object was just served
+func (m *Manager) Touch(godyCdnHash string) error {
+	if m.touched.Has(godyCdnHash) {
+		return nil
+	}
+	_, err := m.dbConn.Exec("UPDATE metadata SET last_served_at = ? WHERE godycdn_hash = ?", time.Now().UTC(), godyCdnHash)
+	if err != nil {
+		return errors.Err(err)
+	}
+	return errors.Err(m.touched.Set(godyCdnHash, true))
+}
+
+// RetrieveRecentlyServed returns the metadata of the n most recently served objects
+func (m *Manager) RetrieveRecentlyServed(n int) ([]*ImageMetadata, error) {
+	return m.retrieveAll(selectColumns+" WHERE last_served_at IS NOT NULL ORDER BY last_served_at DESC LIMIT ?", n)
+}
+
 func (m *Manager) Delete(md *ImageMetadata) error {
 	query := "DELETE FROM metadata WHERE godycdn_hash = ?"
 	_, err := m.dbConn.Exec(query, md.GodycdnHash)
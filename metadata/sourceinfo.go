@@ -0,0 +1,167 @@
+package metadata
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+
+	"github.com/OdyseeTeam/mirage/internal/imagehash"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/sirupsen/logrus"
+)
+
+/*
+CREATE TABLE `source_info` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `url` text NOT NULL,
+  `url_hash` char(40) NOT NULL,
+  `source_sha256` varchar(64) NOT NULL DEFAULT '',
+  `mime` varchar(100) NOT NULL DEFAULT '',
+  `size` bigint NOT NULL DEFAULT 0,
+  `width` int(11) NOT NULL DEFAULT 0,
+  `height` int(11) NOT NULL DEFAULT 0,
+  `dominant_color` varchar(7) NOT NULL DEFAULT '',
+  `blurhash` varchar(64) NOT NULL DEFAULT '',
+  `thumbhash` varchar(64) NOT NULL DEFAULT '',
+  `lqip` text NOT NULL,
+  `frames` int(11) NOT NULL DEFAULT 1,
+  `duration_ms` int(11) NOT NULL DEFAULT 0,
+  `has_alpha` tinyint(1) NOT NULL DEFAULT 0,
+  `orientation` tinyint NOT NULL DEFAULT 1,
+  `average_color` varchar(7) NOT NULL DEFAULT '',
+  `phash` bigint unsigned NOT NULL DEFAULT 0,
+  `stale` tinyint(1) NOT NULL DEFAULT 0,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `source_info_url_hash_index` (`url_hash`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4
+*/
+
+// SourceInfo describes a source url independently of the variants generated from it
+type SourceInfo struct {
+	URL          string `json:"url"`
+	SourceSHA256 string `json:"source_sha256"`
+	MimeType     string `json:"mime_type"`
+	// Size is the size of the source in bytes, -1 when unknown
+	Size   int64 `json:"size"`
+	Width  int   `json:"width"`
+	Height int   `json:"height"`
+	// Frames is 1 for still images and 0 for videos, DurationMs is how long one loop of an animation lasts
+	Frames     int   `json:"frames"`
+	DurationMs int64 `json:"duration_ms"`
+	HasAlpha   bool  `json:"has_alpha"`
+	// Orientation is the EXIF orientation, 1 when absent
+	Orientation   int            `json:"orientation"`
+	DominantColor string         `json:"dominant_color"`
+	AverageColor  string         `json:"average_color"`
+	PHash         imagehash.Hash `json:"phash"`
+	BlurHash      string         `json:"blurhash"`
+	// ThumbHash is base64 encoded
+	ThumbHash string `json:"thumbhash"`
+	// LQIP is a tiny inline image as a data URI
+	LQIP string `json:"lqip"`
+	// Stale is set on the rows stored before sources were described as they are now, which are to be recomputed
+	Stale bool `json:"-"`
+}
+
+// urlHash is what source_info is keyed by, urls being too long for an index
+func urlHash(url string) string {
+	h := sha1.Sum([]byte(url))
+	return hex.EncodeToString(h[:])
+}
+
+func (m *Manager) PersistSourceInfo(info *SourceInfo) error {
+	query := `INSERT INTO mirage.source_info (url, url_hash, source_sha256, mime, size, width, height, frames, duration_ms, has_alpha, orientation, dominant_color, average_color, phash, blurhash, thumbhash, lqip, stale) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+ON DUPLICATE KEY UPDATE source_sha256=values(source_sha256),
+                        mime=values(mime),
+                        size=values(size),
+                        width=values(width),
+                        height=values(height),
+                        frames=values(frames),
+                        duration_ms=values(duration_ms),
+                        has_alpha=values(has_alpha),
+                        orientation=values(orientation),
+                        dominant_color=values(dominant_color),
+                        average_color=values(average_color),
+                        phash=values(phash),
+                        blurhash=values(blurhash),
+                        thumbhash=values(thumbhash),
+                        lqip=values(lqip),
+                        stale=values(stale)`
+	_, err := m.dbConn.Exec(query, info.URL, urlHash(info.URL), info.SourceSHA256, info.MimeType, info.Size, info.Width, info.Height, info.Frames, info.DurationMs, info.HasAlpha, info.Orientation, info.DominantColor, info.AverageColor, uint64(info.PHash), info.BlurHash, info.ThumbHash, info.LQIP, info.Stale)
+	if err != nil {
+		return errors.Err(err)
+	}
+	return errors.Err(m.sourceInfo.Set(info.URL, *info))
+}
+
+// RetrieveSourceInfo returns the stored information about url, or nil if there is none
+func (m *Manager) RetrieveSourceInfo(url string) (*SourceInfo, error) {
+	cached, err := m.sourceInfo.Get(url)
+	if err == nil && cached != nil {
+		info := cached.(SourceInfo)
+		return &info, nil
+	}
+	query := "SELECT url, source_sha256, mime, size, width, height, frames, duration_ms, has_alpha, orientation, dominant_color, average_color, phash, blurhash, thumbhash, lqip, stale FROM source_info WHERE url_hash = ?"
+	var info SourceInfo
+	err = m.dbConn.QueryRow(query, urlHash(url)).Scan(&info.URL, &info.SourceSHA256, &info.MimeType, &info.Size, &info.Width, &info.Height, &info.Frames, &info.DurationMs, &info.HasAlpha, &info.Orientation, &info.DominantColor, &info.AverageColor, &info.PHash, &info.BlurHash, &info.ThumbHash, &info.LQIP, &info.Stale)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, errors.Err(err)
+	}
+	err = m.sourceInfo.Set(url, info)
+	if err != nil {
+		logrus.Errorf("failed to cache source info %s", errors.FullTrace(err))
+	}
+	return &info, nil
+}
+
+func (m *Manager) DeleteSourceInfo(url string) (int64, error) {
+	result, err := m.dbConn.Exec("DELETE FROM source_info WHERE url_hash = ?", urlHash(url))
+	if err != nil {
+		return 0, errors.Err(err)
+	}
+	_ = m.sourceInfo.Remove(url)
+	return rowsAffected(result)
+}
+
+// DeleteSourceInfoForUrlPrefix deletes the information about every source whose url starts with prefix
+func (m *Manager) DeleteSourceInfoForUrlPrefix(prefix string) (int64, error) {
+	return m.deleteSourceInfo("DELETE FROM source_info WHERE url LIKE ?", escapeLike(prefix)+"%")
+}
+
+// DeleteSourceInfoForHost deletes the information about every source served by host (either scheme)
+func (m *Manager) DeleteSourceInfoForHost(host string) (int64, error) {
+	host = escapeLike(host)
+	query := "DELETE FROM source_info WHERE url LIKE ? OR url LIKE ? OR url LIKE ? OR url LIKE ?"
+	return m.deleteSourceInfo(query, "http://"+host+"/%", "https://"+host+"/%", "http://"+host+"?%", "https://"+host+"?%")
+}
+
+// DeleteSourceInfoForSourceHash deletes the information about every source whose content hashes to sourceSHA256
+func (m *Manager) DeleteSourceInfoForSourceHash(sourceSHA256 string) (int64, error) {
+	return m.deleteSourceInfo("DELETE FROM source_info WHERE source_sha256 = ?", sourceSHA256)
+}
+
+// DeleteSourceInfoForPHash deletes the information about every source whose perceptual hash is within maxDistance bits
+// of phash
+func (m *Manager) DeleteSourceInfoForPHash(phash imagehash.Hash, maxDistance int) (int64, error) {
+	return m.deleteSourceInfo("DELETE FROM source_info WHERE phash != 0 AND BIT_COUNT(phash ^ ?) <= ?", uint64(phash), maxDistance)
+}
+
+// deleteSourceInfo runs a bulk delete, which leaves no way to tell the cached urls it affected but to drop them all
+func (m *Manager) deleteSourceInfo(query string, args ...interface{}) (int64, error) {
+	result, err := m.dbConn.Exec(query, args...)
+	if err != nil {
+		return 0, errors.Err(err)
+	}
+	m.sourceInfo.Purge()
+	return rowsAffected(result)
+}
+
+func rowsAffected(result sql.Result) (int64, error) {
+	n, err := result.RowsAffected()
+	return n, errors.Err(err)
+}
@@ -0,0 +1,6 @@
+-- stores the optimized mime type and output dimensions of each cached variant
+use mirage;
+ALTER TABLE `metadata`
+    ADD COLUMN `optimized_mime` varchar(100) NOT NULL DEFAULT '',
+    ADD COLUMN `width`          int(11)      NOT NULL DEFAULT 0,
+    ADD COLUMN `height`         int(11)      NOT NULL DEFAULT 0;
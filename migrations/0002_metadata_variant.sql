@@ -0,0 +1,4 @@
+-- stores the public path each cached variant is served under so purges can be propagated downstream
+use mirage;
+ALTER TABLE `metadata`
+    ADD COLUMN `variant` varchar(255) NOT NULL DEFAULT '';
@@ -0,0 +1,16 @@
+-- fingerprints the source of each cached variant and adds the moderation blocklist
+use mirage;
+ALTER TABLE `metadata`
+    ADD COLUMN `source_sha256` varchar(64)     NOT NULL DEFAULT '',
+    ADD COLUMN `phash`         bigint unsigned NOT NULL DEFAULT 0,
+    ADD KEY `metadata_source_sha256_index` (`source_sha256`);
+CREATE TABLE `blocklist`
+(
+    `id`         int(11)      NOT NULL AUTO_INCREMENT,
+    `kind`       varchar(16)  NOT NULL,
+    `value`      varchar(700) NOT NULL,
+    `reason`     text         NOT NULL,
+    `created_at` timestamp    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (`id`),
+    UNIQUE KEY `blocklist_kind_value_index` (`kind`, `value`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
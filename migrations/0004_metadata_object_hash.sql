@@ -0,0 +1,4 @@
+-- lets variants of byte-identical sources share a single stored object
+use mirage;
+ALTER TABLE `metadata`
+    ADD COLUMN `object_hash` varchar(64) NOT NULL DEFAULT '';
@@ -0,0 +1,5 @@
+-- tracks when variants were last served so the most popular ones can be replayed into a cold cache
+use mirage;
+ALTER TABLE `metadata`
+    ADD COLUMN `last_served_at` timestamp NULL DEFAULT NULL,
+    ADD KEY `metadata_last_served_at_index` (`last_served_at`);
@@ -0,0 +1,20 @@
+-- stores what is known about each source url, its placeholders to begin with
+use mirage;
+CREATE TABLE `source_info`
+(
+    `id`             int(11)      NOT NULL AUTO_INCREMENT,
+    `url`            text         NOT NULL,
+    `url_hash`       char(40)     NOT NULL,
+    `source_sha256`  varchar(64)  NOT NULL DEFAULT '',
+    `mime`           varchar(100) NOT NULL DEFAULT '',
+    `size`           bigint       NOT NULL DEFAULT 0,
+    `width`          int(11)      NOT NULL DEFAULT 0,
+    `height`         int(11)      NOT NULL DEFAULT 0,
+    `dominant_color` varchar(7)   NOT NULL DEFAULT '',
+    `blurhash`       varchar(64)  NOT NULL DEFAULT '',
+    `thumbhash`      varchar(64)  NOT NULL DEFAULT '',
+    `lqip`           text         NOT NULL,
+    `created_at`     timestamp    NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (`id`),
+    UNIQUE KEY `source_info_url_hash_index` (`url_hash`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
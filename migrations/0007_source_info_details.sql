@@ -0,0 +1,12 @@
+-- describes sources further for the info endpoint. rows stored before lack the new columns, they are marked stale and
+-- recomputed when next requested.
+use mirage;
+ALTER TABLE `source_info`
+    ADD COLUMN `frames`        int(11)         NOT NULL DEFAULT 1,
+    ADD COLUMN `duration_ms`   int(11)         NOT NULL DEFAULT 0,
+    ADD COLUMN `has_alpha`     tinyint(1)      NOT NULL DEFAULT 0,
+    ADD COLUMN `orientation`   tinyint         NOT NULL DEFAULT 1,
+    ADD COLUMN `average_color` varchar(7)      NOT NULL DEFAULT '',
+    ADD COLUMN `phash`         bigint unsigned NOT NULL DEFAULT 0,
+    ADD COLUMN `stale`         tinyint(1)      NOT NULL DEFAULT 0;
+UPDATE `source_info` SET `stale` = 1;
@@ -0,0 +1,4 @@
+-- records the encoder quality of each variant so that auto quality searches run once per variant
+use mirage;
+ALTER TABLE `metadata`
+    ADD COLUMN `quality` int(11) NOT NULL DEFAULT 0;
@@ -0,0 +1,4 @@
+-- flags the variants served as their source because re-encoding them made them bigger
+use mirage;
+ALTER TABLE `metadata`
+    ADD COLUMN `kept_source` tinyint(1) NOT NULL DEFAULT 0;
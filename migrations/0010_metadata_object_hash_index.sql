@@ -0,0 +1,4 @@
+-- finds the aliases of a variant when it is purged
+use mirage;
+ALTER TABLE `metadata`
+    ADD KEY `metadata_object_hash_index` (`object_hash`);
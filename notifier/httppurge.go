@@ -0,0 +1,66 @@
+package notifier
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// HTTPPurge sends a PURGE (or BAN) request per url, the way Varnish-style caches expect
+type HTTPPurge struct {
+	method   string
+	endpoint string
+	headers  map[string]string
+	client   *http.Client
+}
+
+// NewHTTPPurge returns a notifier sending method (PURGE by default) requests for every purged url.
+// When endpoint is set the requests are sent there with the public host in the Host header.
+func NewHTTPPurge(method, endpoint string, headers map[string]string) *HTTPPurge {
+	if method == "" {
+		method = "PURGE"
+	}
+	return &HTTPPurge{
+		method:   method,
+		endpoint: endpoint,
+		headers:  headers,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p *HTTPPurge) Notify(urls []string) error {
+	var firstErr error
+	for _, u := range urls {
+		err := p.purge(u)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (p *HTTPPurge) purge(publicURL string) error {
+	target := publicURL
+	host := ""
+	if p.endpoint != "" {
+		parsed, err := url.Parse(publicURL)
+		if err != nil {
+			return errors.Err(err)
+		}
+		host = parsed.Host
+		target = p.endpoint + parsed.RequestURI()
+	}
+	req, err := http.NewRequest(p.method, target, nil)
+	if err != nil {
+		return errors.Err(err)
+	}
+	if host != "" {
+		req.Host = host
+	}
+	for k, v := range p.headers {
+		req.Header.Set(k, v)
+	}
+	return do(p.client, req)
+}
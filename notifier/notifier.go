@@ -0,0 +1,59 @@
+package notifier
+
+import (
+	"strings"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// Notifier tells downstream caches that public urls were purged from Mirage
+type Notifier interface {
+	Notify(urls []string) error
+}
+
+// Config describes a notifier in the configuration file
+type Config struct {
+	// Type is either "webhook" or "http"
+	Type string `mapstructure:"type"`
+	// URL is the webhook endpoint (webhook) or the cache to send purge requests to instead of the public host (http)
+	URL     string            `mapstructure:"url"`
+	Headers map[string]string `mapstructure:"headers"`
+	// BodyTemplate is a text/template rendered with .URLs for webhooks
+	BodyTemplate string `mapstructure:"body_template"`
+	// Method is the purge method used by http notifiers, PURGE by default
+	Method string `mapstructure:"method"`
+}
+
+// FromConfig builds a notifier fanning out to every configured one
+func FromConfig(configs []Config) (Notifier, error) {
+	notifiers := make(Multi, 0, len(configs))
+	for _, cfg := range configs {
+		switch strings.ToLower(cfg.Type) {
+		case "webhook":
+			n, err := NewWebhook(cfg.URL, cfg.Headers, cfg.BodyTemplate)
+			if err != nil {
+				return nil, err
+			}
+			notifiers = append(notifiers, n)
+		case "http":
+			notifiers = append(notifiers, NewHTTPPurge(cfg.Method, cfg.URL, cfg.Headers))
+		default:
+			return nil, errors.Err("unknown purge notifier type %q", cfg.Type)
+		}
+	}
+	return notifiers, nil
+}
+
+// Multi notifies all of its notifiers, returning the first error encountered
+type Multi []Notifier
+
+func (m Multi) Notify(urls []string) error {
+	var firstErr error
+	for _, n := range m {
+		err := n.Notify(urls)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
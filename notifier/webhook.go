@@ -0,0 +1,73 @@
+package notifier
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"text/template"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// DefaultBodyTemplate is the body sent by webhooks that don't configure their own
+const DefaultBodyTemplate = `{"urls":{{json .URLs}}}`
+
+// Webhook posts the purged urls to an HTTP endpoint
+type Webhook struct {
+	url     string
+	headers map[string]string
+	body    *template.Template
+	client  *http.Client
+}
+
+// NewWebhook returns a webhook notifier. bodyTemplate defaults to DefaultBodyTemplate and can use the json function.
+func NewWebhook(url string, headers map[string]string, bodyTemplate string) (*Webhook, error) {
+	if bodyTemplate == "" {
+		bodyTemplate = DefaultBodyTemplate
+	}
+	tmpl, err := template.New("body").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Parse(bodyTemplate)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	return &Webhook{
+		url:     url,
+		headers: headers,
+		body:    tmpl,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (w *Webhook) Notify(urls []string) error {
+	var body bytes.Buffer
+	err := w.body.Execute(&body, struct{ URLs []string }{urls})
+	if err != nil {
+		return errors.Err(err)
+	}
+	req, err := http.NewRequest(http.MethodPost, w.url, &body)
+	if err != nil {
+		return errors.Err(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.headers {
+		req.Header.Set(k, v)
+	}
+	return do(w.client, req)
+}
+
+func do(client *http.Client, req *http.Request) error {
+	response, err := client.Do(req)
+	if err != nil {
+		return errors.Err(err)
+	}
+	_ = response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return errors.Err("received %d response code for %s %s", response.StatusCode, req.Method, req.URL)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package optimizer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
+	"strings"
+	"time"
+
+	"github.com/OdyseeTeam/mirage/internal/imagemeta"
+	"github.com/OdyseeTeam/mirage/internal/placeholder"
+	"github.com/OdyseeTeam/mirage/internal/resample"
+
+	"github.com/chai2010/webp"
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// Analysis describes a source image and holds what clients show while it loads
+type Analysis struct {
+	// Width and Height are the size of the source once oriented
+	Width  int
+	Height int
+	// Frames is 1 for still images, Duration is how long one loop of an animation lasts
+	Frames   int
+	Duration time.Duration
+	HasAlpha bool
+	// Orientation is the EXIF orientation, 1 when absent
+	Orientation int
+	// DominantColor is the most common color as #rrggbb, AverageColor the mean of all the opaque ones
+	DominantColor string
+	AverageColor  string
+	BlurHash      string
+	// ThumbHash is base64 encoded
+	ThumbHash string
+	// LQIP is a tiny WebP as a data URI, ready for an img src
+	LQIP string
+}
+
+const (
+	// blurHashSize is what sources are shrunk to before computing their BlurHash, which is quadratic in the pixel count
+	blurHashSize = 32
+	// thumbHashSize is the largest image ThumbHash accepts
+	thumbHashSize = 100
+	lqipSize      = 16
+	lqipQuality   = 20
+)
+
+// Analyze decodes a source image, animations by their first frame, and describes it
+func (o *Optimizer) Analyze(data []byte) (*Analysis, error) {
+	contentType := mimetype.Detect(data).String()
+	a := &Analysis{}
+	a.Frames, a.Duration = animation(data, contentType)
+	img, err := decodeFirstFrame(data, contentType, a.Frames)
+	if err != nil {
+		return nil, err
+	}
+	md := imagemeta.Read(data)
+	a.Orientation = md.Orientation
+	img = imagemeta.Orient(img, md.Orientation)
+	img, _ = toSRGB(img, md)
+
+	a.Width, a.Height = img.Bounds().Dx(), img.Bounds().Dy()
+	a.HasAlpha = !isOpaque(img)
+	thumbnail := resample.Thumbnail(img, thumbHashSize, thumbHashSize, resample.Bilinear)
+	a.DominantColor = hexColor(placeholder.DominantColor(thumbnail))
+	a.AverageColor = hexColor(placeholder.AverageColor(thumbnail))
+	thumbHash, err := placeholder.ThumbHash(thumbnail)
+	if err != nil {
+		return nil, err
+	}
+	a.ThumbHash = base64.StdEncoding.EncodeToString(thumbHash)
+	xComponents, yComponents := 4, 3
+	if a.Height > a.Width {
+		xComponents, yComponents = 3, 4
+	}
+	a.BlurHash, err = placeholder.BlurHash(resample.Thumbnail(thumbnail, blurHashSize, blurHashSize, resample.Bilinear), xComponents, yComponents)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = webp.Encode(&buf, resample.Thumbnail(thumbnail, lqipSize, lqipSize, resample.Bilinear), &webp.Options{Quality: lqipQuality})
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	a.LQIP = "data:image/webp;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())
+	return a, nil
+}
+
+// decodeFirstFrame decodes any source, animations by their first frame and SVGs at their own size
+func decodeFirstFrame(data []byte, contentType string, frames int) (image.Image, error) {
+	if strings.Contains(contentType, "svg") {
+		return rasterizeSVG(data, 0, 0)
+	}
+	if strings.Contains(contentType, "webp") && frames > 1 {
+		return decodeWithVips(data)
+	}
+	return readRawImage(data, contentType, 16383*16383)
+}
+
+// isOpaque reports whether every pixel of img is fully opaque
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if _, _, _, alpha := img.At(x, y).RGBA(); alpha != 0xffff {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func hexColor(c color.NRGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
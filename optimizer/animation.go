@@ -0,0 +1,88 @@
+package optimizer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image/gif"
+	"strings"
+	"time"
+)
+
+// animation returns the number of frames of an image and how long one loop of them lasts.
+// Still images, and images that can't be parsed, are a single frame lasting 0.
+func animation(data []byte, contentType string) (frames int, duration time.Duration) {
+	switch {
+	case strings.Contains(contentType, "gif"):
+		g, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil || len(g.Image) == 0 {
+			return 1, 0
+		}
+		for _, delay := range g.Delay {
+			duration += time.Duration(delay) * 10 * time.Millisecond
+		}
+		return len(g.Image), duration
+	case strings.Contains(contentType, "png"):
+		return apngAnimation(data)
+	case strings.Contains(contentType, "webp"):
+		return webpAnimation(data)
+	}
+	return 1, 0
+}
+
+// apngAnimation reads the frame count of the acTL chunk and adds up the delays of the fcTL ones
+func apngAnimation(data []byte) (frames int, duration time.Duration) {
+	frames = 1
+	// signature, then length, type, data and crc per chunk
+	for i := 8; i+8 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		kind := string(data[i+4 : i+8])
+		start, end := i+8, i+8+length
+		if length < 0 || end > len(data) {
+			break
+		}
+		chunk := data[start:end]
+		switch kind {
+		case "acTL":
+			if len(chunk) >= 4 {
+				frames = int(binary.BigEndian.Uint32(chunk))
+			}
+		case "fcTL":
+			if len(chunk) >= 24 {
+				num, den := binary.BigEndian.Uint16(chunk[20:]), binary.BigEndian.Uint16(chunk[22:])
+				// a zero denominator means hundredths of a second
+				if den == 0 {
+					den = 100
+				}
+				duration += time.Duration(num) * time.Second / time.Duration(den)
+			}
+		case "IEND":
+			return max(frames, 1), duration
+		}
+		i = end + 4
+	}
+	return max(frames, 1), duration
+}
+
+// webpAnimation counts the ANMF chunks of an animated WebP and adds up their durations
+func webpAnimation(data []byte) (frames int, duration time.Duration) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return 1, 0
+	}
+	for i := 12; i+8 <= len(data); {
+		kind := string(data[i : i+4])
+		size := int(binary.LittleEndian.Uint32(data[i+4:]))
+		start, end := i+8, i+8+size
+		if size < 0 || end > len(data) {
+			break
+		}
+		if kind == "ANMF" && size >= 15 {
+			chunk := data[start:end]
+			frames++
+			// x, y, width and height take 3 bytes each, the duration follows
+			duration += time.Duration(uint32(chunk[12])|uint32(chunk[13])<<8|uint32(chunk[14])<<16) * time.Millisecond
+		}
+		// chunks are padded to an even size
+		i = end + size%2
+	}
+	return max(frames, 1), duration
+}
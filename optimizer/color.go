@@ -0,0 +1,167 @@
+package optimizer
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+
+	"github.com/OdyseeTeam/mirage/internal/icc"
+	"github.com/OdyseeTeam/mirage/internal/imagemeta"
+	"github.com/OdyseeTeam/mirage/internal/metrics"
+
+	"github.com/h2non/bimg"
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// toSRGB converts img to sRGB according to its embedded profile. The returned metadata only keeps the profile
+// when it still describes the pixels, i.e. when it could not be applied but is an RGB one.
+func toSRGB(img image.Image, md imagemeta.Metadata) (image.Image, imagemeta.Metadata) {
+	if len(md.ICC) == 0 {
+		return img, md
+	}
+	// the decoder already turned CMYK and YCCK into RGB without the profile, it doesn't apply anymore
+	if len(md.ICC) < 20 || string(md.ICC[16:20]) != "RGB " {
+		md.ICC = nil
+		return img, md
+	}
+	profile, err := icc.Parse(md.ICC)
+	if err != nil {
+		log.Debugf("keeping unsupported color profile: %s", err)
+		return img, md
+	}
+	if profile.IsSRGB() {
+		return img, md
+	}
+	metrics.ColorConversions.Inc()
+	md.ICC = nil
+	return profile.ToSRGB(img), md
+}
+
+// isCMYKJPEG reports whether data is a JPEG with four components, i.e. CMYK or YCCK
+func isCMYKJPEG(data []byte) bool {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return false
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xff {
+			return false
+		}
+		marker := data[i+1]
+		if marker == 0xff {
+			i++
+			continue
+		}
+		if marker == 0xd8 || marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+			i += 2
+			continue
+		}
+		if marker == 0xd9 || marker == 0xda {
+			return false
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2 : i+4]))
+		// SOF0 to SOF15, minus DHT, JPG and DAC which share the range
+		if marker >= 0xc0 && marker <= 0xcf && marker != 0xc4 && marker != 0xc8 && marker != 0xcc {
+			// length (2), precision (1), height (2), width (2), components (1)
+			return i+9 < len(data) && data[i+9] == 4
+		}
+		i += 2 + length
+	}
+	return false
+}
+
+// decodeCMYK converts a CMYK or YCCK JPEG to sRGB with libvips, which applies the embedded profile or a generic
+// CMYK one when there is none. Without libvips it falls back to the naive conversion of the Go decoder.
+func decodeCMYK(data []byte) (image.Image, error) {
+	converted, err := bimg.NewImage(data).Process(bimg.Options{
+		Type:           bimg.PNG,
+		Interpretation: bimg.InterpretationSRGB,
+		NoAutoRotate:   true,
+		StripMetadata:  true,
+	})
+	if err != nil {
+		log.Debugf("converting CMYK without a profile: %s", err)
+		return jpeg.Decode(bytes.NewReader(data))
+	}
+	metrics.ColorConversions.Inc()
+	return png.Decode(bytes.NewReader(converted))
+}
+
+// optimizeAvif encodes src, animations by their first frame, as a still AVIF with libvips. Embedded profiles are
+// converted to sRGB, unless the optimizer preserves wide gamut in which case the pixels are left alone and the profile
+// embedded. AutoQuality isn't searched, see ChooseQuality.
+func (o *Optimizer) optimizeAvif(src *Source, opts Options) (optimized []byte, originalContentType, optimizedContentType string, err error) {
+	contentType := src.contentType
+	md := imagemeta.Read(src.data)
+	img, err := o.load(src, md.Orientation, opts)
+	if err != nil {
+		return nil, contentType, "", err
+	}
+	if !o.preserveWideGamut {
+		img, md = toSRGB(img, md)
+	}
+	img = opts.Filters.apply(img)
+	// hand libvips a lossless intermediate that carries nothing but the profile, so no other metadata can leak
+	var buf bytes.Buffer
+	encoder := png.Encoder{CompressionLevel: png.BestSpeed}
+	err = encoder.Encode(&buf, img)
+	if err != nil {
+		return nil, contentType, "", errors.Err(err)
+	}
+	intermediate := buf.Bytes()
+	keepProfile := o.preserveWideGamut && len(md.ICC) > 0
+	if keepProfile {
+		intermediate, err = pngWithICC(intermediate, md.ICC)
+		if err != nil {
+			return nil, contentType, "", err
+		}
+	}
+	quality := opts.Quality
+	if quality == AutoQuality {
+		quality = FallbackQuality
+	}
+	newImage, err := bimg.NewImage(intermediate).Process(bimg.Options{
+		Type:          bimg.AVIF,
+		Quality:       int(quality),
+		StripMetadata: !keepProfile,
+	})
+	if err != nil {
+		return nil, contentType, "", errors.Err(err)
+	}
+	return newImage, contentType, "image/avif", nil
+}
+
+// pngWithICC inserts an iCCP chunk right after the IHDR chunk of an encoded PNG
+func pngWithICC(encoded, profile []byte) ([]byte, error) {
+	// signature (8) + IHDR length, type, data (13) and crc
+	const ihdrEnd = 8 + 4 + 4 + 13 + 4
+	if len(encoded) < ihdrEnd || string(encoded[12:16]) != "IHDR" {
+		return nil, errors.Err("malformed png")
+	}
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	_, err := zw.Write(profile)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	err = zw.Close()
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	// profile name, NUL, compression method 0 (zlib)
+	payload := append([]byte("icc\x00\x00"), compressed.Bytes()...)
+	chunk := make([]byte, 8, 12+len(payload))
+	binary.BigEndian.PutUint32(chunk[0:4], uint32(len(payload)))
+	copy(chunk[4:8], "iCCP")
+	chunk = append(chunk, payload...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+
+	out := make([]byte, 0, len(encoded)+len(chunk))
+	out = append(out, encoded[:ihdrEnd]...)
+	out = append(out, chunk...)
+	return append(out, encoded[ihdrEnd:]...), nil
+}
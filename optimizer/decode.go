@@ -0,0 +1,151 @@
+package optimizer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+
+	"github.com/h2non/bimg"
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// decodeWithVips decodes the formats there is no Go decoder for (HEIC/HEIF, AVIF and, when libvips can load it
+// through ImageMagick, JPEG XL). The embedded profile is applied and the EXIF orientation baked in on the way,
+// since imagemeta can't read them from these containers.
+func decodeWithVips(data []byte) (image.Image, error) {
+	converted, err := bimg.NewImage(data).Process(bimg.Options{
+		Type:          bimg.PNG,
+		OutputICC:     "srgb",
+		StripMetadata: true,
+	})
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	return png.Decode(bytes.NewReader(converted))
+}
+
+// decodeICO decodes the largest image of an ICO file. Entries are either a PNG or a headerless BMP.
+func decodeICO(data []byte) (image.Image, error) {
+	if len(data) < 6 || binary.LittleEndian.Uint16(data[0:2]) != 0 || binary.LittleEndian.Uint16(data[2:4]) != 1 {
+		return nil, errors.Err("not an ico file")
+	}
+	count := int(binary.LittleEndian.Uint16(data[4:6]))
+	var best []byte
+	bestArea := -1
+	for i := 0; i < count; i++ {
+		// width (1), height (1), colors (1), reserved (1), planes (2), bpp (2), size (4), offset (4)
+		entry := 6 + i*16
+		if entry+16 > len(data) {
+			return nil, errors.Err("truncated ico directory")
+		}
+		width, height := int(data[entry]), int(data[entry+1])
+		// 0 stands for 256
+		if width == 0 {
+			width = 256
+		}
+		if height == 0 {
+			height = 256
+		}
+		size := int(binary.LittleEndian.Uint32(data[entry+8 : entry+12]))
+		offset := int(binary.LittleEndian.Uint32(data[entry+12 : entry+16]))
+		if offset < 0 || size < 0 || offset+size > len(data) {
+			return nil, errors.Err("ico entry %d is out of bounds", i)
+		}
+		if width*height > bestArea {
+			best, bestArea = data[offset:offset+size], width*height
+		}
+	}
+	if best == nil {
+		return nil, errors.Err("ico file has no images")
+	}
+	if bytes.HasPrefix(best, []byte("\x89PNG")) {
+		return png.Decode(bytes.NewReader(best))
+	}
+	return decodeDIB(best)
+}
+
+// decodeDIB decodes the BMP of an ICO entry: a BITMAPINFOHEADER whose height covers both the color bitmap
+// and the 1 bit transparency mask that follows it
+func decodeDIB(data []byte) (image.Image, error) {
+	if len(data) < 40 {
+		return nil, errors.Err("truncated ico bitmap")
+	}
+	headerSize := int(binary.LittleEndian.Uint32(data[0:4]))
+	width := int(int32(binary.LittleEndian.Uint32(data[4:8])))
+	height := int(int32(binary.LittleEndian.Uint32(data[8:12]))) / 2
+	bpp := int(binary.LittleEndian.Uint16(data[14:16]))
+	compression := binary.LittleEndian.Uint32(data[16:20])
+	colors := int(binary.LittleEndian.Uint32(data[32:36]))
+	if compression != 0 {
+		return nil, errors.Err("compressed ico bitmaps are not supported")
+	}
+	if width <= 0 || height <= 0 || width > 1024 || height > 1024 || headerSize < 40 || headerSize > len(data) {
+		return nil, errors.Err("malformed ico bitmap")
+	}
+	var palette []color.NRGBA
+	pos := headerSize
+	switch bpp {
+	case 1, 4, 8:
+		if colors == 0 {
+			colors = 1 << bpp
+		}
+		if pos+colors*4 > len(data) {
+			return nil, errors.Err("truncated ico palette")
+		}
+		for i := 0; i < colors; i++ {
+			p := data[pos+i*4:]
+			palette = append(palette, color.NRGBA{R: p[2], G: p[1], B: p[0], A: 0xff})
+		}
+		pos += colors * 4
+	case 24, 32:
+	default:
+		return nil, errors.Err("%d bit ico bitmaps are not supported", bpp)
+	}
+	// rows are stored bottom-up and padded to 4 bytes
+	stride := (width*bpp + 31) / 32 * 4
+	maskStride := (width + 31) / 32 * 4
+	if pos+stride*height > len(data) {
+		return nil, errors.Err("truncated ico bitmap")
+	}
+	mask := data[pos+stride*height:]
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	hasAlpha := false
+	for y := 0; y < height; y++ {
+		row := data[pos+(height-1-y)*stride:]
+		for x := 0; x < width; x++ {
+			var c color.NRGBA
+			switch bpp {
+			case 32:
+				c = color.NRGBA{R: row[x*4+2], G: row[x*4+1], B: row[x*4], A: row[x*4+3]}
+				hasAlpha = hasAlpha || c.A != 0
+			case 24:
+				c = color.NRGBA{R: row[x*3+2], G: row[x*3+1], B: row[x*3], A: 0xff}
+			default:
+				bit := x * bpp
+				index := int(row[bit/8]>>(8-bpp-bit%8)) & (1<<bpp - 1)
+				if index < len(palette) {
+					c = palette[index]
+				}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	// 32 bit entries carry their own alpha, older ones (or 32 bit ones that leave it empty) rely on the mask
+	if hasAlpha {
+		return img, nil
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := img.NRGBAAt(x, y)
+			c.A = 0xff
+			offset := (height-1-y)*maskStride + x/8
+			if offset < len(mask) && mask[offset]&(0x80>>(x%8)) != 0 {
+				c.A = 0
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img, nil
+}
@@ -0,0 +1,144 @@
+package optimizer
+
+import (
+	"image"
+
+	"github.com/OdyseeTeam/mirage/internal/libwebp"
+	"github.com/OdyseeTeam/mirage/internal/metrics"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// Encoding is how a still image is encoded to WebP
+type Encoding string
+
+const (
+	EncodingLossy        Encoding = "lossy"
+	EncodingNearLossless Encoding = "near-lossless"
+	EncodingLossless     Encoding = "lossless"
+)
+
+// WebPConfig tunes the WebP encoders, the zero value uses the defaults
+type WebPConfig struct {
+	// LossyGraphics turns off the detection of graphics (logos, screenshots, text), which are otherwise encoded
+	// losslessly or near-losslessly
+	LossyGraphics bool `mapstructure:"lossy_graphics"`
+	// NearLossless is the level of near-lossless encoding, from 0 (most preprocessing) to 100 (lossless), 60 when nil
+	NearLossless *int `mapstructure:"near_lossless"`
+	// Method is the encoder method of lossy still images, from 0 (fastest) to 6 (smallest), 4 when nil
+	Method *int `mapstructure:"method"`
+	// LosslessMethod is the encoder method of lossless and near-lossless still images, 4 when nil
+	LosslessMethod *int `mapstructure:"lossless_method"`
+	// AnimationMethod is the encoder method of GIF conversions, 4 when nil
+	AnimationMethod *int `mapstructure:"animation_method"`
+}
+
+// withDefaults fills in the unset fields, which are all set afterwards
+func (c WebPConfig) withDefaults() (WebPConfig, error) {
+	if c.NearLossless == nil {
+		level := 60
+		c.NearLossless = &level
+	}
+	if *c.NearLossless < 0 || *c.NearLossless > 100 {
+		return c, errors.Err("webp near lossless level must be between 0 and 100")
+	}
+	c.Method = defaultMethod(c.Method)
+	c.LosslessMethod = defaultMethod(c.LosslessMethod)
+	c.AnimationMethod = defaultMethod(c.AnimationMethod)
+	if *c.Method < 0 || *c.Method > 6 {
+		return c, errors.Err("webp method must be between 0 and 6")
+	}
+	if *c.LosslessMethod < 0 || *c.LosslessMethod > 6 {
+		return c, errors.Err("webp lossless method must be between 0 and 6")
+	}
+	if *c.AnimationMethod < 0 || *c.AnimationMethod > 6 {
+		return c, errors.Err("webp animation method must be between 0 and 6")
+	}
+	return c, nil
+}
+
+// defaultMethod is method, or libwebp's default method 4 when it's nil
+func defaultMethod(method *int) *int {
+	if method == nil {
+		value := 4
+		return &value
+	}
+	return method
+}
+
+const (
+	// graphicsMaxColors is the palette size up to which an image is encoded losslessly
+	graphicsMaxColors = 256
+	// graphicsMinFlat is the share of pixels equal to their left neighbour from which an image is taken for a
+	// graphic, photos being noisy. Transparent images need less since their flat areas are often see-through.
+	graphicsMinFlat      = 0.6
+	graphicsMinFlatAlpha = 0.4
+	// classifySamples bounds how many pixels are looked at
+	classifySamples = 512 * 512
+)
+
+// encoding picks how img is encoded: lossless when asked or for images with few colors, near-lossless for those with
+// sharp edges and flat areas, lossy otherwise
+func (o *Optimizer) encoding(img image.Image, opts Options) Encoding {
+	if opts.Lossless {
+		return EncodingLossless
+	}
+	if o.webp.LossyGraphics {
+		return EncodingLossy
+	}
+	return classify(img)
+}
+
+func classify(img image.Image) Encoding {
+	b := img.Bounds()
+	step := 1
+	for b.Dx()*b.Dy()/(step*step) > classifySamples {
+		step++
+	}
+	colors := make(map[uint32]struct{}, graphicsMaxColors+1)
+	flat, samples, alpha := 0, 0, false
+	for y := b.Min.Y; y < b.Max.Y; y += step {
+		var previous uint32
+		for x := b.Min.X; x < b.Max.X; x += step {
+			r, g, bl, a := img.At(x, y).RGBA()
+			c := r>>8<<24 | g>>8<<16 | bl>>8<<8 | a>>8
+			if len(colors) <= graphicsMaxColors {
+				colors[c] = struct{}{}
+			}
+			if x > b.Min.X && c == previous {
+				flat++
+			}
+			alpha = alpha || a != 0xffff
+			previous = c
+			samples++
+		}
+	}
+	if samples == 0 {
+		return EncodingLossy
+	}
+	if len(colors) <= graphicsMaxColors {
+		return EncodingLossless
+	}
+	share := float64(flat) / float64(samples)
+	if share >= graphicsMinFlat || alpha && share >= graphicsMinFlatAlpha {
+		return EncodingNearLossless
+	}
+	return EncodingLossy
+}
+
+// encodeWebP encodes a still image, quality only matters to lossy encoding
+func (o *Optimizer) encodeWebP(img image.Image, encoding Encoding, quality int64) ([]byte, error) {
+	options := libwebp.Options{Quality: float32(quality), Method: *o.webp.Method, NearLossless: 100}
+	switch encoding {
+	case EncodingNearLossless:
+		options.Lossless, options.Method, options.NearLossless = true, *o.webp.LosslessMethod, *o.webp.NearLossless
+	case EncodingLossless:
+		options.Lossless, options.Method = true, *o.webp.LosslessMethod
+	}
+	encoded, err := libwebp.Encode(img, options)
+	if err != nil {
+		return nil, err
+	}
+	metrics.WebPEncodings.WithLabelValues(string(encoding)).Inc()
+	return encoded, nil
+}
@@ -0,0 +1,179 @@
+package optimizer
+
+import (
+	"image"
+	"image/draw"
+	"math"
+
+	"github.com/OdyseeTeam/mirage/internal/resample"
+)
+
+// Filters are applied to the resized image, color adjustments first, then blur and sharpen.
+// The zero value leaves the image alone.
+type Filters struct {
+	// Brightness, Contrast and Saturation are adjustments from -100 to 100 percent
+	Brightness float64
+	Contrast   float64
+	Saturation float64
+	Grayscale  bool
+	// Blur is the sigma of a gaussian blur, in output pixels
+	Blur float64
+	// Sharpen is the amount of an unsharp mask with a 1 pixel sigma
+	Sharpen float64
+}
+
+// IsZero reports whether the filters leave the image alone
+func (f Filters) IsZero() bool {
+	return f == Filters{}
+}
+
+const (
+	// MaxBlur is the largest blur sigma, past it everything is a smudge anyway
+	MaxBlur = 50
+	// blurDownscaleSigma is the sigma past which images are blurred at a lower resolution: the cost of a blur grows
+	// with its radius, and a wide blur leaves no detail that the downscaling could lose
+	blurDownscaleSigma = 8
+)
+
+func (f Filters) apply(img image.Image) image.Image {
+	if f.IsZero() {
+		return img
+	}
+	// premultiplied, so that blurring doesn't bleed the color of transparent pixels
+	rgba := image.NewRGBA(img.Bounds())
+	draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+	if f.Brightness != 0 || f.Contrast != 0 || f.Saturation != 0 || f.Grayscale {
+		f.adjustColors(rgba)
+	}
+	if f.Blur > 0 {
+		rgba = blur(rgba, math.Min(f.Blur, MaxBlur))
+	}
+	if f.Sharpen > 0 {
+		rgba = unsharpMask(rgba, f.Sharpen)
+	}
+	return rgba
+}
+
+func (f Filters) adjustColors(img *image.RGBA) {
+	brightness := f.Brightness / 100 * 255
+	contrast := 1 + f.Contrast/100
+	saturation := 1 + f.Saturation/100
+	if f.Grayscale {
+		saturation = 0
+	}
+	for i := 0; i+3 < len(img.Pix); i += 4 {
+		alpha := float64(img.Pix[i+3])
+		if alpha == 0 {
+			continue
+		}
+		// work on straight colors, write premultiplied ones back
+		var c [3]float64
+		for j := range c {
+			c[j] = float64(img.Pix[i+j]) * 255 / alpha
+		}
+		luma := 0.299*c[0] + 0.587*c[1] + 0.114*c[2]
+		for j := range c {
+			v := luma + (c[j]-luma)*saturation
+			v = (v-128)*contrast + 128 + brightness
+			img.Pix[i+j] = uint8(math.Round(clamp(v, 0, 255) * alpha / 255))
+		}
+	}
+}
+
+// blur applies a gaussian blur of sigma, on a copy downscaled to a sigma of blurDownscaleSigma/2 when it is wider than
+// blurDownscaleSigma, which is then upscaled back
+func blur(img *image.RGBA, sigma float64) *image.RGBA {
+	if sigma <= blurDownscaleSigma {
+		return gaussianBlur(img, sigma)
+	}
+	scale := sigma / (blurDownscaleSigma / 2)
+	b := img.Bounds()
+	width, height := max(1, int(math.Round(float64(b.Dx())/scale))), max(1, int(math.Round(float64(b.Dy())/scale)))
+	small := toRGBA(resample.Resize(img, width, height, resample.Bilinear, false))
+	blurred := gaussianBlur(small, blurDownscaleSigma/2)
+	out := image.NewRGBA(b)
+	draw.Draw(out, b, resample.Resize(blurred, b.Dx(), b.Dy(), resample.Bilinear, false), image.Point{}, draw.Src)
+	return out
+}
+
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok {
+		return rgba
+	}
+	rgba := image.NewRGBA(img.Bounds())
+	draw.Draw(rgba, rgba.Rect, img, img.Bounds().Min, draw.Src)
+	return rgba
+}
+
+// gaussianBlur blurs horizontally then vertically, clamping at the edges
+func gaussianBlur(img *image.RGBA, sigma float64) *image.RGBA {
+	radius := int(math.Ceil(sigma * 3))
+	kernel := make([]float64, 2*radius+1)
+	var sum float64
+	for i := range kernel {
+		x := float64(i - radius)
+		kernel[i] = math.Exp(-x * x / (2 * sigma * sigma))
+		sum += kernel[i]
+	}
+	for i := range kernel {
+		kernel[i] /= sum
+	}
+	b := img.Bounds()
+	width, height := b.Dx(), b.Dy()
+	pass := func(src *image.RGBA, horizontal bool) *image.RGBA {
+		dst := image.NewRGBA(b)
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				var acc [4]float64
+				for k, weight := range kernel {
+					sx, sy := x, y
+					if horizontal {
+						sx = clampInt(x+k-radius, 0, width-1)
+					} else {
+						sy = clampInt(y+k-radius, 0, height-1)
+					}
+					o := sy*src.Stride + sx*4
+					for c := 0; c < 4; c++ {
+						acc[c] += weight * float64(src.Pix[o+c])
+					}
+				}
+				o := y*dst.Stride + x*4
+				for c := 0; c < 4; c++ {
+					dst.Pix[o+c] = uint8(math.Round(clamp(acc[c], 0, 255)))
+				}
+			}
+		}
+		return dst
+	}
+	return pass(pass(img, true), false)
+}
+
+// unsharpMask adds amount times the difference between img and its blurred self
+func unsharpMask(img *image.RGBA, amount float64) *image.RGBA {
+	blurred := gaussianBlur(img, 1)
+	out := image.NewRGBA(img.Bounds())
+	for i := 0; i+3 < len(img.Pix); i += 4 {
+		alpha := img.Pix[i+3]
+		for c := 0; c < 3; c++ {
+			v := float64(img.Pix[i+c]) + amount*(float64(img.Pix[i+c])-float64(blurred.Pix[i+c]))
+			// premultiplied colors can't exceed alpha
+			out.Pix[i+c] = uint8(math.Round(clamp(v, 0, float64(alpha))))
+		}
+		out.Pix[i+3] = alpha
+	}
+	return out
+}
+
+func clamp(v, min, max float64) float64 {
+	return math.Max(min, math.Min(max, v))
+}
+
+func clampInt(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
@@ -0,0 +1,73 @@
+package optimizer
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+
+	"github.com/OdyseeTeam/mirage/internal/metrics"
+	"github.com/OdyseeTeam/mirage/internal/vips"
+
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// JpegOptions are the settings of JPEG output, the zero value being a baseline 4:2:0 JPEG with the standard tables
+type JpegOptions struct {
+	Quality     int64 `mapstructure:"-"`
+	Progressive bool  `mapstructure:"progressive"`
+	// Subsampling is "420", the default, or "444", which keeps text and thin colored lines sharp
+	Subsampling string `mapstructure:"subsampling"`
+	// Trellis zeroes the coefficients that aren't worth their bits and deringing hides the overshoot of text edges,
+	// which libvips only does when built with mozjpeg. Huffman fits the Huffman tables to the image.
+	Trellis bool `mapstructure:"trellis"`
+	Huffman bool `mapstructure:"huffman"`
+	// QuantTable is one of the quantization tables of mozjpeg from 0 (the standard ones) to 8
+	QuantTable int `mapstructure:"quant_table"`
+}
+
+func (j JpegOptions) encoderOptions() (vips.JpegOptions, error) {
+	opts := vips.JpegOptions{
+		Quality:        int(j.Quality),
+		Progressive:    j.Progressive,
+		Trellis:        j.Trellis,
+		OptimizeCoding: j.Huffman,
+		QuantTable:     j.QuantTable,
+	}
+	switch j.Subsampling {
+	case "", "420":
+		opts.Subsampling = vips.Subsampling420
+	case "444":
+		opts.Subsampling = vips.Subsampling444
+	default:
+		return opts, errors.Err("unknown jpeg subsampling %q", j.Subsampling)
+	}
+	if opts.Quality < 1 || opts.Quality > 100 {
+		return opts, errors.Err("jpeg quality must be between 1 and 100")
+	}
+	return opts, nil
+}
+
+// JpegOptimize converts an optimized image, animations by their first frame, to a JPEG. Transparency is flattened
+// onto white.
+func (o *Optimizer) JpegOptimize(data []byte, opts JpegOptions) (optimized []byte, originalContentType, optimizedContentType string, err error) {
+	metrics.JpegOptimizedImages.Inc()
+	contentType := mimetype.Detect(data).String()
+	encoderOptions, err := opts.encoderOptions()
+	if err != nil {
+		return nil, contentType, "", err
+	}
+	frames, _ := animation(data, contentType)
+	img, err := decodeFirstFrame(data, contentType, frames)
+	if err != nil {
+		return nil, contentType, "", err
+	}
+	flattened := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(flattened, flattened.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(flattened, flattened.Bounds(), img, img.Bounds().Min, draw.Over)
+	optimized, err = vips.JpegSave(flattened, encoderOptions)
+	if err != nil {
+		return nil, contentType, "", err
+	}
+	return optimized, contentType, "image/jpeg", nil
+}
@@ -0,0 +1,58 @@
+package optimizer
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"strings"
+
+	"github.com/OdyseeTeam/mirage/internal/imagemeta"
+	"github.com/OdyseeTeam/mirage/internal/metrics"
+)
+
+// keptFormats are the source formats browsers display, which are the only ones worth keeping
+var keptFormats = []string{"image/jpeg", "image/png", "image/gif", "image/webp"}
+
+// smallerSource returns the source, or its resized version in its own format, if it's no bigger than the
+// optimized output of the given size. resized is what was encoded, nil when the source was converted as is.
+// It returns nil when re-encoding is worth it or the source can't be kept.
+func smallerSource(data []byte, contentType string, resized image.Image, opts Options, size int) []byte {
+	kept := keptCandidate(data, contentType, resized, opts)
+	if kept == nil || len(kept) > size {
+		metrics.SizeComparisons.WithLabelValues("reencoded").Inc()
+		return nil
+	}
+	metrics.SizeComparisons.WithLabelValues("source").Inc()
+	return kept
+}
+
+func keptCandidate(data []byte, contentType string, resized image.Image, opts Options) []byte {
+	keepable := false
+	for _, format := range keptFormats {
+		keepable = keepable || strings.Contains(contentType, format)
+	}
+	// the source doesn't have the filters, and metadata must not get through with the source
+	if !keepable || !opts.Filters.IsZero() || imagemeta.HasIdentifying(data) {
+		return nil
+	}
+	if resized == nil {
+		return data
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+	if cfg.Width == resized.Bounds().Dx() && cfg.Height == resized.Bounds().Dy() {
+		return data
+	}
+	// resized sources are only worth keeping for PNGs, lossy formats are always better off as WebP
+	if !strings.Contains(contentType, "png") {
+		return nil
+	}
+	var buf bytes.Buffer
+	encoder := png.Encoder{CompressionLevel: png.BestCompression}
+	if encoder.Encode(&buf, resized) != nil {
+		return nil
+	}
+	return buf.Bytes()
+}
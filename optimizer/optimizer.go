@@ -2,49 +2,142 @@ package optimizer
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"image"
+	"image/gif"
 	"image/jpeg"
 	"image/png"
 	"strings"
 
+	"github.com/OdyseeTeam/mirage/internal/imagehash"
+	"github.com/OdyseeTeam/mirage/internal/imagemeta"
+	"github.com/OdyseeTeam/mirage/internal/libwebp"
 	"github.com/OdyseeTeam/mirage/internal/metrics"
 	"github.com/chai2010/webp"
-	"github.com/gabriel-vasile/mimetype"
-	"github.com/h2non/bimg"
 	"github.com/lbryio/lbry.go/v2/extras/errors"
-	"github.com/nfnt/resize"
 	_ "github.com/oov/psd"
 	log "github.com/sirupsen/logrus"
 	giftowebp "github.com/sizeofint/gif-to-webp"
 	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
 )
 
-type Optimizer struct {
+// MetadataPolicy is what embedded metadata survives optimization
+type MetadataPolicy string
+
+const (
+	// MetadataStrip drops all metadata, GPS tags included. This is the default.
+	MetadataStrip MetadataPolicy = "strip"
+	// MetadataKeepICC keeps the color profile only
+	MetadataKeepICC MetadataPolicy = "icc"
+	// MetadataKeepCopyright keeps the color profile and the artist and copyright EXIF tags
+	MetadataKeepCopyright MetadataPolicy = "copyright"
+)
+
+// Config tunes the optimizer, the zero value is valid
+type Config struct {
+	MetadataPolicy MetadataPolicy `mapstructure:"metadata_policy"`
+	// PreserveWideGamut keeps AVIF output in the color space of the source instead of converting it to sRGB, with the
+	// profile embedded. WebP, JPEG and PNG output is always sRGB.
+	PreserveWideGamut bool              `mapstructure:"preserve_wide_gamut"`
+	AutoQuality       AutoQualityConfig `mapstructure:"auto_quality"`
+	WebP              WebPConfig        `mapstructure:"webp"`
+	Processor         ProcessorConfig   `mapstructure:"processor"`
+	Resize            ResizeConfig      `mapstructure:"resize"`
 }
 
-func NewOptimizer() *Optimizer {
-	return &Optimizer{}
+// AutoQuality as Options.Quality picks the lowest quality whose output is similar enough to the source, see ChooseQuality
+const AutoQuality int64 = -1
+
+// Options are the settings of a single optimization
+type Options struct {
+	Quality int64
+	// Width and Height bound the output, zero keeps the aspect ratio (or the source size when both are zero)
+	Width, Height int64
+	// RasterizeSVG renders SVG sources instead of sanitizing them and passing them through
+	RasterizeSVG bool
+	// Filters turn animated GIFs into their first frame and rasterize SVGs, since passing those through would
+	// skip the filters
+	Filters Filters
+	// KeepSmallerSource returns the source, resized in its own format if need be, when re-encoding it to WebP
+	// doesn't make it smaller. The optimized content type is then the original one.
+	KeepSmallerSource bool
+	// Lossless encodes still images losslessly, which graphics are anyway unless the configuration says otherwise
+	Lossless bool
+	// Png encodes a PNG instead of a WebP when set
+	Png *PngOptions
+	// Avif encodes a still AVIF instead of a WebP, see Config.PreserveWideGamut
+	Avif bool
+	// Kernel overrides the configured resampling kernel when not empty
+	Kernel Kernel
+	// Linear resizes in linear light, whatever the configuration says
+	Linear bool
+}
+
+type Optimizer struct {
+	metadataPolicy    MetadataPolicy
+	preserveWideGamut bool
+	autoQuality       AutoQualityConfig
+	webp              WebPConfig
+	processors        ProcessorConfig
+	resize            ResizeConfig
 }
 
-func (o *Optimizer) JpegOptimize(data []byte, quality, width, height int64) (optimized []byte, originalContentType, optimizedContentType string, err error) {
-	metrics.JpegOptimizedImages.Inc()
-	contentType := mimetype.Detect(data).String()
-	newImage, err := bimg.NewImage(data).Convert(bimg.JPEG)
+func NewOptimizer(cfg Config) (*Optimizer, error) {
+	switch cfg.MetadataPolicy {
+	case "":
+		cfg.MetadataPolicy = MetadataStrip
+	case MetadataStrip, MetadataKeepICC, MetadataKeepCopyright:
+	default:
+		return nil, errors.Err("unknown metadata policy %q", cfg.MetadataPolicy)
+	}
+	autoQuality, err := cfg.AutoQuality.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	webPConfig, err := cfg.WebP.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	processors, err := cfg.Processor.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	resize, err := cfg.Resize.withDefaults()
 	if err != nil {
-		return nil, contentType, "", errors.Err(err)
+		return nil, err
 	}
-	return newImage, contentType, mimetype.Detect(newImage).String(), nil
+	return &Optimizer{
+		metadataPolicy:    cfg.MetadataPolicy,
+		preserveWideGamut: cfg.PreserveWideGamut,
+		autoQuality:       autoQuality,
+		webp:              webPConfig,
+		processors:        processors,
+		resize:            resize,
+	}, nil
 }
 
-func (o *Optimizer) Optimize(data []byte, quality, width, height int64) (optimized []byte, originalContentType, optimizedContentType string, err error) {
+func (o *Optimizer) Optimize(data []byte, opts Options) (optimized []byte, originalContentType, optimizedContentType string, err error) {
+	return o.OptimizeSource(NewSource(data), opts)
+}
+
+// OptimizeSource is Optimize reusing what src already decoded
+func (o *Optimizer) OptimizeSource(src *Source, opts Options) (optimized []byte, originalContentType, optimizedContentType string, err error) {
 	metrics.OptimizersRunning.Inc()
 	metrics.OptimizedImages.Inc()
 	defer metrics.OptimizersRunning.Dec()
-	var buf bytes.Buffer
-	contentType := mimetype.Detect(data).String()
+	data, contentType := src.data, src.contentType
+	metrics.InputFormats.WithLabelValues(contentType).Inc()
 	webPContentType := "image/webp"
-	if strings.Contains(contentType, "gif") {
+	filtered := !opts.Filters.IsZero()
+	if opts.Png != nil {
+		return o.optimizePng(src, opts)
+	}
+	if opts.Avif {
+		return o.optimizeAvif(src, opts)
+	}
+	if strings.Contains(contentType, "gif") && !filtered {
 		//gif, err := gif.DecodeAll(bytes.NewReader(data))
 		//if err != nil {
 		//	log.Fatal(err)
@@ -80,12 +173,23 @@ func (o *Optimizer) Optimize(data []byte, quality, width, height int64) (optimiz
 
 		converter := giftowebp.NewConverter()
 		converter.LoopCompatibility = false
+		quality := opts.Quality
+		// animations aren't searched, see ChooseQuality
+		if quality == AutoQuality {
+			quality = FallbackQuality
+		}
 		converter.WebPConfig.SetQuality(float32(quality))
-		converter.WebPConfig.SetMethod(4)
+		converter.WebPConfig.SetMethod(*o.webp.AnimationMethod)
 		webpBin, err := converter.Convert(data)
 		if err != nil {
 			return nil, contentType, "", errors.Err(err)
 		}
+		// animations aren't resized, the source is what the output compares with
+		if opts.KeepSmallerSource {
+			if kept := smallerSource(data, contentType, nil, opts, len(webpBin)); kept != nil {
+				return kept, contentType, contentType, nil
+			}
+		}
 		return webpBin, contentType, webPContentType, nil
 	} else if strings.Contains(contentType, "webp") {
 		//https://stackoverflow.com/questions/45190469/how-to-identify-whether-webp-image-is-static-or-animated
@@ -103,36 +207,115 @@ func (o *Optimizer) Optimize(data []byte, quality, width, height int64) (optimiz
 		//it's animated, I don't know how to properly work on this
 		//explore https://github.com/h2non/bimg https://github.com/discord/lilliput
 		if riff && simplewebp && vp8x && (anim || anim2) {
+			if filtered {
+				return nil, contentType, "", errors.Err("filters can't be applied to animated webp")
+			}
 			return data, contentType, webPContentType, nil
 		}
-	} else if strings.Contains(contentType, "svg") {
-		return data, contentType, contentType, nil
 	}
 
-	img, err := readRawImage(data, contentType, 16383*16383)
+	if strings.Contains(contentType, "svg") && !opts.RasterizeSVG && !filtered {
+		sanitized, err := SanitizeSVG(data)
+		if err != nil {
+			return nil, contentType, "", err
+		}
+		return sanitized, contentType, contentType, nil
+	}
+	img, md, err := o.prepare(src, opts)
 	if err != nil {
 		return nil, contentType, "", err
 	}
-	img = resize.Resize(uint(width), uint(height), img, resize.Lanczos3)
-	err = webp.Encode(&buf, img, &webp.Options{Lossless: false, Quality: float32(quality)})
+	encoding := o.encoding(img, opts)
+	if opts.Quality == AutoQuality && encoding == EncodingLossy {
+		opts.Quality, err = o.searchQuality(img)
+		if err != nil {
+			return nil, contentType, "", err
+		}
+	}
+	encoded, err := o.encodeWebP(img, encoding, opts.Quality)
 	if err != nil {
-		return nil, contentType, "", errors.Err(err)
+		return nil, contentType, "", err
 	}
+	optimized, err = o.attachMetadata(encoded, md)
+	if err != nil {
+		return nil, contentType, "", err
+	}
+	if opts.KeepSmallerSource {
+		if kept := smallerSource(data, contentType, img, opts, len(optimized)); kept != nil {
+			return kept, contentType, contentType, nil
+		}
+	}
+
+	return optimized, contentType, webPContentType, nil
+}
 
-	return buf.Bytes(), contentType, webPContentType, nil
+// prepare decodes a still source and brings it to the output size and to sRGB, with the filters applied. The result
+// is kept in src for the next call with the same size, filters and resizing.
+func (o *Optimizer) prepare(src *Source, opts Options) (image.Image, imagemeta.Metadata, error) {
+	key := prepareKey{width: opts.Width, height: opts.Height, filters: opts.Filters, resize: o.resizing(opts)}
+	if p, ok := src.prepared[key]; ok {
+		return p.img, p.md, p.err
+	}
+	md := imagemeta.Read(src.data)
+	img, err := o.load(src, md.Orientation, opts)
+	if err != nil {
+		src.prepared[key] = preparedImage{err: err}
+		return nil, imagemeta.Metadata{}, err
+	}
+	img, md = toSRGB(img, md)
+	img = opts.Filters.apply(img)
+	src.prepared[key] = preparedImage{img: img, md: md}
+	return img, md, nil
+}
+
+// attachMetadata copies the source metadata allowed by the metadata policy into an encoded WebP
+func (o *Optimizer) attachMetadata(encoded []byte, md imagemeta.Metadata) ([]byte, error) {
+	if o.metadataPolicy == MetadataStrip {
+		return encoded, nil
+	}
+	var err error
+	if len(md.ICC) > 0 {
+		encoded, err = webp.SetMetadata(encoded, md.ICC, "ICCP")
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+	}
+	if o.metadataPolicy == MetadataKeepCopyright {
+		if exif := imagemeta.BuildExif(md.Artist, md.Copyright); exif != nil {
+			encoded, err = webp.SetMetadata(encoded, exif, "EXIF")
+			if err != nil {
+				return nil, errors.Err(err)
+			}
+		}
+	}
+	return encoded, nil
 }
 
 func readRawImage(data []byte, contentType string, maxPixel int) (img image.Image, err error) {
 	if strings.Contains(contentType, "jpeg") || strings.Contains(contentType, "jpg") {
-		img, err = jpeg.Decode(bytes.NewReader(data))
+		if isCMYKJPEG(data) {
+			img, err = decodeCMYK(data)
+		} else {
+			img, err = jpeg.Decode(bytes.NewReader(data))
+		}
 	} else if strings.Contains(contentType, "png") {
 		img, err = png.Decode(bytes.NewReader(data))
+	} else if strings.Contains(contentType, "gif") {
+		// the first frame, animations are converted as a whole before getting here
+		img, err = gif.Decode(bytes.NewReader(data))
 	} else if strings.Contains(contentType, "bmp") {
 		img, err = bmp.Decode(bytes.NewReader(data))
 	} else if strings.Contains(contentType, "webp") {
-		img, err = webp.Decode(bytes.NewReader(data))
+		img, err = libwebp.Decode(data)
 	} else if strings.Contains(contentType, "image/vnd.adobe.photoshop") {
 		img, _, err = image.Decode(bytes.NewReader(data))
+	} else if strings.Contains(contentType, "tiff") {
+		// only the first page of multi-page files is decoded
+		img, err = tiff.Decode(bytes.NewReader(data))
+	} else if strings.Contains(contentType, "icon") {
+		img, err = decodeICO(data)
+	} else if vipsOnly(contentType) {
+		img, err = decodeWithVips(data)
 	} else {
 		return nil, errors.Err("%s type is not supported", contentType)
 	}
@@ -150,3 +333,33 @@ func readRawImage(data []byte, contentType string, maxPixel int) (img image.Imag
 
 	return img, nil
 }
+
+// vipsOnly reports whether contentType is one of the formats only libvips decodes
+func vipsOnly(contentType string) bool {
+	return strings.Contains(contentType, "heic") || strings.Contains(contentType, "heif") ||
+		strings.Contains(contentType, "avif") || strings.Contains(contentType, "jxl")
+}
+
+// Dimensions returns the pixel size of an encoded image, or zeroes if it can't be determined (e.g. SVG)
+func Dimensions(data []byte) (width, height int) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return 0, 0
+	}
+	return cfg.Width, cfg.Height
+}
+
+// Fingerprint identifies a source image by the SHA-256 of its bytes and, when it can be decoded, its perceptual hash
+func (o *Optimizer) Fingerprint(data []byte) (checksum string, phash imagehash.Hash) {
+	return o.FingerprintSource(NewSource(data))
+}
+
+// FingerprintSource is Fingerprint keeping the full decode of src for OptimizeSource and ChooseQualitySource
+func (o *Optimizer) FingerprintSource(src *Source) (checksum string, phash imagehash.Hash) {
+	checksum = fmt.Sprintf("%x", sha256.Sum256(src.data))
+	img, err := src.rawImage()
+	if err != nil {
+		return checksum, 0
+	}
+	return checksum, imagehash.DHash(img)
+}
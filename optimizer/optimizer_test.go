@@ -0,0 +1,802 @@
+package optimizer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/OdyseeTeam/mirage/internal/icc"
+	"github.com/OdyseeTeam/mirage/internal/imagemeta"
+	"github.com/OdyseeTeam/mirage/internal/libwebp"
+	"github.com/OdyseeTeam/mirage/internal/resample"
+	"github.com/OdyseeTeam/mirage/internal/similarity"
+
+	"github.com/chai2010/webp"
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/h2non/bimg"
+)
+
+// golden describes what optimizing a fixture from testdata (see testdata/generate.go) must produce
+type golden struct {
+	name          string
+	file          string
+	width, height int64
+	// wantMime is the mime type of the output, empty when optimizing must fail
+	wantMime              string
+	wantWidth, wantHeight int
+	// passthrough is set when the source must be served untouched
+	passthrough bool
+	// rasterizeSVG renders SVG sources, which needs libvips
+	rasterizeSVG bool
+	// minSSIM and minPSNR bound how far the output may drift from the resized reference, zero skips the comparison
+	minSSIM, minPSNR float64
+	// reference is the fixture the output is compared with, the source itself when empty
+	reference string
+}
+
+var goldens = []golden{
+	{name: "jpeg", file: "video-001.jpeg", wantMime: "image/webp", wantWidth: 150, wantHeight: 103, minSSIM: 0.97, minPSNR: 32},
+	{name: "jpeg resized", file: "video-001.jpeg", width: 75, wantMime: "image/webp", wantWidth: 75, wantHeight: 52, minSSIM: 0.94, minPSNR: 24},
+	{name: "progressive jpeg", file: "video-001.progressive.jpeg", wantMime: "image/webp", wantWidth: 150, wantHeight: 103, minSSIM: 0.97, minPSNR: 32},
+	{name: "jpeg with exif orientation", file: "exif-rotated.jpeg", wantMime: "image/webp", wantWidth: 150, wantHeight: 103, minSSIM: 0.97, minPSNR: 32, reference: "video-001.jpeg"},
+	{name: "display p3 jpeg", file: "display-p3.jpeg", wantMime: "image/webp", wantWidth: 150, wantHeight: 103, minSSIM: 0.97, minPSNR: 32, reference: "video-001.jpeg"},
+	// how CMYK maps to RGB depends on whether libvips is there to apply a CMYK profile, only the geometry is stable
+	{name: "cmyk jpeg", file: "video-001.cmyk.jpeg", wantMime: "image/webp", wantWidth: 150, wantHeight: 103},
+	{name: "png stretched", file: "video-001.png", width: 100, height: 100, wantMime: "image/webp", wantWidth: 100, wantHeight: 100, minSSIM: 0.97, minPSNR: 31},
+	{name: "png with alpha", file: "alpha.png", wantMime: "image/webp", wantWidth: 128, wantHeight: 96, minSSIM: 0.98, minPSNR: 40},
+	{name: "16 bit png", file: "16bit.png", wantMime: "image/webp", wantWidth: 160, wantHeight: 120, minSSIM: 0.97, minPSNR: 40},
+	{name: "bmp", file: "video-001.bmp", wantMime: "image/webp", wantWidth: 150, wantHeight: 103, minSSIM: 0.97, minPSNR: 32},
+	{name: "psd", file: "video-001.psd", wantMime: "image/webp", wantWidth: 150, wantHeight: 103, minSSIM: 0.97, minPSNR: 32},
+	{name: "tiff", file: "video-001.tiff", wantMime: "image/webp", wantWidth: 150, wantHeight: 103, minSSIM: 0.97, minPSNR: 32},
+	{name: "ico largest entry", file: "favicon.ico", wantMime: "image/webp", wantWidth: 32, wantHeight: 32},
+	{name: "static webp resized", file: "video-001.webp", height: 51, wantMime: "image/webp", wantWidth: 74, wantHeight: 51, minSSIM: 0.96, minPSNR: 28},
+	{name: "animated webp", file: "animated.webp", width: 32, wantMime: "image/webp", wantWidth: 64, wantHeight: 48, passthrough: true},
+	{name: "animated gif", file: "animated.gif", wantMime: "image/webp", wantWidth: 64, wantHeight: 48},
+	{name: "svg", file: "drawing.svg", wantMime: "image/svg+xml"},
+	{name: "svg rasterized", file: "drawing.svg", width: 60, rasterizeSVG: true, wantMime: "image/webp", wantWidth: 60, wantHeight: 40},
+	{name: "truncated jpeg", file: "truncated.jpeg"},
+	{name: "corrupted png", file: "garbage.png"},
+}
+
+func TestOptimizeGolden(t *testing.T) {
+	o, err := NewOptimizer(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, g := range goldens {
+		g := g
+		t.Run(g.name, func(t *testing.T) {
+			if g.rasterizeSVG && !bimg.IsTypeSupported(bimg.SVG) {
+				t.Skip("libvips can't load svg")
+			}
+			source, err := os.ReadFile(filepath.Join("testdata", g.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			optimized, _, optimizedMime, err := o.Optimize(source, Options{Quality: 85, Width: g.width, Height: g.height, RasterizeSVG: g.rasterizeSVG})
+			if g.wantMime == "" {
+				if err == nil {
+					t.Fatalf("expected an error, got a %d bytes %s", len(optimized), optimizedMime)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if optimizedMime != g.wantMime {
+				t.Errorf("reported mime %s, want %s", optimizedMime, g.wantMime)
+			}
+			if detected := mimetype.Detect(optimized).String(); detected != g.wantMime {
+				t.Errorf("output is %s, want %s", detected, g.wantMime)
+			}
+			if g.passthrough && !bytes.Equal(optimized, source) {
+				t.Errorf("expected the source to be passed through")
+			}
+			if g.wantWidth == 0 {
+				return
+			}
+			width, height := outputDimensions(t, optimized)
+			if width != g.wantWidth || height != g.wantHeight {
+				t.Errorf("output is %dx%d, want %dx%d", width, height, g.wantWidth, g.wantHeight)
+			}
+			if g.minSSIM == 0 && g.minPSNR == 0 {
+				return
+			}
+			reference := source
+			if g.reference != "" {
+				reference, err = os.ReadFile(filepath.Join("testdata", g.reference))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, _, err := image.Decode(bytes.NewReader(reference))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want = resample.Resize(want, int(width), int(height), resample.Lanczos3, false)
+			got, err := libwebp.Decode(optimized)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ssim, err := similarity.SSIM(want, got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			psnr, err := similarity.PSNR(want, got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ssim < g.minSSIM {
+				t.Errorf("SSIM %.4f is below %.4f", ssim, g.minSSIM)
+			}
+			if psnr < g.minPSNR {
+				t.Errorf("PSNR %.2fdB is below %.2fdB", psnr, g.minPSNR)
+			}
+			t.Logf("%dx%d %d -> %d bytes, SSIM %.4f, PSNR %.2fdB", width, height, len(source), len(optimized), ssim, psnr)
+		})
+	}
+}
+
+// outputDimensions also handles animated WebP, which image.DecodeConfig doesn't
+func outputDimensions(t *testing.T, data []byte) (int, int) {
+	if width, height := Dimensions(data); width != 0 {
+		return width, height
+	}
+	if len(data) < 30 || string(data[12:16]) != "VP8X" {
+		t.Fatalf("cannot read the dimensions of the output")
+	}
+	canvas := func(b []byte) int {
+		return int(binary.LittleEndian.Uint32(append(b[:3:3], 0))) + 1
+	}
+	return canvas(data[24:27]), canvas(data[27:30])
+}
+
+func TestMetadataPolicy(t *testing.T) {
+	source, err := os.ReadFile(filepath.Join("testdata", "exif-rotated.jpeg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		policy                    MetadataPolicy
+		wantICC                   bool
+		wantArtist, wantCopyright string
+	}{
+		{policy: "", wantICC: false},
+		{policy: MetadataStrip, wantICC: false},
+		{policy: MetadataKeepICC, wantICC: true},
+		{policy: MetadataKeepCopyright, wantICC: true, wantArtist: "Jane Doe", wantCopyright: "(c) Jane Doe"},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			o, err := NewOptimizer(Config{MetadataPolicy: tt.policy})
+			if err != nil {
+				t.Fatal(err)
+			}
+			optimized, _, _, err := o.Optimize(source, Options{Quality: 85})
+			if err != nil {
+				t.Fatal(err)
+			}
+			md := imagemeta.Read(optimized)
+			if (len(md.ICC) > 0) != tt.wantICC {
+				t.Errorf("ICC profile kept: %t, want %t", len(md.ICC) > 0, tt.wantICC)
+			}
+			if md.Artist != tt.wantArtist || md.Copyright != tt.wantCopyright {
+				t.Errorf("artist %q and copyright %q, want %q and %q", md.Artist, md.Copyright, tt.wantArtist, tt.wantCopyright)
+			}
+			// the pixels are already upright, and orientation and GPS tags must never leak
+			exif, _ := webp.GetMetadata(optimized, "EXIF")
+			if want := imagemeta.BuildExif(tt.wantArtist, tt.wantCopyright); !bytes.Equal(exif, want) {
+				t.Errorf("EXIF is %q, want %q", exif, want)
+			}
+		})
+	}
+	if _, err := NewOptimizer(Config{MetadataPolicy: "all"}); err == nil {
+		t.Error("expected an unknown policy to be rejected")
+	}
+}
+
+func TestColorProfiles(t *testing.T) {
+	tests := []struct {
+		file   string
+		cmyk   bool
+		isSRGB bool
+	}{
+		{file: "exif-rotated.jpeg", isSRGB: true},
+		{file: "display-p3.jpeg"},
+		{file: "video-001.cmyk.jpeg", cmyk: true},
+	}
+	for _, tt := range tests {
+		data, err := os.ReadFile(filepath.Join("testdata", tt.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := isCMYKJPEG(data); got != tt.cmyk {
+			t.Errorf("%s: isCMYKJPEG is %t, want %t", tt.file, got, tt.cmyk)
+		}
+		if tt.cmyk {
+			continue
+		}
+		profile, err := icc.Parse(imagemeta.Read(data).ICC)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.file, err)
+		}
+		if profile.IsSRGB() != tt.isSRGB {
+			t.Errorf("%s: IsSRGB is %t, want %t", tt.file, profile.IsSRGB(), tt.isSRGB)
+		}
+	}
+}
+
+func TestDecodeICO(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "favicon.ico"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := decodeICO(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, _, _, a := img.At(16, 16).RGBA(); r>>8 != 0xe0 || a != 0xffff {
+		t.Errorf("unexpected center pixel %v", img.At(16, 16))
+	}
+	if _, _, _, a := img.At(0, 0).RGBA(); a != 0 {
+		t.Errorf("expected a transparent corner, got %v", img.At(0, 0))
+	}
+}
+
+func TestSanitizeSVG(t *testing.T) {
+	dirty := `<?xml version="1.0"?>
+<!DOCTYPE svg [<!ENTITY x SYSTEM "file:///etc/passwd">]>
+<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" onload="alert(1)" width="10" height="10">
+  <script>alert(2)</script>
+  <style>@import url(https://evil.example/x.css);</style>
+  <foreignObject><iframe src="https://evil.example"></iframe></foreignObject>
+  <defs><linearGradient id="g"><stop offset="0" stop-color="red"/></linearGradient></defs>
+  <rect width="10" height="10" fill="url(#g)" style="background:url('https://evil.example/track.png')"/>
+  <image xlink:href="https://evil.example/pixel.png" width="1" height="1"/>
+  <use href="#g"/>
+  <a href="javascript:alert(3)"><text onclick="alert(4)">hi &amp; bye</text></a>
+  <a href="#g"><set attributeName="href" to="javascript:alert(5)"/></a>
+  <a href="#g"><animate attributeName="href" values="#g;javascript:alert(6)"/></a>
+  <animateMotion dur="1s" path="M0,0"><mpath href="#g"/></animateMotion>
+  <animateTransform attributeName="transform" type="rotate" from="0" to="javascript:alert(7)"/>
+  <animateTransform attributeName="transform" type="scale" by="data:text/html,x" dur="1s"/>
+  <animateTransform attributeName="transform" type="rotate" from="0" to="90" dur="1s"/>
+</svg>`
+	clean, err := SanitizeSVG([]byte(dirty))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, forbidden := range []string{"alert", "evil.example", "script", "foreignObject", "ENTITY", "passwd",
+		"<set", "<animate ", "animateMotion", "javascript", "data:"} {
+		if bytes.Contains(clean, []byte(forbidden)) {
+			t.Errorf("%q survived sanitization:\n%s", forbidden, clean)
+		}
+	}
+	for _, kept := range []string{`fill="url(#g)"`, `<use href="#g">`, `xmlns:xlink=`, "hi &amp; bye", `stop-color="red"`, `from="0" to="90"`} {
+		if !bytes.Contains(clean, []byte(kept)) {
+			t.Errorf("%q was removed:\n%s", kept, clean)
+		}
+	}
+	if _, err := SanitizeSVG([]byte("<svg><rect></svg>")); err == nil {
+		t.Error("expected malformed svg to be rejected")
+	}
+}
+
+func TestFilters(t *testing.T) {
+	// a hard vertical edge between two colors
+	src := image.NewNRGBA(image.Rect(0, 0, 16, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 16; x++ {
+			c := color.NRGBA{R: 200, G: 40, B: 40, A: 255}
+			if x >= 8 {
+				c = color.NRGBA{R: 40, G: 40, B: 200, A: 255}
+			}
+			src.SetNRGBA(x, y, c)
+		}
+	}
+	at := func(img image.Image, x int) color.RGBA {
+		return color.RGBAModel.Convert(img.At(x, 4)).(color.RGBA)
+	}
+	if got := at(Filters{Grayscale: true}.apply(src), 0); got.R != got.G || got.G != got.B {
+		t.Errorf("grayscale left %v", got)
+	}
+	if got := at(Filters{Brightness: 100}.apply(src), 0); got != (color.RGBA{255, 255, 255, 255}) {
+		t.Errorf("full brightness gave %v", got)
+	}
+	if got := at(Filters{Contrast: -100}.apply(src), 15); got != (color.RGBA{128, 128, 128, 255}) {
+		t.Errorf("no contrast gave %v", got)
+	}
+	blurred := Filters{Blur: 2}.apply(src)
+	if left, right := at(blurred, 7), at(blurred, 8); left.R >= 200 || right.R <= 40 {
+		t.Errorf("blur kept the edge: %v %v", left, right)
+	}
+	if far := at(blurred, 0); far.R < 195 {
+		t.Errorf("blur reached too far: %v", far)
+	}
+	sharpened := Filters{Sharpen: 1}.apply(src)
+	if left, right := at(sharpened, 7), at(sharpened, 8); left.R <= 200 || right.B <= 200 {
+		t.Errorf("sharpen didn't increase the edge contrast: %v %v", left, right)
+	}
+	// wide blurs run on a downscaled copy, which comes out close to blurring at full size
+	wide := image.NewRGBA(image.Rect(0, 0, 240, 120))
+	for y := 0; y < 120; y++ {
+		for x := 0; x < 240; x++ {
+			wide.SetRGBA(x, y, color.RGBA{R: uint8(x / 60 % 2 * 255), G: uint8(y * 2), B: 90, A: 255})
+		}
+	}
+	direct, scaled := gaussianBlur(wide, 20), blur(wide, 20)
+	for i := range direct.Pix {
+		if d := int(direct.Pix[i]) - int(scaled.Pix[i]); d > 8 || d < -8 {
+			t.Fatalf("downscaled blur is off by %d at %d,%d", d, i/4%240, i/4/240)
+		}
+	}
+
+	o, err := NewOptimizer(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	animated, err := os.ReadFile(filepath.Join("testdata", "animated.gif"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	still, _, _, err := o.Optimize(animated, Options{Quality: 85, Filters: Filters{Blur: 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := libwebp.Decode(still); err != nil {
+		t.Errorf("filtered gif should be a still webp: %s", err)
+	}
+	animated, err = os.ReadFile(filepath.Join("testdata", "animated.webp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := o.Optimize(animated, Options{Quality: 85, Filters: Filters{Blur: 3}}); err == nil {
+		t.Error("expected filters on an animated webp to fail rather than be skipped")
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	tests := []struct {
+		file                  string
+		wantWidth, wantHeight int
+		wantFrames            int
+		wantDuration          time.Duration
+		wantAlpha             bool
+		wantOrientation       int
+		// needsVips is set when the fixture can only be decoded with libvips
+		needsVips bool
+	}{
+		{file: "video-001.jpeg", wantWidth: 150, wantHeight: 103, wantFrames: 1, wantOrientation: 1},
+		{file: "exif-rotated.jpeg", wantWidth: 150, wantHeight: 103, wantFrames: 1, wantOrientation: 6},
+		{file: "alpha.png", wantWidth: 128, wantHeight: 96, wantFrames: 1, wantAlpha: true, wantOrientation: 1},
+		{file: "animated.gif", wantWidth: 64, wantHeight: 48, wantFrames: 3, wantDuration: 300 * time.Millisecond, wantOrientation: 1},
+		{file: "animated.webp", wantWidth: 64, wantHeight: 48, wantFrames: 3, wantDuration: 300 * time.Millisecond, wantOrientation: 1, needsVips: true},
+	}
+	o, err := NewOptimizer(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			frames, duration := animation(data, mimetype.Detect(data).String())
+			if frames != tt.wantFrames || duration != tt.wantDuration {
+				t.Errorf("got %d frames lasting %s, want %d lasting %s", frames, duration, tt.wantFrames, tt.wantDuration)
+			}
+			if tt.needsVips && !bimg.IsTypeSupported(bimg.WEBP) {
+				t.Skip("libvips is not available")
+			}
+			a, err := o.Analyze(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if a.Width != tt.wantWidth || a.Height != tt.wantHeight || a.HasAlpha != tt.wantAlpha || a.Orientation != tt.wantOrientation {
+				t.Errorf("unexpected analysis %+v", a)
+			}
+			if len(a.DominantColor) != 7 || len(a.AverageColor) != 7 || a.BlurHash == "" || a.ThumbHash == "" || a.LQIP == "" {
+				t.Errorf("missing colors or placeholders in %+v", a)
+			}
+		})
+	}
+}
+
+func TestChooseQuality(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "video-001.jpeg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var previous int64
+	for _, target := range []float64{0.9, 0.97, 0.995} {
+		o, err := NewOptimizer(Config{AutoQuality: AutoQualityConfig{TargetSSIM: target}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := Options{Quality: AutoQuality, Width: 100}
+		quality, err := o.ChooseQuality(data, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if quality < 40 || quality > 95 || quality < previous {
+			t.Errorf("target %.3f: got quality %d after %d", target, quality, previous)
+		}
+		previous = quality
+		img, _, err := o.prepare(NewSource(data), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if score, _ := encodedSSIM(img, quality, 4); quality < 95 && score < target {
+			t.Errorf("target %.3f: quality %d only reaches %.4f", target, quality, score)
+		}
+	}
+
+	o, err := NewOptimizer(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	animated, err := os.ReadFile(filepath.Join("testdata", "animated.gif"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quality, _ := o.ChooseQuality(animated, Options{Quality: AutoQuality}); quality != FallbackQuality {
+		t.Errorf("animations should get the fallback quality, got %d", quality)
+	}
+	if _, err := NewOptimizer(Config{AutoQuality: AutoQualityConfig{MinQuality: 90, MaxQuality: 50}}); err == nil {
+		t.Errorf("inverted bounds were accepted")
+	}
+}
+
+func TestSource(t *testing.T) {
+	o, err := NewOptimizer(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	photo, err := os.ReadFile(filepath.Join("testdata", "video-001.jpeg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a miss fingerprints, searches the quality and optimizes the same source, which is decoded and prepared once
+	src := NewSource(photo)
+	checksum, phash := o.FingerprintSource(src)
+	if wantChecksum, wantPHash := o.Fingerprint(photo); checksum != wantChecksum || phash != wantPHash {
+		t.Errorf("fingerprints differ: %s %s and %s %s", checksum, phash, wantChecksum, wantPHash)
+	}
+	if src.decodedImage() == nil {
+		t.Fatal("the full decode wasn't kept")
+	}
+	opts := Options{Quality: AutoQuality, Width: 100}
+	quality, err := o.ChooseQualitySource(src, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.Quality = quality
+	optimized, _, _, err := o.OptimizeSource(src, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(src.prepared) != 1 {
+		t.Errorf("prepared %d images", len(src.prepared))
+	}
+	want, _, _, err := o.Optimize(photo, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(optimized, want) {
+		t.Errorf("reusing the decode changed the output")
+	}
+}
+
+func TestKeepSmallerSource(t *testing.T) {
+	// a two color checkerboard, which PNG stores in a few bytes and lossy WebP struggles with
+	board := image.NewPaletted(image.Rect(0, 0, 64, 64), color.Palette{color.Black, color.White})
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			board.SetColorIndex(x, y, uint8((x/2+y/2)%2))
+		}
+	}
+	var buf bytes.Buffer
+	_ = png.Encode(&buf, board)
+	source := buf.Bytes()
+	// losslessly, WebP would beat the PNG
+	o, err := NewOptimizer(Config{WebP: WebPConfig{LossyGraphics: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _, mime, err := o.Optimize(source, Options{Quality: 85, KeepSmallerSource: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mime != "image/png" || !bytes.Equal(out, source) {
+		t.Errorf("expected the source back, got %s of %d bytes", mime, len(out))
+	}
+	out, _, mime, err = o.Optimize(source, Options{Quality: 85, Width: 32, KeepSmallerSource: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if width, height := Dimensions(out); mime != "image/png" || width != 32 || height != 32 {
+		t.Errorf("expected a 32x32 PNG, got %s of %dx%d", mime, width, height)
+	}
+	for name, opts := range map[string]Options{
+		"not asked":   {Quality: 85},
+		"with filter": {Quality: 85, KeepSmallerSource: true, Filters: Filters{Grayscale: true}},
+	} {
+		if _, _, mime, _ := o.Optimize(source, opts); mime != "image/webp" {
+			t.Errorf("%s: got %s", name, mime)
+		}
+	}
+}
+
+func TestEncoding(t *testing.T) {
+	photo, err := os.ReadFile(filepath.Join("testdata", "video-001.jpeg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, err := NewOptimizer(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	photoImg, _, err := o.prepare(NewSource(photo), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a few colors, then many colors in flat blocks like a screenshot's
+	palette := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	screenshot := image.NewNRGBA(image.Rect(0, 0, 128, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 128; x++ {
+			if x < 64 {
+				palette.Set(x, y, color.NRGBA{R: uint8(x / 16 * 60), G: uint8(y / 16 * 60), A: 255})
+			}
+			screenshot.Set(x, y, color.NRGBA{R: uint8(x / 8 * 16), G: uint8(y * 4), B: 90, A: 255})
+		}
+	}
+	tests := []struct {
+		name string
+		img  image.Image
+		want Encoding
+	}{
+		{"photo", photoImg, EncodingLossy},
+		{"palette", palette, EncodingLossless},
+		{"screenshot", screenshot, EncodingNearLossless},
+	}
+	for _, tt := range tests {
+		if got := o.encoding(tt.img, Options{}); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+		if got := o.encoding(tt.img, Options{Lossless: true}); got != EncodingLossless {
+			t.Errorf("%s: asked for lossless, got %s", tt.name, got)
+		}
+	}
+	lossy, err := NewOptimizer(Config{WebP: WebPConfig{LossyGraphics: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := lossy.encoding(palette, Options{}); got != EncodingLossy {
+		t.Errorf("graphics detection is off, got %s", got)
+	}
+
+	encoded, err := o.encodeWebP(palette, EncodingLossless, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := libwebp.Decode(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if psnr, _ := similarity.PSNR(palette, decoded); !math.IsInf(psnr, 1) {
+		t.Errorf("lossless output differs from the source, PSNR %.2f", psnr)
+	}
+	encoded, err = o.encodeWebP(screenshot, EncodingNearLossless, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err = libwebp.Decode(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ssim, _ := similarity.SSIM(screenshot, decoded); ssim < 0.99 {
+		t.Errorf("near-lossless output drifted to an SSIM of %.4f", ssim)
+	}
+	method := 7
+	for _, cfg := range []WebPConfig{{Method: &method}, {LosslessMethod: &method}, {AnimationMethod: &method}} {
+		if _, err := NewOptimizer(Config{WebP: cfg}); err == nil {
+			t.Errorf("method 7 was accepted in %+v", cfg)
+		}
+	}
+	// 0 is a setting of its own rather than the default
+	zero := 0
+	o, err = NewOptimizer(Config{WebP: WebPConfig{NearLossless: &zero, Method: &zero, AnimationMethod: &zero}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *o.webp.NearLossless != 0 || *o.webp.Method != 0 || *o.webp.AnimationMethod != 0 || *o.webp.LosslessMethod != 4 {
+		t.Errorf("unexpected settings %d, %d, %d and %d", *o.webp.NearLossless, *o.webp.Method, *o.webp.AnimationMethod, *o.webp.LosslessMethod)
+	}
+	// the fastest method gives up some compression
+	fast, err := o.encodeWebP(photoImg, EncodingLossy, 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slow, err := lossy.encodeWebP(photoImg, EncodingLossy, 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fast) <= len(slow) {
+		t.Errorf("method 0 encoded %d bytes, method 4 %d", len(fast), len(slow))
+	}
+}
+
+func TestPng(t *testing.T) {
+	if !bimg.IsTypeSupported(bimg.PNG) {
+		t.Skip("libvips is not available")
+	}
+	o, err := NewOptimizer(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	photo, err := os.ReadFile(filepath.Join("testdata", "video-001.jpeg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	animated, err := os.ReadFile(filepath.Join("testdata", "animated.gif"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	alpha, err := os.ReadFile(filepath.Join("testdata", "alpha.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		source   []byte
+		png      PngOptions
+		paletted bool
+		colors   int
+	}{
+		{"truecolor photo", photo, PngOptions{}, false, 0},
+		{"quantized photo", photo, PngOptions{Colors: 16, Dither: true}, true, 16},
+		{"rounded up palette", photo, PngOptions{Colors: 3}, true, 4},
+		{"first frame", animated, PngOptions{}, true, 256},
+		{"quantized alpha", alpha, PngOptions{Colors: 64, CompressionLevel: 1}, true, 256},
+	}
+	for _, tt := range tests {
+		out, _, mime, err := o.Optimize(tt.source, Options{Width: 64, Png: &tt.png})
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if mime != "image/png" {
+			t.Fatalf("%s: got %s", tt.name, mime)
+		}
+		img, err := png.Decode(bytes.NewReader(out))
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		p, paletted := img.(*image.Paletted)
+		if paletted != tt.paletted || paletted && len(p.Palette) > tt.colors {
+			t.Errorf("%s: decoded as %T", tt.name, img)
+		}
+		if img.Bounds().Dx() != 64 {
+			t.Errorf("%s: %d pixels wide", tt.name, img.Bounds().Dx())
+		}
+	}
+	if q, err := o.ChooseQuality(photo, Options{Png: &PngOptions{}}); err != nil || q != FallbackQuality {
+		t.Errorf("png output searched quality %d: %v", q, err)
+	}
+}
+
+func TestProcessors(t *testing.T) {
+	if _, err := NewOptimizer(Config{Processor: ProcessorConfig{Default: "imagemagick"}}); err == nil {
+		t.Error("unknown default processor was accepted")
+	}
+	if _, err := NewOptimizer(Config{Processor: ProcessorConfig{Formats: map[string]string{"png": "gd"}}}); err == nil {
+		t.Error("unknown format processor was accepted")
+	}
+	o, err := NewOptimizer(Config{Processor: ProcessorConfig{Formats: map[string]string{"jpeg": ProcessorVips}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := o.processor("image/jpeg").Name(); got != ProcessorVips {
+		t.Errorf("jpeg went to %s", got)
+	}
+	if got := o.processor("image/png").Name(); got != ProcessorGo {
+		t.Errorf("png went to %s", got)
+	}
+
+	// both backends turn the source upright before fitting it to the requested width
+	source, err := os.ReadFile(filepath.Join("testdata", "exif-rotated.jpeg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	md := imagemeta.Read(source)
+	loaded := map[string]image.Image{}
+	for name, processor := range processors {
+		img, err := processor.Load(source, "image/jpeg", md.Orientation, 150, 0, o.resize)
+		if err != nil {
+			// libvips may not be installed where the tests run
+			t.Logf("%s: %s", name, err)
+			continue
+		}
+		if img.Bounds().Dx() != 150 || img.Bounds().Dy() != 103 {
+			t.Errorf("%s: loaded as %v", name, img.Bounds())
+		}
+		loaded[name] = img
+	}
+	if loaded[ProcessorGo] == nil {
+		t.Fatal("the go processor failed")
+	}
+	if vips := loaded[ProcessorVips]; vips != nil {
+		if psnr, _ := similarity.PSNR(loaded[ProcessorGo], vips); psnr < 30 {
+			t.Errorf("the backends differ, PSNR %.2f", psnr)
+		}
+	}
+}
+
+func TestResizing(t *testing.T) {
+	if _, err := NewOptimizer(Config{Resize: ResizeConfig{Kernel: "box"}}); err == nil {
+		t.Error("unknown kernel was accepted")
+	}
+	o, err := NewOptimizer(Config{Resize: ResizeConfig{Kernel: KernelBilinear}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := o.resizing(Options{Kernel: KernelNearest, Linear: true}); r.Kernel != KernelNearest || !r.Linear {
+		t.Errorf("request settings ignored: %+v", r)
+	}
+	if r := o.resizing(Options{}); r.Kernel != KernelBilinear || r.Linear {
+		t.Errorf("configured settings ignored: %+v", r)
+	}
+	source, err := os.ReadFile(filepath.Join("testdata", "video-001.jpeg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for kernel := range kernels {
+		for _, linear := range []bool{false, true} {
+			optimized, _, _, err := o.Optimize(source, Options{Quality: 80, Width: 40, Kernel: kernel, Linear: linear})
+			if err != nil {
+				t.Fatalf("%s: %s", kernel, err)
+			}
+			if w, h := Dimensions(optimized); w != 40 || h != 28 {
+				t.Errorf("%s, linear %t: %dx%d", kernel, linear, w, h)
+			}
+		}
+	}
+
+	// shrinking on load is close to a full decode, upright and with a full decode fallback for CMYK
+	shrinking, err := NewOptimizer(Config{Resize: ResizeConfig{ShrinkOnLoad: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"video-001.jpeg", "video-001.progressive.jpeg", "video-001.cmyk.jpeg", "exif-rotated.jpeg"} {
+		source, err := os.ReadFile(filepath.Join("testdata", file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		md := imagemeta.Read(source)
+		r := shrinking.resizing(Options{})
+		shrunk, err := goProcessor{}.Load(source, "image/jpeg", md.Orientation, 6, 0, r)
+		if err != nil {
+			t.Fatalf("%s: %s", file, err)
+		}
+		r.ShrinkOnLoad = false
+		full, err := goProcessor{}.Load(source, "image/jpeg", md.Orientation, 6, 0, r)
+		if err != nil {
+			t.Fatalf("%s: %s", file, err)
+		}
+		if shrunk.Bounds() != full.Bounds() {
+			t.Errorf("%s: shrunk to %v instead of %v", file, shrunk.Bounds(), full.Bounds())
+			continue
+		}
+		if psnr, _ := similarity.PSNR(full, shrunk); psnr < 30 {
+			t.Errorf("%s: PSNR %.2f with the full decode", file, psnr)
+		}
+	}
+}
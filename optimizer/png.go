@@ -0,0 +1,101 @@
+package optimizer
+
+import (
+	"image"
+	"strings"
+
+	"github.com/OdyseeTeam/mirage/internal/metrics"
+	"github.com/OdyseeTeam/mirage/internal/vips"
+)
+
+// PngOptions are the settings of PNG output
+type PngOptions struct {
+	// Colors quantizes the output to a palette of that many colors, from 2 to 256, rounded up to the 2, 4, 16 or 256
+	// colors of the bit depths libvips writes palettes at. When 0, images with few enough colors get a palette of
+	// their own and the others are written as truecolor.
+	Colors int `mapstructure:"max_colors"`
+	// Dither spreads the quantization error over the neighbouring pixels
+	Dither bool `mapstructure:"dither"`
+	// CompressionLevel is the zlib level, from 1 (fastest) to 9 (smallest), 9 when 0
+	CompressionLevel int `mapstructure:"compression_level"`
+}
+
+// optimizePng encodes data, animations by their first frame, as a PNG. Quality doesn't apply.
+func (o *Optimizer) optimizePng(src *Source, opts Options) (optimized []byte, originalContentType, optimizedContentType string, err error) {
+	data, contentType := src.data, src.contentType
+	img, md, err := o.prepare(src, opts)
+	if err != nil {
+		return nil, contentType, "", err
+	}
+	// the output is sRGB, which needs no profile
+	encoderOptions := vips.PngOptions{Bitdepth: 8, Compression: opts.Png.CompressionLevel}
+	if encoderOptions.Compression == 0 {
+		encoderOptions.Compression = 9
+	}
+	kind := "truecolor"
+	if opts.Png.Colors > 0 {
+		encoderOptions.Palette, encoderOptions.Bitdepth, encoderOptions.Quality = true, paletteBitdepth(opts.Png.Colors), 100
+		if opts.Png.Dither {
+			encoderOptions.Dither = 1
+		}
+		kind = "quantized"
+	} else if colors := countColors(img, graphicsMaxColors); colors <= graphicsMaxColors {
+		// libimagequant keeps the colors as they are when they all fit in the palette
+		encoderOptions.Palette, encoderOptions.Bitdepth, encoderOptions.Quality = true, paletteBitdepth(colors), 100
+		kind = "palette"
+	}
+	if o.metadataPolicy == MetadataKeepCopyright {
+		if md.Artist != "" {
+			encoderOptions.Text = append(encoderOptions.Text, vips.Text{Keyword: "Author", Value: md.Artist})
+		}
+		if md.Copyright != "" {
+			encoderOptions.Text = append(encoderOptions.Text, vips.Text{Keyword: "Copyright", Value: md.Copyright})
+		}
+	}
+	encoded, err := vips.PngSave(img, encoderOptions)
+	if err != nil {
+		return nil, contentType, "", err
+	}
+	metrics.PngEncodings.WithLabelValues(kind).Inc()
+	// only PNG sources can stand in for PNG output
+	if opts.KeepSmallerSource && strings.Contains(contentType, "png") {
+		if kept := smallerSource(data, contentType, img, opts, len(encoded)); kept != nil {
+			return kept, contentType, contentType, nil
+		}
+	}
+	return encoded, contentType, "image/png", nil
+}
+
+// PaletteSize is the number of colors of the smallest palette libvips writes that holds colors: 2, 4, 16 or 256
+func PaletteSize(colors int) int {
+	return 1 << paletteBitdepth(colors)
+}
+
+// paletteBitdepth is the PNG bit depth of a palette of colors
+func paletteBitdepth(colors int) int {
+	switch {
+	case colors <= 2:
+		return 1
+	case colors <= 4:
+		return 2
+	case colors <= 16:
+		return 4
+	}
+	return 8
+}
+
+// countColors returns the number of colors of img, or limit+1 once it has more than limit
+func countColors(img image.Image, limit int) int {
+	b := img.Bounds()
+	colors := make(map[uint32]struct{}, limit+1)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, a := img.At(x, y).RGBA()
+			colors[r>>8<<24|g>>8<<16|bl>>8<<8|a>>8] = struct{}{}
+			if len(colors) > limit {
+				return len(colors)
+			}
+		}
+	}
+	return len(colors)
+}
@@ -0,0 +1,171 @@
+package optimizer
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"strings"
+	"time"
+
+	"github.com/OdyseeTeam/mirage/internal/imagemeta"
+	"github.com/OdyseeTeam/mirage/internal/metrics"
+
+	"github.com/h2non/bimg"
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// Processor is a backend decoding and resizing still sources, which is where most of the time of an optimization
+// goes. Encoding, color management and filters are the same whatever the backend.
+type Processor interface {
+	Name() string
+	// Load decodes a still source, or the first frame of an animation, turns it upright according to the EXIF
+	// orientation and resizes it to width and height as r says, a zero keeping the aspect ratio. The pixels stay in
+	// the color space of the source.
+	Load(data []byte, contentType string, orientation int, width, height int64, r ResizeConfig) (image.Image, error)
+}
+
+const (
+	// ProcessorGo decodes with the image packages and resizes with internal/resample, falling back to libvips for
+	// the formats Go can't decode
+	ProcessorGo = "go"
+	// ProcessorVips does both with libvips, which shrinks JPEGs and WebPs while decoding them. It downscales with
+	// Lanczos whatever the kernel, which only applies to upscaling, and leaves linear light resizing to the Go one.
+	ProcessorVips = "vips"
+)
+
+var processors = map[string]Processor{
+	ProcessorGo:   goProcessor{},
+	ProcessorVips: vipsProcessor{},
+}
+
+// ProcessorConfig picks the backend of each source format, the zero value uses the Go one for everything
+type ProcessorConfig struct {
+	// Default is ProcessorGo or ProcessorVips
+	Default string `mapstructure:"default"`
+	// Formats overrides the default per source format, keyed by the subtype of the content type, e.g. "jpeg" or "png"
+	Formats map[string]string `mapstructure:"formats"`
+}
+
+func (c ProcessorConfig) withDefaults() (ProcessorConfig, error) {
+	if c.Default == "" {
+		c.Default = ProcessorGo
+	}
+	if _, ok := processors[c.Default]; !ok {
+		return c, errors.Err("unknown processor %q", c.Default)
+	}
+	for format, name := range c.Formats {
+		if _, ok := processors[name]; !ok {
+			return c, errors.Err("unknown processor %q for %s", name, format)
+		}
+	}
+	return c, nil
+}
+
+// processor returns the backend configured for contentType
+func (o *Optimizer) processor(contentType string) Processor {
+	subtype := strings.TrimPrefix(contentType, "image/")
+	if name, ok := o.processors.Formats[subtype]; ok {
+		return processors[name]
+	}
+	return processors[o.processors.Default]
+}
+
+// load decodes a still source upright and at the output size. SVGs are rendered at that size by libvips whatever
+// the backend.
+func (o *Optimizer) load(src *Source, orientation int, opts Options) (image.Image, error) {
+	data, contentType := src.data, src.contentType
+	if strings.Contains(contentType, "svg") {
+		img, err := rasterizeSVG(data, opts.Width, opts.Height)
+		if err != nil {
+			return nil, err
+		}
+		return resizeImage(img, opts.Width, opts.Height, o.resizing(opts)), nil
+	}
+	processor := o.processor(contentType)
+	// the go processor would decode the source in full again
+	if raw := src.decodedImage(); raw != nil && processor.Name() == ProcessorGo {
+		return resizeImage(imagemeta.Orient(raw, orientation), opts.Width, opts.Height, o.resizing(opts)), nil
+	}
+	start := time.Now()
+	img, err := processor.Load(data, contentType, orientation, opts.Width, opts.Height, o.resizing(opts))
+	if err != nil {
+		return nil, err
+	}
+	metrics.ProcessorDuration.WithLabelValues(processor.Name()).Observe(time.Since(start).Seconds())
+	return img, nil
+}
+
+type goProcessor struct{}
+
+func (goProcessor) Name() string {
+	return ProcessorGo
+}
+
+func (goProcessor) Load(data []byte, contentType string, orientation int, width, height int64, r ResizeConfig) (image.Image, error) {
+	if img := shrinkOnLoad(data, contentType, orientation, width, height, r); img != nil {
+		return resizeImage(imagemeta.Orient(img, orientation), width, height, r), nil
+	}
+	frames := 1
+	if strings.Contains(contentType, "webp") {
+		frames, _ = webpAnimation(data)
+	}
+	img, err := decodeFirstFrame(data, contentType, frames)
+	if err != nil {
+		return nil, err
+	}
+	img = imagemeta.Orient(img, orientation)
+	return resizeImage(img, width, height, r), nil
+}
+
+type vipsProcessor struct{}
+
+// vipsInterpolators are the closest libvips interpolators to the kernels, bicubic standing in for Catmull-Rom and
+// Lanczos
+var vipsInterpolators = map[Kernel]bimg.Interpolator{
+	KernelNearest:    bimg.Nearest,
+	KernelBilinear:   bimg.Bilinear,
+	KernelCatmullRom: bimg.Bicubic,
+	KernelLanczos:    bimg.Bicubic,
+}
+
+func (vipsProcessor) Name() string {
+	return ProcessorVips
+}
+
+func (vipsProcessor) Load(data []byte, contentType string, orientation int, width, height int64, r ResizeConfig) (image.Image, error) {
+	if r.Linear && !vipsOnly(contentType) {
+		return goProcessor{}.Load(data, contentType, orientation, width, height, r)
+	}
+	opts := bimg.Options{
+		Type:          bimg.PNG,
+		Compression:   1,
+		Enlarge:       true,
+		StripMetadata: true,
+		Interpolator:  vipsInterpolators[r.Kernel],
+	}
+	decodedByVips := vipsOnly(contentType)
+	if decodedByVips {
+		// as in decodeWithVips, only libvips knows the profile and the orientation of these
+		opts.OutputICC = "srgb"
+	} else {
+		// the smaller image is turned upright after resizing, so the requested size is the sideways one
+		opts.NoAutoRotate = true
+		if orientation >= 5 {
+			width, height = height, width
+		}
+	}
+	opts.Width, opts.Height = int(width), int(height)
+	opts.Force = width > 0 && height > 0
+	converted, err := bimg.NewImage(data).Process(opts)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	img, err := png.Decode(bytes.NewReader(converted))
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	if decodedByVips {
+		return img, nil
+	}
+	return imagemeta.Orient(img, orientation), nil
+}
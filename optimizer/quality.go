@@ -0,0 +1,129 @@
+package optimizer
+
+import (
+	"image"
+	"strconv"
+	"strings"
+
+	"github.com/OdyseeTeam/mirage/internal/libwebp"
+	"github.com/OdyseeTeam/mirage/internal/metrics"
+	"github.com/OdyseeTeam/mirage/internal/similarity"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// FallbackQuality is what AutoQuality means for the sources that can't be searched, e.g. animations
+const FallbackQuality int64 = 85
+
+// ParseQuality parses a quality as given in urls and on the command line, a number from 1 to 100 or "auto"
+func ParseQuality(s string) (int64, error) {
+	if s == "auto" {
+		return AutoQuality, nil
+	}
+	quality, err := strconv.ParseInt(s, 10, 32)
+	if err != nil || quality < 1 || quality > 100 {
+		return 0, errors.Err("quality should be a number between 1 and 100 or auto, got %q", s)
+	}
+	return quality, nil
+}
+
+// AutoQualityConfig tunes the search behind AutoQuality, the zero value uses the defaults
+type AutoQualityConfig struct {
+	// TargetSSIM is how similar to the resized source the output must be, 0.98 by default
+	TargetSSIM float64 `mapstructure:"target_ssim"`
+	// MinQuality and MaxQuality bound the search, 40 and 95 by default
+	MinQuality int64 `mapstructure:"min_quality"`
+	MaxQuality int64 `mapstructure:"max_quality"`
+	// MaxIterations bounds how many times the image is encoded, 6 by default
+	MaxIterations int `mapstructure:"max_iterations"`
+}
+
+func (c AutoQualityConfig) withDefaults() (AutoQualityConfig, error) {
+	if c.TargetSSIM == 0 {
+		c.TargetSSIM = 0.98
+	}
+	if c.MinQuality == 0 {
+		c.MinQuality = 40
+	}
+	if c.MaxQuality == 0 {
+		c.MaxQuality = 95
+	}
+	if c.MaxIterations == 0 {
+		c.MaxIterations = 6
+	}
+	if c.TargetSSIM < 0 || c.TargetSSIM > 1 {
+		return c, errors.Err("auto quality target ssim must be between 0 and 1")
+	}
+	if c.MinQuality < 1 || c.MaxQuality > 100 || c.MinQuality > c.MaxQuality {
+		return c, errors.Err("auto quality bounds must be within 1 and 100, the minimum first")
+	}
+	return c, nil
+}
+
+// ChooseQuality returns the quality Optimize uses for AutoQuality: the lowest one reaching the target similarity,
+// or the maximum when none does. Sources that are passed through, converted as a whole or encoded losslessly, PNG
+// output included, get FallbackQuality, and so does AVIF output which the WebP based search doesn't apply to.
+func (o *Optimizer) ChooseQuality(data []byte, opts Options) (int64, error) {
+	return o.ChooseQualitySource(NewSource(data), opts)
+}
+
+// ChooseQualitySource is ChooseQuality keeping the prepared image in src for OptimizeSource
+func (o *Optimizer) ChooseQualitySource(src *Source, opts Options) (int64, error) {
+	if opts.Png != nil || opts.Avif {
+		return FallbackQuality, nil
+	}
+	data, contentType := src.data, src.contentType
+	filtered := !opts.Filters.IsZero()
+	if strings.Contains(contentType, "gif") && !filtered ||
+		strings.Contains(contentType, "svg") && !opts.RasterizeSVG && !filtered {
+		return FallbackQuality, nil
+	}
+	if strings.Contains(contentType, "webp") {
+		if frames, _ := animation(data, contentType); frames > 1 {
+			return FallbackQuality, nil
+		}
+	}
+	img, _, err := o.prepare(src, opts)
+	if err != nil {
+		return 0, err
+	}
+	// lossless encodings have no quality to search
+	if o.encoding(img, opts) != EncodingLossy {
+		return FallbackQuality, nil
+	}
+	return o.searchQuality(img)
+}
+
+// searchQuality binary searches the qualities allowed for the lowest one whose output reaches the target SSIM
+func (o *Optimizer) searchQuality(img image.Image) (int64, error) {
+	low, high := o.autoQuality.MinQuality, o.autoQuality.MaxQuality
+	chosen := high
+	for i := 0; i < o.autoQuality.MaxIterations && low <= high; i++ {
+		quality := (low + high) / 2
+		score, err := encodedSSIM(img, quality, *o.webp.Method)
+		if err != nil {
+			return 0, err
+		}
+		if score >= o.autoQuality.TargetSSIM {
+			chosen = quality
+			high = quality - 1
+		} else {
+			low = quality + 1
+		}
+	}
+	metrics.AutoQuality.Observe(float64(chosen))
+	return chosen, nil
+}
+
+// encodedSSIM encodes img as a lossy WebP of the given quality and method and compares the result with img
+func encodedSSIM(img image.Image, quality int64, method int) (float64, error) {
+	encoded, err := libwebp.Encode(img, libwebp.Options{Quality: float32(quality), Method: method})
+	if err != nil {
+		return 0, err
+	}
+	decoded, err := libwebp.Decode(encoded)
+	if err != nil {
+		return 0, err
+	}
+	return similarity.SSIM(img, decoded)
+}
@@ -0,0 +1,116 @@
+package optimizer
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"strings"
+
+	"github.com/OdyseeTeam/mirage/internal/resample"
+	"github.com/OdyseeTeam/mirage/internal/vips"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Kernel is the resampling filter images are resized with
+type Kernel string
+
+const (
+	KernelNearest    Kernel = "nearest"
+	KernelBilinear   Kernel = "bilinear"
+	KernelCatmullRom Kernel = "catmullrom"
+	// KernelLanczos is the default, the sharpest of them
+	KernelLanczos Kernel = "lanczos"
+)
+
+var kernels = map[Kernel]resample.Filter{
+	KernelNearest:    resample.Nearest,
+	KernelBilinear:   resample.Bilinear,
+	KernelCatmullRom: resample.CatmullRom,
+	KernelLanczos:    resample.Lanczos3,
+}
+
+// ParseKernel returns the kernel called name
+func ParseKernel(name string) (Kernel, error) {
+	if _, ok := kernels[Kernel(name)]; !ok {
+		return "", errors.Err("unknown resampling kernel %q", name)
+	}
+	return Kernel(name), nil
+}
+
+// shrinkOnLoadFactor is the downscale factor from which JPEGs are decoded at 1/8 of their size. The decoded image is
+// then still at least twice the output size, which the kernel brings down without aliasing.
+const shrinkOnLoadFactor = 16
+
+// ResizeConfig is how images are resized, the zero value resizes with Lanczos in gamma-encoded sRGB
+type ResizeConfig struct {
+	// Kernel is the default resampling filter, KernelLanczos when empty
+	Kernel Kernel `mapstructure:"kernel"`
+	// Linear resizes in linear light, which keeps the brightness of fine high-contrast detail when downscaling
+	Linear bool `mapstructure:"linear"`
+	// ShrinkOnLoad decodes JPEGs at 1/8 of their size with the shrink-on-load of libvips when they're downscaled by
+	// 16 or more, which is much faster and barely different. The vips processor does it on its own.
+	ShrinkOnLoad bool `mapstructure:"shrink_on_load"`
+}
+
+func (c ResizeConfig) withDefaults() (ResizeConfig, error) {
+	if c.Kernel == "" {
+		c.Kernel = KernelLanczos
+	}
+	if _, err := ParseKernel(string(c.Kernel)); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+// resizing returns the resize settings of a request, the options overriding the configuration
+func (o *Optimizer) resizing(opts Options) ResizeConfig {
+	r := o.resize
+	if opts.Kernel != "" {
+		r.Kernel = opts.Kernel
+	}
+	r.Linear = r.Linear || opts.Linear
+	return r
+}
+
+// resizeImage resizes img to width and height, a zero keeping the aspect ratio
+func resizeImage(img image.Image, width, height int64, r ResizeConfig) image.Image {
+	filter, ok := kernels[r.Kernel]
+	if !ok {
+		filter = resample.Lanczos3
+	}
+	return resample.Resize(img, int(width), int(height), filter, r.Linear)
+}
+
+// shrinkOnLoad decodes a JPEG at 1/8 of its size when it's downscaled enough to width and height, the upright
+// output size. It returns nil when the source is to be decoded in full.
+func shrinkOnLoad(data []byte, contentType string, orientation int, width, height int64, r ResizeConfig) image.Image {
+	if !r.ShrinkOnLoad || !strings.Contains(contentType, "jpeg") || width == 0 && height == 0 {
+		return nil
+	}
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+	if orientation >= 5 {
+		width, height = height, width
+	}
+	// with both sizes given, the image is stretched and the smaller factor is the one that counts
+	factor := int64(shrinkOnLoadFactor)
+	if width > 0 {
+		factor = min(factor, int64(cfg.Width)/width)
+	}
+	if height > 0 {
+		factor = min(factor, int64(cfg.Height)/height)
+	}
+	if factor < shrinkOnLoadFactor {
+		return nil
+	}
+	img, err := vips.JpegShrink(data, 8)
+	if err != nil {
+		log.Debugf("decoding the jpeg in full: %s", err)
+		return nil
+	}
+	return img
+}
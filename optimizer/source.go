@@ -0,0 +1,70 @@
+package optimizer
+
+import (
+	"image"
+
+	"github.com/OdyseeTeam/mirage/internal/imagemeta"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+// Source is a source image to fingerprint, choose the quality of and optimize. It keeps what was decoded from it so
+// that a request decodes it once: the full decode fingerprinting needs, which the go processor then resizes instead
+// of decoding again, and the image prepared for each output size and filters. A Source isn't safe for concurrent use.
+type Source struct {
+	data        []byte
+	contentType string
+	raw         image.Image
+	rawErr      error
+	rawDecoded  bool
+	prepared    map[prepareKey]preparedImage
+}
+
+// prepareKey is what the image prepared from a source depends on
+type prepareKey struct {
+	width, height int64
+	filters       Filters
+	resize        ResizeConfig
+}
+
+type preparedImage struct {
+	img image.Image
+	md  imagemeta.Metadata
+	err error
+}
+
+// NewSource wraps the bytes of a source image
+func NewSource(data []byte) *Source {
+	return &Source{
+		data:        data,
+		contentType: mimetype.Detect(data).String(),
+		prepared:    make(map[prepareKey]preparedImage),
+	}
+}
+
+// Data returns the bytes of the source
+func (s *Source) Data() []byte {
+	return s.data
+}
+
+// ContentType returns the content type detected from the bytes of the source
+func (s *Source) ContentType() string {
+	return s.contentType
+}
+
+// rawImage decodes the source in full as it is stored, animations by their first frame, on the first call
+func (s *Source) rawImage() (image.Image, error) {
+	if !s.rawDecoded {
+		s.raw, s.rawErr = readRawImage(s.data, s.contentType, 16383*16383)
+		s.rawDecoded = true
+	}
+	return s.raw, s.rawErr
+}
+
+// decodedImage returns the full decode of the source if it was done already, nil otherwise
+func (s *Source) decodedImage() image.Image {
+	if !s.rawDecoded {
+		return nil
+	}
+	return s.raw
+}
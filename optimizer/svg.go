@@ -0,0 +1,165 @@
+package optimizer
+
+import (
+	"bytes"
+	"encoding/xml"
+	"image"
+	"image/png"
+	"io"
+	"strings"
+
+	"github.com/h2non/bimg"
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// rasterizeSVG renders an SVG with libvips, at the requested size when there is one
+func rasterizeSVG(data []byte, width, height int64) (image.Image, error) {
+	rendered, err := bimg.NewImage(data).Process(bimg.Options{
+		Type:          bimg.PNG,
+		Width:         int(width),
+		Height:        int(height),
+		StripMetadata: true,
+	})
+	if err != nil {
+		return nil, errors.Err("could not rasterize svg: %s", err)
+	}
+	return png.Decode(bytes.NewReader(rendered))
+}
+
+// droppedSVGElements are removed along with everything they contain. Animations go too, since they can set any
+// attribute, href included, to a value no attribute check sees.
+var droppedSVGElements = map[string]bool{
+	"script":        true,
+	"foreignobject": true,
+	"iframe":        true,
+	"embed":         true,
+	"object":        true,
+	"set":           true,
+	"animate":       true,
+	"animatemotion": true,
+}
+
+// SanitizeSVG removes what an SVG could use to run code or load anything when opened on its own: scripts, event
+// handlers, foreignObject and references to anything outside the document
+func SanitizeSVG(data []byte) ([]byte, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.Strict = false
+	var out bytes.Buffer
+	// depth of the dropped element being skipped, 0 when not skipping
+	skipping := 0
+	inStyle := false
+	// RawToken doesn't check that elements are balanced
+	var open []xml.Name
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			if len(open) > 0 {
+				return nil, errors.Err("malformed svg: unclosed <%s>", qualifiedName(open[len(open)-1]))
+			}
+			break
+		}
+		if err != nil {
+			return nil, errors.Err("malformed svg: %s", err)
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			open = append(open, t.Name)
+			if skipping > 0 {
+				skipping++
+				continue
+			}
+			if droppedSVGElements[strings.ToLower(t.Name.Local)] {
+				skipping = 1
+				continue
+			}
+			inStyle = strings.EqualFold(t.Name.Local, "style")
+			out.WriteString("<" + qualifiedName(t.Name))
+			for _, attr := range t.Attr {
+				if !safeSVGAttribute(attr) {
+					continue
+				}
+				out.WriteString(" " + qualifiedName(attr.Name) + `="`)
+				_ = xml.EscapeText(&out, []byte(attr.Value))
+				out.WriteString(`"`)
+			}
+			out.WriteString(">")
+		case xml.EndElement:
+			if len(open) == 0 || open[len(open)-1] != t.Name {
+				return nil, errors.Err("malformed svg: unexpected </%s>", qualifiedName(t.Name))
+			}
+			open = open[:len(open)-1]
+			if skipping > 0 {
+				skipping--
+				continue
+			}
+			inStyle = false
+			out.WriteString("</" + qualifiedName(t.Name) + ">")
+		case xml.CharData:
+			if skipping > 0 {
+				continue
+			}
+			if inStyle && (hasExternalURL(string(t)) || strings.Contains(strings.ToLower(string(t)), "@import")) {
+				continue
+			}
+			_ = xml.EscapeText(&out, t)
+		case xml.ProcInst:
+			if skipping == 0 && t.Target == "xml" {
+				out.WriteString("<?xml " + string(t.Inst) + "?>")
+			}
+		}
+		// comments and directives (DOCTYPE and its entities) are dropped
+	}
+	return out.Bytes(), nil
+}
+
+func qualifiedName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
+
+func safeSVGAttribute(attr xml.Attr) bool {
+	name := strings.ToLower(attr.Name.Local)
+	if strings.HasPrefix(name, "on") {
+		return false
+	}
+	value := strings.TrimSpace(attr.Value)
+	switch name {
+	case "href", "src":
+		// only fragments within the document
+		return strings.HasPrefix(value, "#")
+	case "to", "from", "values", "by":
+		if hasScriptURL(value) {
+			return false
+		}
+	}
+	return !hasExternalURL(value)
+}
+
+// hasScriptURL reports whether a value holds a javascript: or data: url, whitespace and control characters within
+// the scheme being ignored like browsers do
+func hasScriptURL(s string) bool {
+	compact := strings.Map(func(r rune) rune {
+		if r <= ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(s))
+	return strings.Contains(compact, "javascript:") || strings.Contains(compact, "data:")
+}
+
+// hasExternalURL reports whether a style value references anything but a fragment with url()
+func hasExternalURL(s string) bool {
+	lower := strings.ToLower(s)
+	for {
+		i := strings.Index(lower, "url(")
+		if i < 0 {
+			return false
+		}
+		lower = strings.TrimLeft(lower[i+len("url("):], " \t\n\r'\"")
+		if !strings.HasPrefix(lower, "#") {
+			return true
+		}
+	}
+}
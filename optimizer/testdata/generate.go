@@ -0,0 +1,409 @@
+//go:build ignore
+
+// generate writes the fixtures used by the optimizer tests. Photographic sources come from the Go distribution's
+// image/testdata, the rest is drawn here so that every fixture can be recreated with:
+//
+//	go run ./optimizer/testdata/generate.go
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/chai2010/webp"
+	giftowebp "github.com/sizeofint/gif-to-webp"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+)
+
+var out = "optimizer/testdata"
+
+func main() {
+	goTestdata := filepath.Join(runtime.GOROOT(), "src", "image", "testdata")
+	for _, name := range []string{"video-001.jpeg", "video-001.progressive.jpeg", "video-001.cmyk.jpeg", "video-001.png"} {
+		data, err := os.ReadFile(filepath.Join(goTestdata, name))
+		check(err)
+		write(name, data)
+	}
+	photo, err := png.Decode(bytes.NewReader(read("video-001.png")))
+	check(err)
+
+	var buf bytes.Buffer
+	check(png.Encode(&buf, alphaGradient()))
+	write("alpha.png", buf.Bytes())
+
+	buf.Reset()
+	check(png.Encode(&buf, deepGradient()))
+	write("16bit.png", buf.Bytes())
+
+	buf.Reset()
+	check(bmp.Encode(&buf, photo))
+	write("video-001.bmp", buf.Bytes())
+
+	write("video-001.psd", encodePSD(photo))
+
+	buf.Reset()
+	check(tiff.Encode(&buf, photo, &tiff.Options{Compression: tiff.Deflate}))
+	write("video-001.tiff", buf.Bytes())
+
+	write("favicon.ico", encodeICO())
+
+	buf.Reset()
+	check(webp.Encode(&buf, photo, &webp.Options{Quality: 90}))
+	write("video-001.webp", buf.Bytes())
+
+	buf.Reset()
+	check(gif.EncodeAll(&buf, animation()))
+	write("animated.gif", buf.Bytes())
+
+	animated, err := giftowebp.NewConverter().Convert(buf.Bytes())
+	check(err)
+	write("animated.webp", animated)
+
+	write("drawing.svg", []byte(`<svg xmlns="http://www.w3.org/2000/svg" width="120" height="80" viewBox="0 0 120 80">
+  <rect width="120" height="80" fill="#2a9d8f"/>
+  <circle cx="60" cy="40" r="30" fill="#e9c46a"/>
+</svg>
+`))
+
+	buf.Reset()
+	check(jpeg.Encode(&buf, rotateCounterClockwise(photo), &jpeg.Options{Quality: 90}))
+	write("exif-rotated.jpeg", withMetadata(buf.Bytes(), exifBlob(), iccProfile(srgbPrimaries)))
+
+	buf.Reset()
+	check(jpeg.Encode(&buf, toDisplayP3(photo), &jpeg.Options{Quality: 95}))
+	write("display-p3.jpeg", withMetadata(buf.Bytes(), nil, iccProfile(displayP3Primaries)))
+
+	jpg := read("video-001.jpeg")
+	write("truncated.jpeg", jpg[:len(jpg)/3])
+	write("garbage.png", append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0xde, 0xad, 0xbe, 0xef}, 64)...))
+}
+
+// alphaGradient is opaque on the left edge and fully transparent on the right one
+func alphaGradient() image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, 128, 96))
+	for y := 0; y < 96; y++ {
+		for x := 0; x < 128; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(x * 2), G: uint8(y * 2), B: 200, A: uint8(255 - x*2)})
+		}
+	}
+	return img
+}
+
+// deepGradient uses the full 16 bit range, which an 8 bit round trip can only approximate
+func deepGradient() image.Image {
+	img := image.NewRGBA64(image.Rect(0, 0, 160, 120))
+	for y := 0; y < 120; y++ {
+		for x := 0; x < 160; x++ {
+			img.SetRGBA64(x, y, color.RGBA64{R: uint16(x * 409), G: uint16(y * 546), B: uint16((x + y) * 234), A: 0xffff})
+		}
+	}
+	return img
+}
+
+// animation is a square moving across three frames
+func animation() *gif.GIF {
+	anim := &gif.GIF{}
+	for i := 0; i < 3; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 64, 48), palette.WebSafe)
+		for y := 0; y < 48; y++ {
+			for x := 0; x < 64; x++ {
+				c := color.RGBA{R: 255, G: 255, B: 255, A: 255}
+				if x >= 8+i*16 && x < 24+i*16 && y >= 16 && y < 32 {
+					c = color.RGBA{R: 204, A: 255}
+				}
+				frame.Set(x, y, c)
+			}
+		}
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 10)
+	}
+	return anim
+}
+
+// rotateCounterClockwise stores img the way a camera held sideways would, EXIF orientation 6 brings it back upright
+func rotateCounterClockwise(img image.Image) image.Image {
+	b := img.Bounds()
+	out := image.NewRGBA(image.Rect(0, 0, b.Dy(), b.Dx()))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			out.Set(y, b.Dx()-1-x, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return out
+}
+
+// exifBlob is a big endian EXIF with orientation 6, artist, copyright and a GPS position
+func exifBlob() []byte {
+	var buf bytes.Buffer
+	be := func(v interface{}) { check(binary.Write(&buf, binary.BigEndian, v)) }
+	artist, copyright := "Jane Doe\x00", "(c) Jane Doe\x00"
+	buf.WriteString("MM")
+	be(uint16(42))
+	be(uint32(8))
+	// IFD0: orientation, artist, copyright, GPS IFD pointer
+	ifd0End := 8 + 2 + 4*12 + 4
+	be(uint16(4))
+	be([]uint16{0x0112, 3})
+	be(uint32(1))
+	be([]uint16{6, 0})
+	be([]uint16{0x013b, 2})
+	be(uint32(len(artist)))
+	be(uint32(ifd0End))
+	be([]uint16{0x8298, 2})
+	be(uint32(len(copyright)))
+	be(uint32(ifd0End + len(artist)))
+	be([]uint16{0x8825, 4})
+	be(uint32(1))
+	be(uint32(ifd0End + len(artist) + len(copyright)))
+	be(uint32(0))
+	buf.WriteString(artist)
+	buf.WriteString(copyright)
+	// GPS IFD: latitude ref only, enough to tell whether it leaked
+	be(uint16(1))
+	be([]uint16{0x0001, 2})
+	be(uint32(2))
+	buf.WriteString("N\x00\x00\x00")
+	be(uint32(0))
+	return buf.Bytes()
+}
+
+// withMetadata inserts APP1 EXIF and APP2 ICC segments right after the SOI marker of a JPEG
+func withMetadata(jpg, exif, icc []byte) []byte {
+	segment := func(marker byte, payload []byte) []byte {
+		length := make([]byte, 2)
+		binary.BigEndian.PutUint16(length, uint16(len(payload)+2))
+		return append(append([]byte{0xff, marker}, length...), payload...)
+	}
+	out := append([]byte{}, jpg[:2]...)
+	if exif != nil {
+		out = append(out, segment(0xe1, append([]byte("Exif\x00\x00"), exif...))...)
+	}
+	out = append(out, segment(0xe2, append([]byte("ICC_PROFILE\x00\x01\x01"), icc...))...)
+	return append(out, jpg[2:]...)
+}
+
+// primaries are the D50 adapted XYZ coordinates of the red, green and blue primaries, one column each
+type primaries [3][3]float64
+
+var (
+	srgbPrimaries = primaries{
+		{0.4360747, 0.3850649, 0.1430804},
+		{0.2225045, 0.7168786, 0.0606169},
+		{0.0139322, 0.0971045, 0.7141733},
+	}
+	displayP3Primaries = primaries{
+		{0.515102, 0.291965, 0.157153},
+		{0.241182, 0.692236, 0.066582},
+		{-0.001050, 0.041882, 0.784378},
+	}
+)
+
+// iccProfile writes a v2 matrix/TRC display profile with the sRGB tone curve
+func iccProfile(p primaries) []byte {
+	var tags bytes.Buffer
+	tbe := func(v interface{}) { check(binary.Write(&tags, binary.BigEndian, v)) }
+	s15 := func(v float64) int32 { return int32(math.Round(v * 65536)) }
+	xyz := func(x, y, z float64) {
+		tags.WriteString("XYZ \x00\x00\x00\x00")
+		tbe([]int32{s15(x), s15(y), s15(z)})
+	}
+	type tag struct {
+		sig            string
+		offset, length int
+	}
+	const headerAndTable = 128 + 4 + 7*12
+	var table []tag
+	for i, sig := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		table = append(table, tag{sig, headerAndTable + tags.Len(), 20})
+		xyz(p[0][i], p[1][i], p[2][i])
+	}
+	table = append(table, tag{"wtpt", headerAndTable + tags.Len(), 20})
+	xyz(0.9642, 1, 0.8249)
+	trc := headerAndTable + tags.Len()
+	tags.WriteString("para\x00\x00\x00\x00")
+	tbe([]uint16{3, 0})
+	tbe([]int32{s15(2.4), s15(1 / 1.055), s15(0.055 / 1.055), s15(1 / 12.92), s15(0.04045)})
+	for _, sig := range []string{"rTRC", "gTRC", "bTRC"} {
+		table = append(table, tag{sig, trc, 32})
+	}
+
+	var buf bytes.Buffer
+	be := func(v interface{}) { check(binary.Write(&buf, binary.BigEndian, v)) }
+	be(uint32(headerAndTable + tags.Len()))
+	buf.WriteString("none")
+	be(uint32(0x02100000))
+	buf.WriteString("mntrRGB XYZ ")
+	buf.Write(make([]byte, 12)) // creation date
+	buf.WriteString("acsp")
+	buf.Write(make([]byte, 68-40))
+	be([]int32{s15(0.9642), s15(1), s15(0.8249)})
+	buf.Write(make([]byte, 128-80))
+	be(uint32(len(table)))
+	for _, t := range table {
+		buf.WriteString(t.sig)
+		be([]uint32{uint32(t.offset), uint32(t.length)})
+	}
+	buf.Write(tags.Bytes())
+	return buf.Bytes()
+}
+
+// toDisplayP3 re-encodes the sRGB pixels of img in Display P3, so that they only look right when color managed
+func toDisplayP3(img image.Image) image.Image {
+	toXYZ, fromXYZ := srgbPrimaries, invert(displayP3Primaries)
+	decode := func(v uint32) float64 {
+		c := float64(v) / 0xffff
+		if c <= 0.04045 {
+			return c / 12.92
+		}
+		return math.Pow((c+0.055)/1.055, 2.4)
+	}
+	encode := func(c float64) uint8 {
+		c = math.Max(0, math.Min(1, c))
+		if c <= 0.0031308 {
+			c *= 12.92
+		} else {
+			c = 1.055*math.Pow(c, 1/2.4) - 0.055
+		}
+		return uint8(math.Round(c * 255))
+	}
+	b := img.Bounds()
+	out := image.NewRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, _ := img.At(x, y).RGBA()
+			linear := [3]float64{decode(r), decode(g), decode(bl)}
+			var xyz, p3 [3]float64
+			for i := 0; i < 3; i++ {
+				xyz[i] = toXYZ[i][0]*linear[0] + toXYZ[i][1]*linear[1] + toXYZ[i][2]*linear[2]
+			}
+			for i := 0; i < 3; i++ {
+				p3[i] = fromXYZ[i][0]*xyz[0] + fromXYZ[i][1]*xyz[1] + fromXYZ[i][2]*xyz[2]
+			}
+			out.Set(x, y, color.RGBA{R: encode(p3[0]), G: encode(p3[1]), B: encode(p3[2]), A: 255})
+		}
+	}
+	return out
+}
+
+func invert(m primaries) primaries {
+	det := m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+	var inv primaries
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			// cofactor of m[j][i]
+			a, b := (j+1)%3, (j+2)%3
+			c, d := (i+1)%3, (i+2)%3
+			inv[i][j] = (m[a][c]*m[b][d] - m[a][d]*m[b][c]) / det
+		}
+	}
+	return inv
+}
+
+// encodePSD writes a single layer, uncompressed 8 bit RGB Photoshop document
+// encodeICO writes an icon with a 16x16 PNG entry and a larger 32x32 32 bit BMP one
+func encodeICO() []byte {
+	small := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	for i := range small.Pix {
+		small.Pix[i] = 0xff
+	}
+	var smallPNG bytes.Buffer
+	check(png.Encode(&smallPNG, small))
+
+	const size = 32
+	// BITMAPINFOHEADER, the height counts the AND mask too
+	dib := make([]byte, 40, 40+size*size*4+size*4)
+	binary.LittleEndian.PutUint32(dib[0:], 40)
+	binary.LittleEndian.PutUint32(dib[4:], size)
+	binary.LittleEndian.PutUint32(dib[8:], size*2)
+	binary.LittleEndian.PutUint16(dib[12:], 1)
+	binary.LittleEndian.PutUint16(dib[14:], 32)
+	// bottom-up BGRA rows: a red disc on a transparent background
+	for y := size - 1; y >= 0; y-- {
+		for x := 0; x < size; x++ {
+			dx, dy := float64(x)-15.5, float64(y)-15.5
+			if dx*dx+dy*dy < 14*14 {
+				dib = append(dib, 0x20, 0x30, 0xe0, 0xff)
+			} else {
+				dib = append(dib, 0, 0, 0, 0)
+			}
+		}
+	}
+	// the mask is ignored when the alpha channel is used, but must be there
+	dib = append(dib, make([]byte, size*4)...)
+
+	entries := [][]byte{smallPNG.Bytes(), dib}
+	sizes := []byte{16, size}
+	ico := []byte{0, 0, 1, 0, byte(len(entries)), 0}
+	offset := 6 + 16*len(entries)
+	for i, entry := range entries {
+		dir := make([]byte, 16)
+		dir[0], dir[1] = sizes[i], sizes[i]
+		binary.LittleEndian.PutUint16(dir[4:], 1)
+		binary.LittleEndian.PutUint16(dir[6:], 32)
+		binary.LittleEndian.PutUint32(dir[8:], uint32(len(entry)))
+		binary.LittleEndian.PutUint32(dir[12:], uint32(offset))
+		ico = append(ico, dir...)
+		offset += len(entry)
+	}
+	for _, entry := range entries {
+		ico = append(ico, entry...)
+	}
+	return ico
+}
+
+func encodePSD(img image.Image) []byte {
+	b := img.Bounds()
+	var buf bytes.Buffer
+	buf.WriteString("8BPS")
+	be := func(v interface{}) { check(binary.Write(&buf, binary.BigEndian, v)) }
+	be(uint16(1)) // version
+	buf.Write(make([]byte, 6))
+	be(uint16(3)) // channels
+	be(uint32(b.Dy()))
+	be(uint32(b.Dx()))
+	be(uint16(8)) // depth
+	be(uint16(3)) // RGB
+	be(uint32(0)) // color mode data
+	be(uint32(0)) // image resources
+	be(uint32(0)) // layer and mask information
+	be(uint16(0)) // raw image data
+	for channel := 0; channel < 3; channel++ {
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				r, g, bl, _ := img.At(x, y).RGBA()
+				buf.WriteByte(uint8([]uint32{r, g, bl}[channel] >> 8))
+			}
+		}
+	}
+	return buf.Bytes()
+}
+
+func read(name string) []byte {
+	data, err := os.ReadFile(filepath.Join(out, name))
+	check(err)
+	return data
+}
+
+func write(name string, data []byte) {
+	check(os.WriteFile(filepath.Join(out, name), data, 0644))
+}
+
+func check(err error) {
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,66 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/OdyseeTeam/mirage/metadata"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// cachedVariant is the admin view of a cached object
+type cachedVariant struct {
+	*metadata.ImageMetadata
+	Stored bool `json:"stored"`
+}
+
+func (s *Server) describeVariant(md *metadata.ImageMetadata) (cachedVariant, error) {
+	stored, err := s.cache.Has(md.StorageHash())
+	if err != nil {
+		return cachedVariant{}, errors.Err(err)
+	}
+	return cachedVariant{ImageMetadata: md, Stored: stored}, nil
+}
+
+// variantsHandler lists every cached variant of a source url
+func (s *Server) variantsHandler(c *gin.Context) {
+	urlToProxy := extractUrl(c)
+	storedImages, err := s.metadataManager.RetrieveAllForUrl(urlToProxy)
+	if err != nil {
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	variants := make([]cachedVariant, 0, len(storedImages))
+	for _, md := range storedImages {
+		v, err := s.describeVariant(md)
+		if err != nil {
+			_ = c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		variants = append(variants, v)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"url":      urlToProxy,
+		"variants": variants,
+	})
+}
+
+// hashHandler traces an X-mirage-godycdn-hash value back to its source
+func (s *Server) hashHandler(c *gin.Context) {
+	md, err := s.metadataManager.Retrieve(c.Param("hash"))
+	if err != nil {
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	if md == nil {
+		_ = c.AbortWithError(http.StatusNotFound, errors.Err("no metadata found for this hash"))
+		return
+	}
+	v, err := s.describeVariant(md)
+	if err != nil {
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, v)
+}
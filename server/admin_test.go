@@ -0,0 +1,355 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/OdyseeTeam/mirage/blocklist"
+	"github.com/OdyseeTeam/mirage/metadata"
+)
+
+func decode(t *testing.T, body []byte, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(body, v); err != nil {
+		t.Fatalf("%s: %s", err, body)
+	}
+}
+
+func TestVariantsAndHash(t *testing.T) {
+	h := newHarness(t)
+	source := h.origin.URL + "/photo.png"
+	rec := h.get("/optimize/s:16:0/quality:80/plain/" + source)
+	hash := rec.Header().Get("X-mirage-godycdn-hash")
+
+	rec = h.admin(http.MethodGet, "/admin/variants/"+source, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+	}
+	var variants struct {
+		URL      string          `json:"url"`
+		Variants []cachedVariant `json:"variants"`
+	}
+	decode(t, rec.Body.Bytes(), &variants)
+	if variants.URL != source || len(variants.Variants) != 1 || !variants.Variants[0].Stored || variants.Variants[0].GodycdnHash != hash {
+		t.Errorf("unexpected variants %s", rec.Body.String())
+	}
+
+	rec = h.admin(http.MethodGet, "/admin/hash/"+hash, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+	}
+	var variant cachedVariant
+	decode(t, rec.Body.Bytes(), &variant)
+	if variant.ImageMetadata == nil || variant.OriginalURL != source {
+		t.Errorf("unexpected variant %s", rec.Body.String())
+	}
+	if rec := h.admin(http.MethodGet, "/admin/hash/unknown", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown hash got %d", rec.Code)
+	}
+}
+
+func TestDuplicates(t *testing.T) {
+	h := newHarness(t)
+	h.get("/optimize/s:16:0/quality:80/plain/" + h.origin.URL + "/photo.png")
+	// other.png has the same bytes, so it is aliased to the object of photo.png
+	rec := h.get("/optimize/s:16:0/quality:80/plain/" + h.origin.URL + "/other.png")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+	}
+	if calls := h.optimizer.calls.Load(); calls != 1 {
+		t.Errorf("optimizer ran %d times for byte-identical sources", calls)
+	}
+
+	rec = h.admin(http.MethodGet, "/admin/duplicates?url="+url.QueryEscape(h.origin.URL+"/photo.png"), "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+	}
+	var duplicates struct {
+		Sources []duplicateSource `json:"sources"`
+	}
+	decode(t, rec.Body.Bytes(), &duplicates)
+	if len(duplicates.Sources) != 2 {
+		t.Errorf("unexpected duplicates %s", rec.Body.String())
+	}
+	if rec := h.admin(http.MethodGet, "/admin/duplicates", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("duplicates without a query got %d", rec.Code)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	h := newHarness(t)
+	source := h.origin.URL + "/photo.png"
+	h.get("/optimize/s:16:0/quality:80/plain/" + source)
+
+	if rec := h.admin(http.MethodPost, "/admin/purge", `{}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("empty purge got %d", rec.Code)
+	}
+	rec := h.admin(http.MethodPost, "/admin/purge", `{"prefixes": ["`+h.origin.URL+`/"], "hosts": ["unknown.example.com"]}`)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+	}
+	var status purgeJobStatus
+	decode(t, rec.Body.Bytes(), &status)
+	h.waitFor(func() bool {
+		rec = h.admin(http.MethodGet, "/admin/purge/"+status.ID, "")
+		decode(t, rec.Body.Bytes(), &status)
+		return status.Done
+	})
+	if len(status.Summary.Purged) != 1 || len(status.Summary.NotFound) != 1 {
+		t.Errorf("unexpected purge status %s", rec.Body.String())
+	}
+	if rec := h.admin(http.MethodGet, "/admin/purge/unknown", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown purge job got %d", rec.Code)
+	}
+}
+
+func TestPruneOwnerKeepsAliases(t *testing.T) {
+	h := newHarness(t)
+	owner := h.origin.URL + "/photo.png"
+	h.get("/optimize/s:16:0/quality:80/plain/" + owner)
+	// other.png has the same bytes, so it is aliased to the object of photo.png
+	alias := "/optimize/s:16:0/quality:80/plain/" + h.origin.URL + "/other.png"
+	rec := h.get(alias)
+	served := rec.Body.String()
+	aliasHash := rec.Header().Get("X-mirage-godycdn-hash")
+
+	if rec := h.admin(http.MethodGet, "/admin/prune/"+owner, ""); rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+	}
+	md, _ := h.metadata.Retrieve(aliasHash)
+	if md == nil || md.IsAlias() {
+		t.Fatalf("the alias was not handed the object: %+v", md)
+	}
+	rec = h.get(alias)
+	if rec.Code != http.StatusOK || rec.Body.String() != served || rec.Header().Get("X-mirage-cache-hit") != "true" {
+		t.Errorf("the alias got %d, cache hit %s", rec.Code, rec.Header().Get("X-mirage-cache-hit"))
+	}
+	if calls := h.optimizer.calls.Load(); calls != 1 {
+		t.Errorf("optimizer ran %d times", calls)
+	}
+}
+
+func TestWarm(t *testing.T) {
+	h := newHarness(t)
+	source := h.origin.URL + "/photo.png"
+	body := `{"concurrency": 2, "items": [{"url": "` + source + `", "width": 16}, {"url": "` + source + `", "width": 24, "card": true}, {"url": "` + h.origin.URL + `/missing.png"}]}`
+	rec := h.admin(http.MethodPost, "/admin/warm", body)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+	}
+	var job struct {
+		ID       string       `json:"id"`
+		Progress WarmProgress `json:"progress"`
+	}
+	decode(t, rec.Body.Bytes(), &job)
+	h.waitFor(func() bool {
+		rec = h.admin(http.MethodGet, "/admin/warm/"+job.ID, "")
+		decode(t, rec.Body.Bytes(), &job)
+		return job.Progress.Done
+	})
+	if job.Progress.Generated != 2 || len(job.Progress.Failed) != 1 {
+		t.Errorf("unexpected warm progress %s", rec.Body.String())
+	}
+	// cards are stored as they are generated and encoded to JPEG by libvips when served
+	if rec := h.get("/card/s:24:0/quality:85/plain/" + source); vipsAvailable() && rec.Code != http.StatusOK || h.optimizer.calls.Load() != 2 {
+		t.Errorf("warmed card variant was not cached")
+	}
+}
+
+func TestWarmProgressInOrder(t *testing.T) {
+	h := newHarness(t)
+	var items []WarmItem
+	for width := int64(8); width < 40; width += 2 {
+		items = append(items, WarmItem{URL: h.origin.URL + "/photo.png", Width: width, Quality: 80})
+	}
+	var published []int
+	result := h.server.Warm(items, WarmOptions{Concurrency: 4}, func(p WarmProgress) {
+		published = append(published, p.Processed)
+	})
+	if result.Processed != len(items) || len(published) != len(items)+1 {
+		t.Fatalf("%d processed, %d progress reports", result.Processed, len(published))
+	}
+	for i := 1; i < len(items); i++ {
+		if published[i] <= published[i-1] {
+			t.Fatalf("progress went from %d to %d", published[i-1], published[i])
+		}
+	}
+}
+
+func TestWarmItemParams(t *testing.T) {
+	tests := []struct {
+		name    string
+		item    WarmItem
+		variant string
+		url     string
+		invalid bool
+	}{
+		{"defaults", WarmItem{URL: "https://example.com/a.png"}, "/optimize/s:0:0/quality:85", "https://example.com/a.png", false},
+		{"height along with the width", WarmItem{URL: "https://example.com/a.png", Width: 10, Height: 20}, "/optimize/s:10:0/quality:85", "https://example.com/a.png", false},
+		{"rewritten source", WarmItem{URL: "https://example.com/a.png@webp", Card: true}, "/card/s:0:0/quality:85", "https://example.com/a.png", false},
+		{"negative width", WarmItem{URL: "https://example.com/a.png", Width: -1}, "", "", true},
+		{"oversized height", WarmItem{URL: "https://example.com/a.png", Height: maxDimension + 1}, "", "", true},
+		{"quality out of range", WarmItem{URL: "https://example.com/a.png", Quality: 101}, "", "", true},
+		{"jpeg options off cards", WarmItem{URL: "https://example.com/a.png", Options: "trellis:1"}, "", "", true},
+		{"card format", WarmItem{URL: "https://example.com/a.png", Card: true, Options: "format:png"}, "", "", true},
+		{"malformed recursion", WarmItem{URL: "https://thumbnails.odycdn.com/a.png"}, "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params, err := tt.item.params()
+			if tt.invalid {
+				if err == nil {
+					t.Errorf("got %s for an invalid item", params.variant())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if params.variant() != tt.variant || params.UrlToProxy != tt.url {
+				t.Errorf("got %s for %s, want %s for %s", params.variant(), params.UrlToProxy, tt.variant, tt.url)
+			}
+		})
+	}
+}
+
+func TestBlocklistDisabled(t *testing.T) {
+	h := newHarness(t)
+	rec := h.admin(http.MethodGet, "/admin/blocklist", "")
+	if rec.Code != http.StatusOK || rec.Body.String() != "[]" {
+		t.Errorf("got %d: %s", rec.Code, rec.Body.String())
+	}
+	entry := `{"kind": "url", "value": "https://example.com/a.png"}`
+	if rec := h.admin(http.MethodPost, "/admin/blocklist", entry); rec.Code != http.StatusNotImplemented {
+		t.Errorf("adding to a disabled blocklist got %d", rec.Code)
+	}
+	if rec := h.admin(http.MethodDelete, "/admin/blocklist", entry); rec.Code != http.StatusNotImplemented {
+		t.Errorf("removing from a disabled blocklist got %d", rec.Code)
+	}
+}
+
+func TestBlocklistContentOnHit(t *testing.T) {
+	h := newHarness(t)
+	h.server.blocklist = blocklist.NewMemory(4)
+	legacy := "/optimize/s:32:0/quality:80/plain/" + h.origin.URL + "/photo.png"
+	fingerprinted := "/optimize/s:32:0/quality:80/plain/" + h.origin.URL + "/other.png"
+	var hashes []string
+	for _, path := range []string{legacy, fingerprinted} {
+		rec := h.get(path)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+		}
+		hashes = append(hashes, rec.Header().Get("X-mirage-godycdn-hash"))
+	}
+	// the first variant was cached before sources were fingerprinted
+	md, _ := h.metadata.Retrieve(hashes[0])
+	sourceSHA256 := md.SourceSHA256
+	md.SourceSHA256, md.PHash = "", 0
+	if err := h.metadata.Persist(md); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := h.admin(http.MethodPost, "/admin/blocklist", `{"kind": "sha256", "value": "`+sourceSHA256+`"}`)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"unchecked":1`) {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+	}
+	if md, _ := h.metadata.Retrieve(hashes[1]); md != nil {
+		t.Error("the fingerprinted variant was not purged")
+	}
+	// the legacy variant is still served from the cache, and gets fingerprinted, blocked and purged in the background
+	if rec := h.get(legacy); rec.Code != http.StatusOK {
+		t.Errorf("legacy variant got %d", rec.Code)
+	}
+	h.waitFor(func() bool {
+		md, _ := h.metadata.Retrieve(hashes[0])
+		return md == nil
+	})
+	if rec := h.get(legacy); rec.Code != http.StatusUnavailableForLegalReasons {
+		t.Errorf("purged legacy variant got %d", rec.Code)
+	}
+	if h.origin.hitsFor("/photo.png") != 3 {
+		t.Errorf("the source was downloaded %d times", h.origin.hitsFor("/photo.png"))
+	}
+
+	// variants a content entry was added for elsewhere are blocked when served from the cache
+	h.server.blocklist = blocklist.NewMemory(4)
+	rec = h.get(fingerprinted)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d", rec.Code)
+	}
+	if _, err := h.server.blocklist.Add(blocklist.Entry{Kind: blocklist.KindSHA256, Value: sourceSHA256}); err != nil {
+		t.Fatal(err)
+	}
+	if rec := h.get(fingerprinted); rec.Code != http.StatusUnavailableForLegalReasons {
+		t.Errorf("cached variant got %d", rec.Code)
+	}
+
+	// and so are the aliases sharing their object
+	h.server.blocklist = blocklist.NewMemory(4)
+	owner := "/optimize/s:32:0/quality:70/plain/" + h.origin.URL + "/other.png"
+	alias := "/optimize/s:32:0/quality:70/plain/" + h.origin.URL + "/photo.png"
+	for _, path := range []string{owner, alias} {
+		if rec = h.get(path); rec.Code != http.StatusOK {
+			t.Fatalf("%s: got %d", path, rec.Code)
+		}
+	}
+	if md, _ := h.metadata.Retrieve(rec.Header().Get("X-mirage-godycdn-hash")); md == nil || !md.IsAlias() {
+		t.Fatalf("expected an alias, got %+v", md)
+	}
+	if _, err := h.server.blocklist.Add(blocklist.Entry{Kind: blocklist.KindSHA256, Value: sourceSHA256}); err != nil {
+		t.Fatal(err)
+	}
+	if rec := h.get(alias); rec.Code != http.StatusUnavailableForLegalReasons {
+		t.Errorf("alias got %d", rec.Code)
+	}
+}
+
+func TestFingerprintWithoutMetadata(t *testing.T) {
+	h := newHarness(t)
+	h.server.blocklist = blocklist.NewMemory(4)
+	path := "/optimize/s:32:0/quality:80/plain/" + h.origin.URL + "/photo.png"
+	rec := h.get(path)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+	}
+	hash := rec.Header().Get("X-mirage-godycdn-hash")
+	if err := h.metadata.Delete(&metadata.ImageMetadata{GodycdnHash: hash}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.server.blocklist.Add(blocklist.Entry{Kind: blocklist.KindSHA256, Value: strings.Repeat("0", 64)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the hit is served at once, and the metadata of the variant is stored once its source is fingerprinted
+	if rec := h.get(path); rec.Code != http.StatusOK {
+		t.Fatalf("got %d", rec.Code)
+	}
+	h.waitFor(func() bool {
+		md, _ := h.metadata.Retrieve(hash)
+		return md != nil && md.SourceSHA256 != ""
+	})
+	for i := 0; i < 3; i++ {
+		if rec := h.get(path); rec.Code != http.StatusOK {
+			t.Fatalf("got %d", rec.Code)
+		}
+	}
+	if h.origin.hitsFor("/photo.png") != 2 {
+		t.Errorf("the source was downloaded %d times", h.origin.hitsFor("/photo.png"))
+	}
+}
+
+// waitFor polls done until it returns true, failing the test after a few seconds
+func (h *harness) waitFor(done func() bool) {
+	h.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			h.t.Fatal("timed out")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,240 @@
+package http
+
+import (
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/OdyseeTeam/mirage/blocklist"
+	"github.com/OdyseeTeam/mirage/internal/imagehash"
+	"github.com/OdyseeTeam/mirage/metadata"
+	"github.com/OdyseeTeam/mirage/optimizer"
+
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/gin-gonic/gin"
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+var (
+	placeholderOnce sync.Once
+	placeholder     []byte
+)
+
+// loadPlaceholder reads the image configured as blocklist.placeholder, returning nil if there is none
+func loadPlaceholder() []byte {
+	placeholderOnce.Do(func() {
+		path := viper.GetString("blocklist.placeholder")
+		if path == "" {
+			return
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			logrus.Errorf("could not read blocklist placeholder: %s", errors.FullTrace(err))
+			return
+		}
+		placeholder = data
+	})
+	return placeholder
+}
+
+// respondBlocked serves the placeholder image in place of blocked content, or a 451 when there is none
+func respondBlocked(c *gin.Context, entry *blocklist.Entry) {
+	c.Header("X-mirage-blocked", string(entry.Kind))
+	data := loadPlaceholder()
+	if viper.GetString("blocklist.mode") == "451" || data == nil {
+		c.AbortWithStatus(http.StatusUnavailableForLegalReasons)
+		return
+	}
+	// entries can be removed, don't let edges keep the placeholder for a year
+	c.Header("Cache-control", "max-age=3600")
+	c.Data(http.StatusOK, mimetype.Detect(data).String(), data)
+	c.Abort()
+}
+
+// blockedError returns the blocklist error wrapped in err, if any
+func blockedError(err error) *blocklist.BlockedError {
+	blocked, _ := errors.Unwrap(err).(*blocklist.BlockedError)
+	return blocked
+}
+
+func (s *Server) blocklistListHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, s.blocklist.List())
+}
+
+// blocklistAddHandler blocks a url, host or content hash and purges the variants already cached for it
+func (s *Server) blocklistAddHandler(c *gin.Context) {
+	if s.blocklist == nil {
+		_ = c.AbortWithError(http.StatusNotImplemented, errors.Err("blocklist is not enabled"))
+		return
+	}
+	var entry blocklist.Entry
+	err := c.ShouldBindJSON(&entry)
+	if err != nil {
+		_ = c.AbortWithError(http.StatusBadRequest, errors.Err(err))
+		return
+	}
+	entry, err = blocklist.Normalize(entry)
+	if err != nil {
+		_ = c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	entry, err = s.blocklist.Add(entry)
+	if err != nil {
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	storedImages, err := s.variantsMatching(entry)
+	if err != nil {
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	summary := newPurgeSummary()
+	s.purgeVariants(storedImages, summary)
+	s.purgeSourceInfo(storedImages, summary)
+	// sources only probed by /info/ and /placeholder/ have no variants to be found by
+	switch entry.Kind {
+	case blocklist.KindSHA256:
+		s.deleteSourceInfo(entry.Value, s.metadataManager.DeleteSourceInfoForSourceHash, summary)
+	case blocklist.KindPHash:
+		s.deleteSourceInfo(entry.Value, s.deleteSourceInfoForPHash, summary)
+	}
+	response := gin.H{
+		"entry":  entry,
+		"purged": summary,
+	}
+	// variants cached before sources were fingerprinted can't be found by content, they are fingerprinted
+	// in the background when next served
+	if entry.Kind == blocklist.KindSHA256 || entry.Kind == blocklist.KindPHash {
+		unchecked, err := s.metadataManager.CountUnfingerprinted()
+		if err != nil {
+			logrus.Errorf("could not count unfingerprinted variants: %s", errors.FullTrace(err))
+		} else {
+			response["unchecked"] = unchecked
+		}
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+func (s *Server) blocklistRemoveHandler(c *gin.Context) {
+	if s.blocklist == nil {
+		_ = c.AbortWithError(http.StatusNotImplemented, errors.Err("blocklist is not enabled"))
+		return
+	}
+	var entry blocklist.Entry
+	err := c.ShouldBindJSON(&entry)
+	if err != nil {
+		_ = c.AbortWithError(http.StatusBadRequest, errors.Err(err))
+		return
+	}
+	err = s.blocklist.Remove(entry)
+	if err != nil {
+		_ = c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// fingerprintQueueSize bounds the variants waiting to be fingerprinted, those served past it are queued again when
+// next served
+const fingerprintQueueSize = 1000
+
+// fingerprintJob is a cached variant whose source is to be fingerprinted. Metadata that wasn't persisted is filled in
+// from the source before it is.
+type fingerprintJob struct {
+	md        metadata.ImageMetadata
+	persisted bool
+}
+
+// blockedContent returns the content entry blocking a cached variant, if any. Variants cached before sources were
+// fingerprinted are served as they are and queued to be fingerprinted in the background when there are content
+// entries to check.
+func (s *Server) blockedContent(md *metadata.ImageMetadata, persisted bool) *blocklist.Entry {
+	if md.SourceSHA256 == "" && s.blocklist.HasContentEntries() {
+		s.queueFingerprint(md, persisted)
+	}
+	return s.blocklist.MatchContent(md.SourceSHA256, md.PHash)
+}
+
+// queueFingerprint queues a variant to be fingerprinted unless it was lately, whether or not that worked, or the queue
+// is full
+func (s *Server) queueFingerprint(md *metadata.ImageMetadata, persisted bool) {
+	if s.fingerprinted.Has(md.GodycdnHash) {
+		return
+	}
+	select {
+	case s.fingerprints <- fingerprintJob{md: *md, persisted: persisted}:
+		_ = s.fingerprinted.Set(md.GodycdnHash, true)
+	default:
+	}
+}
+
+// fingerprintVariants fingerprints the queued variants one at a time until the server shuts down
+func (s *Server) fingerprintVariants() {
+	defer s.grp.Done()
+	for {
+		select {
+		case <-s.grp.Ch():
+			return
+		case job := <-s.fingerprints:
+			s.fingerprintVariant(job)
+		}
+	}
+}
+
+// fingerprintVariant stores the fingerprint of the source of a cached variant, and purges the variant if a content
+// entry blocks it. A source that can't be downloaded anymore leaves the variant unchecked.
+func (s *Server) fingerprintVariant(job fingerprintJob) {
+	md := &job.md
+	source, image, err := s.downloadSource(md.OriginalURL)
+	if err != nil {
+		logrus.Warnf("could not fingerprint the source of %s: %s", md.GodycdnHash, errors.FullTrace(err))
+		return
+	}
+	md.SourceSHA256, md.PHash = s.optimizer.FingerprintSource(optimizer.NewSource(image))
+	if !job.persisted {
+		md.OriginalMimeType = source.MimeType
+		md.OriginalSize = int(max(source.Size, 0))
+	}
+	err = s.metadataManager.Persist(md)
+	if err != nil {
+		logrus.Errorf("could not persist the fingerprint of %s: %s", md.GodycdnHash, errors.FullTrace(err))
+		return
+	}
+	// content entries apply to what was cached before them too, purging on add only finds fingerprinted variants
+	if entry := s.blocklist.MatchContent(md.SourceSHA256, md.PHash); entry != nil {
+		logrus.Infof("purging %s, its source is blocked by %s %s", md.GodycdnHash, entry.Kind, entry.Value)
+		summary := newPurgeSummary()
+		s.purgeVariants([]*metadata.ImageMetadata{md}, summary)
+		s.purgeSourceInfo([]*metadata.ImageMetadata{md}, summary)
+	}
+}
+
+// deleteSourceInfoForPHash deletes the source info a phash entry applies to
+func (s *Server) deleteSourceInfoForPHash(value string) (int64, error) {
+	h, err := imagehash.Parse(value)
+	if err != nil {
+		return 0, errors.Err(err)
+	}
+	return s.metadataManager.DeleteSourceInfoForPHash(h, s.blocklist.PHashDistance())
+}
+
+// variantsMatching returns the cached variants a blocklist entry applies to
+func (s *Server) variantsMatching(entry blocklist.Entry) ([]*metadata.ImageMetadata, error) {
+	switch entry.Kind {
+	case blocklist.KindURL:
+		return s.metadataManager.RetrieveAllForUrl(entry.Value)
+	case blocklist.KindHost:
+		return s.metadataManager.RetrieveAllForHost(entry.Value)
+	case blocklist.KindSHA256:
+		return s.metadataManager.RetrieveAllForSourceHash(entry.Value)
+	case blocklist.KindPHash:
+		h, err := imagehash.Parse(entry.Value)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		return s.metadataManager.RetrieveAllForPHash(h, s.blocklist.PHashDistance())
+	}
+	return nil, errors.Err("unknown blocklist kind %q", entry.Kind)
+}
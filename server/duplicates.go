@@ -0,0 +1,168 @@
+package http
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/OdyseeTeam/mirage/blocklist"
+	"github.com/OdyseeTeam/mirage/internal/imagehash"
+	"github.com/OdyseeTeam/mirage/metadata"
+
+	"github.com/OdyseeTeam/gody-cdn/store"
+	"github.com/gin-gonic/gin"
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// cachedAlias returns the variant stored as hashedName when it shares the object of a byte-identical source.
+// It returns nil if hashedName isn't an alias or the shared object is gone, and a BlockedError if its source is
+// blocked.
+func (s *Server) cachedAlias(hashedName string) (*optimizedImage, error) {
+	md, err := s.metadataManager.Retrieve(hashedName)
+	if err != nil {
+		logrus.Errorf("cannot retrieve metadata: %s", errors.FullTrace(err))
+		return nil, nil
+	}
+	if md == nil || !md.IsAlias() {
+		return nil, nil
+	}
+	if entry := s.blockedContent(md, true); entry != nil {
+		return nil, &blocklist.BlockedError{Entry: *entry}
+	}
+	obj, err := s.cache.Get(md.StorageHash())
+	if err != nil {
+		if strings.Contains(err.Error(), store.ErrObjectNotFound.Error()) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &optimizedImage{
+		optimizedImage: &obj,
+		metadata:       md,
+		cacheHit:       true,
+	}, nil
+}
+
+// aliasDuplicate looks for the same variant of a byte-identical source cached under another url.
+// If one is found its object is reused and a metadata entry pointing at it is stored as hashedName.
+func (s *Server) aliasDuplicate(params optimizerParams, hashedName, sourceSHA256 string) (*optimizedImage, error) {
+	candidates, err := s.metadataManager.RetrieveAllForSourceVariant(sourceSHA256, params.variant())
+	if err != nil {
+		logrus.Errorf("cannot retrieve duplicates: %s", errors.FullTrace(err))
+		return nil, nil
+	}
+	for _, candidate := range candidates {
+		// re-encoded variants share the variant of the kept sources and AVIFs they stand in for
+		avif := candidate.OptimizedMimeType == "image/avif"
+		if candidate.GodycdnHash == hashedName || params.Reencode && (candidate.KeptSource || avif) ||
+			params.Options.Format == formatAvif && !params.Reencode && !avif {
+			continue
+		}
+		obj, err := s.cache.Get(candidate.StorageHash())
+		if err != nil {
+			if strings.Contains(err.Error(), store.ErrObjectNotFound.Error()) {
+				continue
+			}
+			return nil, err
+		}
+		md := *candidate
+		md.OriginalURL = params.UrlToProxy
+		md.GodycdnHash = hashedName
+		md.ObjectHash = candidate.StorageHash()
+		err = s.metadataManager.Persist(&md)
+		if err != nil {
+			logrus.Errorf("failed to persist metadata for object %s: %s", params.UrlToProxy, errors.FullTrace(err))
+		}
+		return &optimizedImage{
+			optimizedImage: &obj,
+			metadata:       &md,
+			cacheHit:       true,
+		}, nil
+	}
+	return nil, nil
+}
+
+type duplicateSource struct {
+	OriginalURL  string         `json:"original_url"`
+	SourceSHA256 string         `json:"source_sha256"`
+	PHash        imagehash.Hash `json:"phash"`
+	Distance     int            `json:"distance"`
+	Variants     int            `json:"variants"`
+}
+
+// duplicatesHandler lists the sources whose perceptual hash is within ?distance= bits of ?phash= or of the source at ?url=
+func (s *Server) duplicatesHandler(c *gin.Context) {
+	distance := viper.GetInt("duplicates.max_distance")
+	if d := c.Query("distance"); d != "" {
+		parsed, err := strconv.Atoi(d)
+		if err != nil || parsed < 0 || parsed > 64 {
+			_ = c.AbortWithError(http.StatusBadRequest, errors.Err("distance must be between 0 and 64"))
+			return
+		}
+		distance = parsed
+	}
+	var phash imagehash.Hash
+	if p := c.Query("phash"); p != "" {
+		parsed, err := imagehash.Parse(p)
+		if err != nil {
+			_ = c.AbortWithError(http.StatusBadRequest, errors.Err(err))
+			return
+		}
+		phash = parsed
+	} else if u := c.Query("url"); u != "" {
+		storedImages, err := s.metadataManager.RetrieveAllForUrl(u)
+		if err != nil {
+			_ = c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		for _, md := range storedImages {
+			if md.PHash != 0 {
+				phash = md.PHash
+				break
+			}
+		}
+	} else {
+		_ = c.AbortWithError(http.StatusBadRequest, errors.Err("either phash or url is required"))
+		return
+	}
+	if phash == 0 {
+		_ = c.AbortWithError(http.StatusNotFound, errors.Err("no perceptual hash known for this source"))
+		return
+	}
+	storedImages, err := s.metadataManager.RetrieveAllForPHash(phash, distance)
+	if err != nil {
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"phash":    phash,
+		"distance": distance,
+		"sources":  groupBySource(storedImages, phash),
+	})
+}
+
+func groupBySource(storedImages []*metadata.ImageMetadata, phash imagehash.Hash) []*duplicateSource {
+	bySource := make(map[string]*duplicateSource)
+	sources := make([]*duplicateSource, 0)
+	for _, md := range storedImages {
+		source, ok := bySource[md.OriginalURL]
+		if !ok {
+			source = &duplicateSource{
+				OriginalURL:  md.OriginalURL,
+				SourceSHA256: md.SourceSHA256,
+				PHash:        md.PHash,
+				Distance:     md.PHash.Distance(phash),
+			}
+			bySource[md.OriginalURL] = source
+			sources = append(sources, source)
+		}
+		source.Variants++
+	}
+	sort.SliceStable(sources, func(i, j int) bool {
+		return sources[i].Distance < sources[j].Distance
+	})
+	return sources
+}
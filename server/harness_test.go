@@ -0,0 +1,263 @@
+package http
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/OdyseeTeam/mirage/metadata"
+	"github.com/OdyseeTeam/mirage/optimizer"
+
+	"github.com/OdyseeTeam/gody-cdn/store"
+	"github.com/gin-gonic/gin"
+	"github.com/h2non/bimg"
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const adminToken = "secret"
+
+// vipsAvailable reports whether libvips is there to encode cards and PNGs
+func vipsAvailable() bool {
+	return bimg.IsTypeSupported(bimg.JPEG)
+}
+
+// avifAvailable reports whether libvips was built with an AVIF encoder
+func avifAvailable() bool {
+	return bimg.IsTypeSupportedSave(bimg.AVIF)
+}
+
+func requireVips(t *testing.T) {
+	if !vipsAvailable() {
+		t.Skip("libvips is not available")
+	}
+}
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	logrus.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// memoryStore is an ObjectStore that keeps objects in a map
+type memoryStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{objects: make(map[string][]byte)}
+}
+
+func (m *memoryStore) Has(hash string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.objects[hash]
+	return ok, nil
+}
+
+func (m *memoryStore) Get(hash string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	object, ok := m.objects[hash]
+	if !ok {
+		return nil, errors.Err(store.ErrObjectNotFound)
+	}
+	return object, nil
+}
+
+func (m *memoryStore) Put(hash string, object []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[hash] = object
+	return nil
+}
+
+func (m *memoryStore) Delete(hash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.objects, hash)
+	return nil
+}
+
+// countingOptimizer counts optimizations and quality searches
+type countingOptimizer struct {
+	*optimizer.Optimizer
+	calls    atomic.Int32
+	searches atomic.Int32
+}
+
+func (o *countingOptimizer) ChooseQualitySource(src *optimizer.Source, opts optimizer.Options) (int64, error) {
+	o.searches.Add(1)
+	return o.Optimizer.ChooseQualitySource(src, opts)
+}
+
+func (o *countingOptimizer) OptimizeSource(src *optimizer.Source, opts optimizer.Options) ([]byte, string, string, error) {
+	o.calls.Add(1)
+	return o.Optimizer.OptimizeSource(src, opts)
+}
+
+// origin serves test images and counts the requests it gets per path
+type origin struct {
+	*httptest.Server
+	mu   sync.Mutex
+	hits map[string]int
+	// gate, when not nil, holds /slow.png until it is closed
+	gate chan struct{}
+}
+
+func newOrigin(t *testing.T) *origin {
+	o := &origin{hits: make(map[string]int)}
+	photo := testImage(64, 48)
+	o.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		o.mu.Lock()
+		o.hits[r.URL.Path]++
+		gate := o.gate
+		o.mu.Unlock()
+		switch r.URL.Path {
+		case "/photo.png", "/other.png":
+			w.Header().Set("Content-Type", "image/png")
+			_, _ = w.Write(photo)
+		case "/board.png":
+			w.Header().Set("Content-Type", "image/png")
+			_, _ = w.Write(testBoard)
+		case "/clip.mp4":
+			w.Header().Set("Content-Type", "video/mp4")
+			w.Header().Set("Content-Length", strconv.Itoa(len(testVideo)))
+			_, _ = w.Write(testVideo)
+		case "/drawing.svg":
+			w.Header().Set("Content-Type", "image/svg+xml")
+			_, _ = w.Write([]byte(testSVG))
+		case "/slow.png":
+			if gate != nil {
+				<-gate
+			}
+			_, _ = w.Write(photo)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(o.Close)
+	return o
+}
+
+// testVideo is recognized as an MP4, the frames harness extracts the actual image
+var testVideo = append([]byte("\x00\x00\x00\x18ftypisom\x00\x00\x02\x00isomiso2"), make([]byte, 64*1024)...)
+
+// frames stands in for ffmpeg, returning the test image as every poster frame
+type frames struct {
+	mu      sync.Mutex
+	sources []string
+}
+
+func (f *frames) PosterFrame(source, mimeType string) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sources = append(f.sources, source)
+	return testImage(64, 48), nil
+}
+
+const testSVG = `<svg xmlns="http://www.w3.org/2000/svg" width="40" height="20" onload="alert(1)">
+<script>alert(2)</script><rect width="40" height="20" fill="teal"/></svg>`
+
+func (o *origin) hitsFor(path string) int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.hits[path]
+}
+
+// testImage is a gradient with some noise, which like photos is better off as WebP than as PNG
+func testImage(width, height int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	noise := uint32(1)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			noise = noise*1664525 + 1013904223
+			img.Set(x, y, color.RGBA{R: uint8(128 + 127*math.Sin(float64(x)/5)), G: uint8(y * 5), B: 112 + uint8(noise>>27), A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	_ = png.Encode(&buf, img)
+	return buf.Bytes()
+}
+
+// testBoard is a checkerboard PNG, smaller than any WebP it could be re-encoded to
+var testBoard = func() []byte {
+	img := image.NewPaletted(image.Rect(0, 0, 64, 64), color.Palette{color.Black, color.White})
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			img.SetColorIndex(x, y, uint8((x/2+y/2)%2))
+		}
+	}
+	var buf bytes.Buffer
+	_ = png.Encode(&buf, img)
+	return buf.Bytes()
+}()
+
+// harness is a Server wired to in-memory stores and a local origin
+type harness struct {
+	t         *testing.T
+	server    *Server
+	router    *gin.Engine
+	origin    *origin
+	cache     *memoryStore
+	metadata  *metadata.MemoryStore
+	optimizer *countingOptimizer
+	frames    *frames
+}
+
+func newHarness(t *testing.T) *harness {
+	viper.Set("security.admin_token", adminToken)
+	o, err := optimizer.NewOptimizer(optimizer.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &harness{
+		t:         t,
+		origin:    newOrigin(t),
+		cache:     newMemoryStore(),
+		metadata:  metadata.NewMemoryStore(),
+		optimizer: &countingOptimizer{Optimizer: o},
+		frames:    &frames{},
+	}
+	h.server = NewServer(h.optimizer, h.cache, h.metadata, nil, nil, h.frames)
+	t.Cleanup(h.server.Shutdown)
+	h.router = gin.New()
+	h.router.Use(h.server.errorHandler)
+	h.router.Use(h.server.addCSPHeaders)
+	h.server.installRoutes(h.router, h.router)
+	return h
+}
+
+func (h *harness) do(method, path string, body string, admin bool) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if admin {
+		req.SetBasicAuth("admin", adminToken)
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	rec := httptest.NewRecorder()
+	h.router.ServeHTTP(rec, req)
+	return rec
+}
+
+func (h *harness) get(path string) *httptest.ResponseRecorder {
+	return h.do(http.MethodGet, path, "", false)
+}
+
+func (h *harness) admin(method, path, body string) *httptest.ResponseRecorder {
+	return h.do(method, path, body, true)
+}
@@ -0,0 +1,117 @@
+package http
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultAddress is the address the public routes are served on when none is configured.
+const DefaultAddress = ":6456"
+
+const unixPrefix = "unix:"
+
+// ListenConfig describes where and how the server accepts connections.
+type ListenConfig struct {
+	// Addresses to serve the public routes on. Either host:port or unix:/path/to/socket.
+	Addresses []string
+	// AdminAddresses moves /metrics and /admin to their own listeners when set.
+	AdminAddresses []string
+	// TLSCertFile and TLSKeyFile enable TLS (and HTTP/2) on TCP listeners. They are reloaded on SIGHUP.
+	TLSCertFile string
+	TLSKeyFile  string
+	// H2C enables HTTP/2 over cleartext connections.
+	H2C bool
+}
+
+func isUnixAddress(address string) bool {
+	return strings.HasPrefix(address, unixPrefix)
+}
+
+func listen(address string) (net.Listener, error) {
+	if !isUnixAddress(address) {
+		l, err := net.Listen("tcp", address)
+		return l, errors.Err(err)
+	}
+	path := strings.TrimPrefix(address, unixPrefix)
+	// a stale socket is left behind if the previous process didn't shut down cleanly, anything else at the path is
+	// left alone and fails the listen
+	info, err := os.Lstat(path)
+	if err == nil && info.Mode()&os.ModeSocket != 0 {
+		err = os.Remove(path)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Err(err)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	err = os.Chmod(path, 0660)
+	if err != nil {
+		_ = l.Close()
+		return nil, errors.Err(err)
+	}
+	return l, nil
+}
+
+type certReloader struct {
+	certFile string
+	keyFile  string
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	err := r.reload()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return errors.Err(err)
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.mu.Unlock()
+	return nil
+}
+
+// GetCertificate satisfies tls.Config.GetCertificate
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+func (r *certReloader) reloadOnSighup(stopCh <-chan struct{}) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	defer signal.Stop(sighup)
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-sighup:
+			err := r.reload()
+			if err != nil {
+				// keep serving the previous certificate
+				log.Errorf("failed to reload TLS certificate: %s", errors.FullTrace(err))
+				continue
+			}
+			log.Infof("reloaded TLS certificate from %s", r.certFile)
+		}
+	}
+}
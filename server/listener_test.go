@@ -0,0 +1,88 @@
+package http
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListenUnix(t *testing.T) {
+	dir := t.TempDir()
+	// a socket left behind by a process that didn't shut down cleanly is replaced
+	stale := filepath.Join(dir, "stale.sock")
+	l, err := net.Listen("unix", stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = l.Close()
+	l, err = listen(unixPrefix + stale)
+	if err != nil {
+		t.Fatalf("stale socket: %s", err)
+	}
+	_ = l.Close()
+
+	// anything else is left alone
+	file := filepath.Join(dir, "mirage.conf")
+	err = os.WriteFile(file, []byte("keep"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l, err := listen(unixPrefix + file); err == nil {
+		_ = l.Close()
+		t.Errorf("listened over a regular file")
+	}
+	if data, err := os.ReadFile(file); err != nil || string(data) != "keep" {
+		t.Errorf("the file at the socket path was removed")
+	}
+}
+
+func TestServeClosesEveryListener(t *testing.T) {
+	h := newHarness(t)
+	failing, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a listener that can't accept anymore fails serving
+	_ = failing.Close()
+	srv := &http.Server{Handler: http.NotFoundHandler()}
+	admin := &http.Server{Handler: http.NotFoundHandler()}
+	done := make(chan error, 1)
+	go func() {
+		done <- h.server.serve([]binding{{srv: srv, l: failing, address: "failing"}, {srv: admin, l: other, address: "other"}})
+	}()
+	select {
+	case err = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve kept going after a listener failed")
+	}
+	if err == nil || !strings.Contains(err.Error(), "failing") {
+		t.Errorf("unexpected error %v", err)
+	}
+	if conn, err := net.Dial("tcp", other.Addr().String()); err == nil {
+		_ = conn.Close()
+		t.Error("the other listener is still open")
+	}
+
+	// opening fails as a whole too
+	dir := t.TempDir()
+	file := filepath.Join(dir, "mirage.conf")
+	if err := os.WriteFile(file, []byte("keep"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(dir, "mirage.sock")
+	if _, err := listenAll(nil, srv, []string{unixPrefix + socket, unixPrefix + file}); err == nil {
+		t.Fatal("listened over a regular file")
+	}
+	if _, err := os.Stat(socket); err == nil {
+		t.Error("the socket opened first was left open")
+	}
+}
@@ -0,0 +1,280 @@
+package http
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/OdyseeTeam/mirage/optimizer"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/spf13/viper"
+)
+
+const (
+	svgRasterize   = "rasterize"
+	svgPassthrough = "passthrough"
+)
+
+// imageOptions are the optional settings of a variant. They are given as a comma separated list of name:value pairs
+// in a path segment between the quality and /plain/, e.g. /optimize/s:0:0/quality:85/svg:rasterize/plain/<url>
+type imageOptions struct {
+	// SVG is how SVG sources are handled, svgRasterize or svgPassthrough (sanitized), empty for the route default
+	SVG string `json:"svg,omitempty"`
+	// Filters are given as bl:sigma, sh:amount, grayscale, brightness:n, contrast:n and saturation:n
+	Filters optimizer.Filters `json:"filters"`
+	// Lossless encodes the variant losslessly, given as the lossless flag
+	Lossless bool `json:"lossless,omitempty"`
+	// Jpeg overrides the card.jpeg settings of cards, given as progressive:0|1, subsampling:420|444, trellis:0|1 and
+	// huffman:0|1
+	Jpeg jpegOverrides `json:"jpeg"`
+	// Format is formatPng for PNG output, formatAvif for AVIF output to the clients that accept it, empty for WebP
+	Format string `json:"format,omitempty"`
+	// Png overrides the png settings of PNG output, given as colors:2-256 and dither:0|1. Colors are rounded up to the
+	// palette sizes PNGs are written with.
+	Png pngOverrides `json:"png"`
+	// Kernel overrides the optimizer.resize kernel, given as kernel:nearest|bilinear|catmullrom|lanczos
+	Kernel optimizer.Kernel `json:"kernel,omitempty"`
+	// Linear resizes in linear light, given as the linear flag
+	Linear bool `json:"linear,omitempty"`
+}
+
+const (
+	formatPng  = "png"
+	formatAvif = "avif"
+)
+
+// pngOverrides are the PNG settings given in the url, zero or nil when left to the configuration
+type pngOverrides struct {
+	Colors int   `json:"colors,omitempty"`
+	Dither *bool `json:"dither,omitempty"`
+}
+
+// jpegOverrides are the JPEG settings given in the url, nil or empty when left to the configuration
+type jpegOverrides struct {
+	Progressive *bool  `json:"progressive,omitempty"`
+	Subsampling string `json:"subsampling,omitempty"`
+	Trellis     *bool  `json:"trellis,omitempty"`
+	Huffman     *bool  `json:"huffman,omitempty"`
+}
+
+func (j jpegOverrides) isZero() bool {
+	return j.Progressive == nil && j.Subsampling == "" && j.Trellis == nil && j.Huffman == nil
+}
+
+func parseOptions(segment string) (imageOptions, error) {
+	var opts imageOptions
+	if segment == "" {
+		return opts, nil
+	}
+	for _, option := range strings.Split(segment, ",") {
+		switch option {
+		case "grayscale":
+			opts.Filters.Grayscale = true
+			continue
+		case "lossless":
+			opts.Lossless = true
+			continue
+		case "linear":
+			opts.Linear = true
+			continue
+		}
+		name, value, ok := strings.Cut(option, ":")
+		if !ok {
+			return opts, errors.Err("options should be in the form of name:value, got %q", option)
+		}
+		var err error
+		switch name {
+		case "bl":
+			opts.Filters.Blur, err = parseFilter(name, value, 0, optimizer.MaxBlur)
+		case "sh":
+			opts.Filters.Sharpen, err = parseFilter(name, value, 0, 10)
+		case "brightness":
+			opts.Filters.Brightness, err = parseFilter(name, value, -100, 100)
+		case "contrast":
+			opts.Filters.Contrast, err = parseFilter(name, value, -100, 100)
+		case "saturation":
+			opts.Filters.Saturation, err = parseFilter(name, value, -100, 100)
+		case "svg":
+			if value != svgRasterize && value != svgPassthrough {
+				return opts, errors.Err("svg should be %q or %q", svgRasterize, svgPassthrough)
+			}
+			opts.SVG = value
+		case "progressive":
+			opts.Jpeg.Progressive, err = parseSwitch(name, value)
+		case "subsampling":
+			if value != "420" && value != "444" {
+				return opts, errors.Err("subsampling should be 420 or 444")
+			}
+			opts.Jpeg.Subsampling = value
+		case "trellis":
+			opts.Jpeg.Trellis, err = parseSwitch(name, value)
+		case "huffman":
+			opts.Jpeg.Huffman, err = parseSwitch(name, value)
+		case "format":
+			if value != formatPng && value != formatAvif {
+				return opts, errors.Err("format should be %q or %q", formatPng, formatAvif)
+			}
+			opts.Format = value
+		case "colors":
+			opts.Png.Colors, err = strconv.Atoi(value)
+			if err != nil || opts.Png.Colors < 2 || opts.Png.Colors > 256 {
+				return opts, errors.Err("colors should be a number between 2 and 256")
+			}
+			opts.Png.Colors = optimizer.PaletteSize(opts.Png.Colors)
+		case "dither":
+			opts.Png.Dither, err = parseSwitch(name, value)
+		case "kernel":
+			opts.Kernel, err = optimizer.ParseKernel(value)
+		default:
+			return opts, errors.Err("unknown option %q", name)
+		}
+		if err != nil {
+			return opts, err
+		}
+	}
+	if opts.Format != formatPng && (opts.Png.Colors != 0 || opts.Png.Dither != nil) {
+		return opts, errors.Err("colors and dither only apply to format:png")
+	}
+	return opts, nil
+}
+
+func parseFilter(name, value string, min, max float64) (float64, error) {
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(v) || v < min || v > max {
+		return 0, errors.Err("%s should be a number between %g and %g", name, min, max)
+	}
+	return v, nil
+}
+
+func parseSwitch(name, value string) (*bool, error) {
+	if value != "0" && value != "1" {
+		return nil, errors.Err("%s should be 0 or 1", name)
+	}
+	on := value == "1"
+	return &on, nil
+}
+
+// String is the canonical form of the options, empty when none is set
+func (o imageOptions) String() string {
+	var options []string
+	filter := func(name string, v float64) {
+		if v != 0 {
+			options = append(options, name+":"+strconv.FormatFloat(v, 'f', -1, 64))
+		}
+	}
+	filter("bl", o.Filters.Blur)
+	filter("sh", o.Filters.Sharpen)
+	filter("brightness", o.Filters.Brightness)
+	filter("contrast", o.Filters.Contrast)
+	filter("saturation", o.Filters.Saturation)
+	if o.Filters.Grayscale {
+		options = append(options, "grayscale")
+	}
+	if o.Lossless {
+		options = append(options, "lossless")
+	}
+	if o.SVG != "" {
+		options = append(options, "svg:"+o.SVG)
+	}
+	switches := func(name string, v *bool) {
+		if v == nil {
+			return
+		}
+		value := "0"
+		if *v {
+			value = "1"
+		}
+		options = append(options, name+":"+value)
+	}
+	switches("progressive", o.Jpeg.Progressive)
+	if o.Jpeg.Subsampling != "" {
+		options = append(options, "subsampling:"+o.Jpeg.Subsampling)
+	}
+	switches("trellis", o.Jpeg.Trellis)
+	switches("huffman", o.Jpeg.Huffman)
+	if o.Format != "" {
+		options = append(options, "format:"+o.Format)
+	}
+	if o.Png.Colors != 0 {
+		options = append(options, "colors:"+strconv.Itoa(o.Png.Colors))
+	}
+	switches("dither", o.Png.Dither)
+	if o.Kernel != "" {
+		options = append(options, "kernel:"+string(o.Kernel))
+	}
+	if o.Linear {
+		options = append(options, "linear")
+	}
+	return strings.Join(options, ",")
+}
+
+// segment is the path segment the options are given in, including the leading slash, empty when none is set
+func (o imageOptions) segment() string {
+	if s := o.String(); s != "" {
+		return "/" + s
+	}
+	return ""
+}
+
+// stored are the options the stored object depends on: cards are encoded to JPEG on every request, so all their
+// JPEG settings share one object
+func (o imageOptions) stored() imageOptions {
+	o.Jpeg = jpegOverrides{}
+	return o
+}
+
+// rasterizeSVG resolves the svg option: cards, PNG and AVIF output are always rasterized, /optimize/ follows
+// svg.rasterize by default
+func (p optimizerParams) rasterizeSVG() bool {
+	if p.Card || p.Options.Format != "" {
+		return true
+	}
+	if p.Options.SVG != "" {
+		return p.Options.SVG == svgRasterize
+	}
+	return viper.GetBool("svg.rasterize")
+}
+
+// jpegOptions resolves the JPEG settings of a card: the url overrides card.jpeg
+func (p optimizerParams) jpegOptions(quality int64) (optimizer.JpegOptions, error) {
+	var opts optimizer.JpegOptions
+	err := viper.UnmarshalKey("card.jpeg", &opts)
+	if err != nil {
+		return opts, errors.Err(err)
+	}
+	opts.Quality = quality
+	overrides := p.Options.Jpeg
+	if overrides.Progressive != nil {
+		opts.Progressive = *overrides.Progressive
+	}
+	if overrides.Subsampling != "" {
+		opts.Subsampling = overrides.Subsampling
+	}
+	if overrides.Trellis != nil {
+		opts.Trellis = *overrides.Trellis
+	}
+	if overrides.Huffman != nil {
+		opts.Huffman = *overrides.Huffman
+	}
+	return opts, nil
+}
+
+// pngOptions resolves the PNG settings of a variant, nil for WebP output: the url overrides png
+func (p optimizerParams) pngOptions() (*optimizer.PngOptions, error) {
+	if p.Options.Format != formatPng {
+		return nil, nil
+	}
+	var opts optimizer.PngOptions
+	err := viper.UnmarshalKey("png", &opts)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	if p.Options.Png.Colors != 0 {
+		opts.Colors = p.Options.Png.Colors
+	}
+	if p.Options.Png.Dither != nil {
+		opts.Dither = *p.Options.Png.Dither
+	}
+	return &opts, nil
+}
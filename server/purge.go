@@ -0,0 +1,320 @@
+package http
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OdyseeTeam/mirage/metadata"
+
+	"github.com/OdyseeTeam/gody-cdn/store"
+	"github.com/gin-gonic/gin"
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+type purgeRequest struct {
+	URLs     []string `json:"urls"`
+	Prefixes []string `json:"prefixes"`
+	Hosts    []string `json:"hosts"`
+}
+
+type purgeEntry struct {
+	OriginalURL string `json:"original_url"`
+	GodycdnHash string `json:"godycdn_hash,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+type purgeSummary struct {
+	Purged   []purgeEntry `json:"purged"`
+	Failed   []purgeEntry `json:"failed"`
+	NotFound []string     `json:"not_found"`
+	// SourceInfoPurged counts the sources whose probed information was deleted
+	SourceInfoPurged int64 `json:"source_info_purged"`
+	// NotifyErrors holds the errors returned while propagating the purge downstream
+	NotifyErrors []string `json:"notify_errors,omitempty"`
+}
+
+func newPurgeSummary() *purgeSummary {
+	return &purgeSummary{
+		Purged:   []purgeEntry{},
+		Failed:   []purgeEntry{},
+		NotFound: []string{},
+	}
+}
+
+type purgeJob struct {
+	mu        sync.Mutex
+	id        string
+	total     int
+	processed int
+	done      bool
+	startedAt time.Time
+	summary   *purgeSummary
+}
+
+type purgeJobStatus struct {
+	ID        string        `json:"id"`
+	Done      bool          `json:"done"`
+	Total     int           `json:"total"`
+	Processed int           `json:"processed"`
+	StartedAt time.Time     `json:"started_at"`
+	Summary   *purgeSummary `json:"summary"`
+}
+
+func (j *purgeJob) status() purgeJobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	summary := *j.summary
+	return purgeJobStatus{
+		ID:        j.id,
+		Done:      j.done,
+		Total:     j.total,
+		Processed: j.processed,
+		StartedAt: j.startedAt,
+		Summary:   &summary,
+	}
+}
+
+// purgeVariants removes the given variants from the object store and their metadata, recording the outcome in summary.
+// The public urls of the purged variants are then handed to the purge notifier.
+func (s *Server) purgeVariants(storedImages []*metadata.ImageMetadata, summary *purgeSummary) {
+	var purgedURLs []string
+	defer func() {
+		if s.purgeNotifier == nil || len(purgedURLs) == 0 {
+			return
+		}
+		err := s.purgeNotifier.Notify(purgedURLs)
+		if err != nil {
+			logrus.Errorf("could not notify purge downstream: %s", errors.FullTrace(err))
+			summary.NotifyErrors = append(summary.NotifyErrors, err.Error())
+		}
+	}()
+	purging := make(map[string]bool, len(storedImages))
+	for _, md := range storedImages {
+		purging[md.GodycdnHash] = true
+	}
+	for _, md := range storedImages {
+		logrus.Debugf("deleting %+v", md)
+		entry := purgeEntry{OriginalURL: md.OriginalURL, GodycdnHash: md.GodycdnHash}
+		// aliases don't own the object they point to, the variant they share it with does
+		if !md.IsAlias() {
+			err := s.rehomeAliases(md, purging)
+			if err == nil {
+				err = s.cache.Delete(md.GodycdnHash)
+			}
+			if err != nil {
+				logrus.Errorf("could not prune image: %s", errors.FullTrace(err))
+				entry.Error = err.Error()
+				summary.Failed = append(summary.Failed, entry)
+				continue
+			}
+		}
+		err := s.metadataManager.Delete(md)
+		if err != nil {
+			logrus.Errorf("could not prune image metadata: %s", errors.FullTrace(err))
+			entry.Error = err.Error()
+			summary.Failed = append(summary.Failed, entry)
+			continue
+		}
+		summary.Purged = append(summary.Purged, entry)
+		purgedURLs = append(purgedURLs, publicURLs(md)...)
+	}
+}
+
+// rehomeAliases hands the object of a variant being purged over to the first of its aliases that isn't, and points
+// the others at it. Aliases of an object that is already gone are left to regenerate when next served.
+func (s *Server) rehomeAliases(owner *metadata.ImageMetadata, purging map[string]bool) error {
+	aliases, err := s.metadataManager.RetrieveAllForObjectHash(owner.GodycdnHash)
+	if err != nil {
+		return err
+	}
+	var surviving []*metadata.ImageMetadata
+	for _, alias := range aliases {
+		if !purging[alias.GodycdnHash] {
+			surviving = append(surviving, alias)
+		}
+	}
+	if len(surviving) == 0 {
+		return nil
+	}
+	obj, err := s.cache.Get(owner.GodycdnHash)
+	if err != nil {
+		if strings.Contains(err.Error(), store.ErrObjectNotFound.Error()) {
+			return nil
+		}
+		return err
+	}
+	heir := surviving[0]
+	err = s.cache.Put(heir.GodycdnHash, obj)
+	if err != nil {
+		return err
+	}
+	for _, alias := range surviving {
+		alias.ObjectHash = heir.GodycdnHash
+		if alias == heir {
+			alias.ObjectHash = ""
+		}
+		err = s.metadataManager.Persist(alias)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// purgeSourceInfo deletes what was learned about the sources of the given variants, once per source.
+// A source may be replaced, what was learned about it goes along with its variants.
+func (s *Server) purgeSourceInfo(storedImages []*metadata.ImageMetadata, summary *purgeSummary) {
+	seen := make(map[string]bool, len(storedImages))
+	for _, md := range storedImages {
+		if seen[md.OriginalURL] {
+			continue
+		}
+		seen[md.OriginalURL] = true
+		s.deleteSourceInfo(md.OriginalURL, s.metadataManager.DeleteSourceInfo, summary)
+	}
+}
+
+// deleteSourceInfo deletes the source info selected by value, returning how many sources it covered
+func (s *Server) deleteSourceInfo(value string, remove func(string) (int64, error), summary *purgeSummary) int64 {
+	deleted, err := remove(value)
+	if err != nil {
+		logrus.Errorf("could not prune source info for %s: %s", value, errors.FullTrace(err))
+		return 0
+	}
+	summary.SourceInfoPurged += deleted
+	return deleted
+}
+
+// publicURLs returns the urls a variant can be requested with: the raw source url as the frontend links it,
+// and the escaped one Mirage redirects to. Cards requested with JPEG overrides share the stored variant but not these
+// urls, downstream caches purge those by prefix (see the README).
+func publicURLs(md *metadata.ImageMetadata) []string {
+	base := strings.TrimSuffix(viper.GetString("purge.public_base_url"), "/")
+	if base == "" || md.Variant == "" {
+		return nil
+	}
+	urls := []string{base + md.Variant + "/plain/" + md.OriginalURL}
+	escaped := url.QueryEscape(md.OriginalURL)
+	if escaped != md.OriginalURL {
+		urls = append(urls, base+md.Variant+"/plain/"+escaped)
+	}
+	return urls
+}
+
+// purgeHandler starts an asynchronous purge of every variant matching the requested urls, url prefixes and hosts
+func (s *Server) purgeHandler(c *gin.Context) {
+	var req purgeRequest
+	err := c.ShouldBindJSON(&req)
+	if err != nil {
+		_ = c.AbortWithError(http.StatusBadRequest, errors.Err(err))
+		return
+	}
+	total := len(req.URLs) + len(req.Prefixes) + len(req.Hosts)
+	if total == 0 {
+		_ = c.AbortWithError(http.StatusBadRequest, errors.Err("at least one url, prefix or host is required"))
+		return
+	}
+	id, err := newJobID()
+	if err != nil {
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	job := &purgeJob{
+		id:        id,
+		total:     total,
+		startedAt: time.Now(),
+		summary:   newPurgeSummary(),
+	}
+	err = s.jobs.Set(id, job)
+	if err != nil {
+		_ = c.AbortWithError(http.StatusInternalServerError, errors.Err(err))
+		return
+	}
+	s.grp.Add(1)
+	go func() {
+		defer s.grp.Done()
+		s.runPurgeJob(job, req)
+	}()
+	c.JSON(http.StatusAccepted, job.status())
+}
+
+func (s *Server) runPurgeJob(job *purgeJob, req purgeRequest) {
+	type selector struct {
+		value    string
+		retrieve func(string) ([]*metadata.ImageMetadata, error)
+		// removeInfo deletes the source info of the same urls, which can be there without any variant (e.g. /info)
+		removeInfo func(string) (int64, error)
+	}
+	selectors := make([]selector, 0, job.total)
+	for _, u := range req.URLs {
+		selectors = append(selectors, selector{u, s.metadataManager.RetrieveAllForUrl, s.metadataManager.DeleteSourceInfo})
+	}
+	for _, p := range req.Prefixes {
+		selectors = append(selectors, selector{p, s.metadataManager.RetrieveAllForUrlPrefix, s.metadataManager.DeleteSourceInfoForUrlPrefix})
+	}
+	for _, h := range req.Hosts {
+		selectors = append(selectors, selector{h, s.metadataManager.RetrieveAllForHost, s.metadataManager.DeleteSourceInfoForHost})
+	}
+	defer func() {
+		job.mu.Lock()
+		job.done = true
+		job.mu.Unlock()
+	}()
+	for _, sel := range selectors {
+		select {
+		case <-s.grp.Ch():
+			return
+		default:
+		}
+		partial := newPurgeSummary()
+		infoDeleted := s.deleteSourceInfo(sel.value, sel.removeInfo, partial)
+		storedImages, err := sel.retrieve(sel.value)
+		if err != nil {
+			logrus.Errorf("could not retrieve metadata for %s: %s", sel.value, errors.FullTrace(err))
+			partial.Failed = append(partial.Failed, purgeEntry{OriginalURL: sel.value, Error: err.Error()})
+		} else if len(storedImages) == 0 && infoDeleted == 0 {
+			partial.NotFound = append(partial.NotFound, sel.value)
+		} else {
+			s.purgeVariants(storedImages, partial)
+		}
+		job.mu.Lock()
+		job.processed++
+		job.summary.Purged = append(job.summary.Purged, partial.Purged...)
+		job.summary.Failed = append(job.summary.Failed, partial.Failed...)
+		job.summary.NotFound = append(job.summary.NotFound, partial.NotFound...)
+		job.summary.SourceInfoPurged += partial.SourceInfoPurged
+		job.summary.NotifyErrors = append(job.summary.NotifyErrors, partial.NotifyErrors...)
+		job.mu.Unlock()
+	}
+}
+
+// purgeStatusHandler reports the progress of a purge job
+func (s *Server) purgeStatusHandler(c *gin.Context) {
+	cached, err := s.jobs.Get(c.Param("id"))
+	if err != nil {
+		_ = c.AbortWithError(http.StatusNotFound, errors.Err("purge job not found"))
+		return
+	}
+	job, ok := cached.(*purgeJob)
+	if !ok {
+		_ = c.AbortWithError(http.StatusNotFound, errors.Err("purge job not found"))
+		return
+	}
+	c.JSON(http.StatusOK, job.status())
+}
+
+func newJobID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", errors.Err(err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -7,14 +7,16 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
-	"regexp"
+	"strconv"
 	"strings"
 
-	"github.com/OdyseeTeam/mirage/downloader"
+	"github.com/OdyseeTeam/mirage/blocklist"
 	"github.com/OdyseeTeam/mirage/internal/metrics"
 	"github.com/OdyseeTeam/mirage/metadata"
+	"github.com/OdyseeTeam/mirage/optimizer"
 
 	"github.com/OdyseeTeam/gody-cdn/store"
+	"github.com/gabriel-vasile/mimetype"
 	"github.com/gin-gonic/gin"
 	"github.com/golang/groupcache/singleflight"
 	"github.com/lbryio/lbry.go/v2/extras/errors"
@@ -22,10 +24,41 @@ import (
 )
 
 type optimizerParams struct {
-	Width      int64  `json:"width"`
-	Height     int64  `json:"height"`
-	Quality    int64  `json:"quality"`
-	UrlToProxy string `json:"urlToProxy"`
+	Width      int64        `json:"width"`
+	Height     int64        `json:"height"`
+	Quality    int64        `json:"quality"`
+	UrlToProxy string       `json:"urlToProxy"`
+	Card       bool         `json:"card"`
+	Options    imageOptions `json:"options"`
+	// Reencode never keeps the source and encodes WebP rather than AVIF, for the clients that don't accept those
+	Reencode bool `json:"reencode"`
+}
+
+func (p optimizerParams) cacheKey() string {
+	key := fmt.Sprintf("%s-%d-%d-%s-%t", p.UrlToProxy, p.Width, p.Height, formatQuality(p.Quality), p.Card)
+	// variants without options keep the keys they were cached under before options existed
+	if options := p.Options.stored().String(); options != "" {
+		key += "-" + options
+	}
+	if p.Reencode {
+		key += "-reencode"
+	}
+	return key
+}
+
+// path is the canonical path prefix (everything before /plain/) of the variant as requested, JPEG settings included
+func (p optimizerParams) path() string {
+	route := "optimize"
+	if p.Card {
+		route = "card"
+	}
+	return fmt.Sprintf("/%s/s:%d:%d/quality:%s%s", route, p.Width, p.Height, formatQuality(p.Quality), p.Options.segment())
+}
+
+// variant is the path prefix (everything before /plain/) this variant is publicly served under
+func (p optimizerParams) variant() string {
+	p.Options = p.Options.stored()
+	return p.path()
 }
 
 var sf = singleflight.Group{}
@@ -41,9 +74,12 @@ func (s *Server) noQualityRedirect(c *gin.Context) {
 		_ = c.AbortWithError(http.StatusBadRequest, err)
 		return
 	}
-	urlToProxy := extractUrl(c)
-
-	c.Redirect(http.StatusPermanentRedirect, fmt.Sprintf("/optimize/s:%d:%d/quality:85/plain/%s", width, height, url.QueryEscape(urlToProxy)))
+	params, err := newOptimizerParams(false, width, height, 85, "", extractUrl(c))
+	if err != nil {
+		_ = c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	c.Redirect(http.StatusPermanentRedirect, params.path()+"/plain/"+url.QueryEscape(params.UrlToProxy))
 }
 
 type optimizedImage struct {
@@ -65,23 +101,19 @@ func (s *Server) pruneHandler(c *gin.Context) {
 		_ = c.AbortWithError(http.StatusInternalServerError, errors.Err("could not cast from sf cache"))
 		return
 	}
-	if len(storedImages) == 0 {
+	summary := newPurgeSummary()
+	// source info is kept for urls that were only probed too, those have nothing else to prune
+	infoDeleted := s.deleteSourceInfo(urlToProxy, s.metadataManager.DeleteSourceInfo, summary)
+	if len(storedImages) == 0 && infoDeleted == 0 {
 		_ = c.AbortWithError(http.StatusNotFound, errors.Err("no cached images found for this url"))
 		return
 	}
-	for _, md := range storedImages {
-		logrus.Debugf("deleting %+v", md)
-		err = s.cache.Delete(md.GodycdnHash, nil)
-		if err != nil {
-			logrus.Errorf("could not prune image: %s", errors.FullTrace(err))
-			continue
-		}
-		err = s.metadataManager.Delete(md)
-		if err != nil {
-			logrus.Errorf("could not prune image metadata: %s", errors.FullTrace(err))
-			continue
-		}
+	s.purgeVariants(storedImages, summary)
+	status := http.StatusOK
+	if len(summary.Failed) > 0 {
+		status = http.StatusInternalServerError
 	}
+	c.JSON(status, summary)
 }
 
 func (s *Server) optimizeHandler(c *gin.Context) {
@@ -95,77 +127,196 @@ func (s *Server) optimizeHandler(c *gin.Context) {
 		_ = c.AbortWithError(http.StatusBadRequest, err)
 		return
 	}
-	useJpeg := false
-	re, err := regexp.Compile("^/optimize/")
+	useJpeg := strings.HasPrefix(c.Request.URL.Path, "/card/")
+	params, err := newOptimizerParams(useJpeg, width, height, quality, c.Param("options"), extractUrl(c))
 	if err != nil {
-		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		_ = c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	if handleExceptions(c, params) {
+		return
+	}
+	if entry := s.blocklist.MatchURL(params.UrlToProxy); entry != nil {
+		respondBlocked(c, entry)
 		return
 	}
-	if re.MatchString(c.Request.URL.Path) {
-		if handleExceptions(c, width, height, quality, "/optimize/s:%d:%d/quality:%d/plain/%s") {
+	// AVIF is only served to the clients that accept it, the others get the variant as WebP
+	if params.Options.Format == formatAvif && !acceptsAvif(c) {
+		params.Reencode = true
+	}
+	optimizedDataPtr := s.optimized(c, params)
+	if optimizedDataPtr == nil {
+		return
+	}
+	// a kept source is only served to clients that accept its format, the others get it re-encoded. Either way the
+	// response depends on Accept.
+	variesByAccept := optimizedDataPtr.metadata.KeptSource || params.Options.Format == formatAvif
+	if optimizedDataPtr.metadata.KeptSource && !accepts(c, optimizedDataPtr.metadata.OptimizedMimeType) {
+		params.Reencode = true
+		optimizedDataPtr = s.optimized(c, params)
+		if optimizedDataPtr == nil {
 			return
 		}
-	} else {
-		if handleExceptions(c, width, height, quality, "/card/s:%d:%d/quality:%d/plain/%s") {
+	}
+	key := params.cacheKey()
+	optimizedData := *optimizedDataPtr
+	go func(hash string) {
+		err := s.metadataManager.Touch(hash)
+		if err != nil {
+			logrus.Errorf("could not touch metadata: %s", errors.FullTrace(err))
+		}
+	}(optimizedData.metadata.GodycdnHash)
+	// sanitized SVGs and sources re-encoding didn't shrink are served as they are. Variants cached before the type
+	// was recorded are told by their content.
+	contentType := optimizedData.metadata.OptimizedMimeType
+	if contentType == "" {
+		contentType = mimetype.Detect(*optimizedData.optimizedImage).String()
+	}
+	if useJpeg {
+		if quality == optimizer.AutoQuality {
+			quality = optimizedData.metadata.Quality
+			// variants cached before qualities were recorded
+			if quality <= 0 {
+				quality = optimizer.FallbackQuality
+			}
+		}
+		jpegOptions, err := params.jpegOptions(quality)
+		if err != nil {
+			_ = c.AbortWithError(http.StatusInternalServerError, err)
 			return
 		}
-		useJpeg = true
+		optimized, origMime, optimizedMime, err := s.optimizer.JpegOptimize(*optimizedData.optimizedImage, jpegOptions)
+		if err != nil {
+			_ = s.errorCache.Set(key, err)
+			_ = c.AbortWithError(http.StatusInternalServerError, err)
+			logrus.Errorf("failed to optimize resource with content type: %s", origMime)
+			return
+		}
+		c.Header("Content-Length", fmt.Sprintf("%d", len(optimized)))
+		c.Header("X-mirage-original-mime", origMime)
+		c.Header("X-mirage-godycdn-hash", optimizedData.metadata.GodycdnHash)
+		c.Header("Cache-control", "max-age=31536000")
+		c.Data(200, optimizedMime, optimized)
+		return
 	}
+	served := *optimizedData.optimizedImage
+	// SVGs are sanitized again on the way out, those cached before sanitizing existed were stored as they came
+	if contentType == "image/svg+xml" {
+		served, err = optimizer.SanitizeSVG(served)
+		if err != nil {
+			_ = c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+	}
+	c.Header("Content-Length", fmt.Sprintf("%d", len(served)))
+	c.Header("X-mirage-saved-bytes", fmt.Sprintf("%d", optimizedData.metadata.OriginalSize-optimizedData.metadata.OptimizedSize))
+	c.Header("X-mirage-compression-ratio", fmt.Sprintf("%.2f:1", float64(optimizedData.metadata.OriginalSize)/float64(optimizedData.metadata.OptimizedSize)))
+	c.Header("X-mirage-original-mime", optimizedData.metadata.OriginalMimeType)
+	c.Header("X-mirage-cache-hit", fmt.Sprintf("%t", optimizedData.cacheHit))
+	c.Header("X-mirage-godycdn-hash", optimizedData.metadata.GodycdnHash)
+	if optimizedData.metadata.KeptSource {
+		c.Header("X-mirage-kept-source", "true")
+	}
+	if variesByAccept {
+		c.Header("Vary", "Accept")
+	}
+	c.Header("Cache-control", "max-age=31536000")
+	c.Data(200, contentType, served)
+}
 
-	urlToProxy := extractUrl(c)
-	key := fmt.Sprintf("%s-%d-%d-%d-%t", urlToProxy, width, height, quality, useJpeg)
-
+// optimized returns the variant described by params, or aborts the request and returns nil
+func (s *Server) optimized(c *gin.Context, params optimizerParams) *optimizedImage {
+	key := params.cacheKey()
 	cachedErr, err := s.errorCache.Get(key)
 	if err == nil && cachedErr != nil {
 		val, ok := cachedErr.(error)
 		if ok {
+			if blocked := blockedError(val); blocked != nil {
+				respondBlocked(c, &blocked.Entry)
+				return nil
+			}
 			_ = c.AbortWithError(http.StatusBadRequest, val)
-			return
+			return nil
 		}
 	}
 	metrics.RequestCount.Inc()
 	v, err := sf.Do(key, func() (interface{}, error) {
-		return s.downloadAndOptimize(key, urlToProxy, quality, width, height)
+		return s.downloadAndOptimize(params)
 	})
 	if err != nil {
 		_ = s.errorCache.Set(key, err)
+		if blocked := blockedError(err); blocked != nil {
+			respondBlocked(c, &blocked.Entry)
+			return nil
+		}
 		_ = c.AbortWithError(http.StatusBadRequest, errors.Err(err))
-		return
+		return nil
 	}
 	optimizedDataPtr, ok := v.(*optimizedImage)
 	if !ok {
 		_ = s.errorCache.Set(key, err)
 		_ = c.AbortWithError(http.StatusInternalServerError, errors.Err("could not cast from sf cache"))
-		return
+		return nil
 	}
-	optimizedData := *optimizedDataPtr
-	contentType := "image/webp"
-	if optimizedData.metadata.OriginalMimeType == "image/svg+xml" {
-		contentType = optimizedData.metadata.OriginalMimeType
+	return optimizedDataPtr
+}
+
+// accepts reports whether the Accept header of the request allows mime, which it does when there's none. The most
+// specific range matching mime decides, and a q of 0 refuses it.
+func accepts(c *gin.Context, mime string) bool {
+	accept := c.GetHeader("Accept")
+	if accept == "" {
+		return true
 	}
-	if useJpeg {
-		optimized, origMime, optimizedMime, err := s.optimizer.JpegOptimize(*optimizedData.optimizedImage, quality, width, height)
-		if err != nil {
-			_ = s.errorCache.Set(key, err)
-			_ = c.AbortWithError(http.StatusInternalServerError, err)
-			logrus.Errorf("failed to optimize resource with content type: %s", origMime)
-			return
+	mainType := strings.SplitN(mime, "/", 2)[0]
+	specificity, q := 0, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		accepted := strings.ToLower(strings.TrimSpace(params[0]))
+		matched := 0
+		switch accepted {
+		case mime:
+			matched = 3
+		case mainType + "/*":
+			matched = 2
+		case "*/*":
+			matched = 1
+		}
+		if matched <= specificity {
+			continue
+		}
+		specificity, q = matched, 1
+		for _, param := range params[1:] {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(name, "q") {
+				if v, err := strconv.ParseFloat(value, 64); err == nil {
+					q = v
+				}
+			}
 		}
-		c.Header("Content-Length", fmt.Sprintf("%d", len(optimized)))
-		c.Header("X-mirage-original-mime", origMime)
-		c.Header("X-mirage-godycdn-hash", optimizedData.metadata.GodycdnHash)
-		c.Header("Cache-control", "max-age=31536000")
-		c.Data(200, optimizedMime, optimized)
-		return
 	}
-	c.Header("Content-Length", fmt.Sprintf("%d", len(*optimizedData.optimizedImage)))
-	c.Header("X-mirage-saved-bytes", fmt.Sprintf("%d", optimizedData.metadata.OriginalSize-optimizedData.metadata.OptimizedSize))
-	c.Header("X-mirage-compression-ratio", fmt.Sprintf("%.2f:1", float64(optimizedData.metadata.OriginalSize)/float64(optimizedData.metadata.OptimizedSize)))
-	c.Header("X-mirage-original-mime", optimizedData.metadata.OriginalMimeType)
-	c.Header("X-mirage-cache-hit", fmt.Sprintf("%t", optimizedData.cacheHit))
-	c.Header("X-mirage-godycdn-hash", optimizedData.metadata.GodycdnHash)
-	c.Header("Cache-control", "max-age=31536000")
-	c.Data(200, contentType, *optimizedData.optimizedImage)
+	return q > 0
+}
+
+// acceptsAvif reports whether the Accept header of the request lists image/avif. Browsers send image/* and */*
+// whether or not they decode AVIF, so unlike in accepts the wildcards don't count.
+func acceptsAvif(c *gin.Context) bool {
+	for _, part := range strings.Split(c.GetHeader("Accept"), ",") {
+		params := strings.Split(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(params[0]), "image/avif") {
+			continue
+		}
+		for _, param := range params[1:] {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(name, "q") {
+				if v, err := strconv.ParseFloat(value, 64); err == nil && v <= 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
 }
 
 func (s *Server) recoveryHandler(c *gin.Context, err interface{}) {
@@ -190,27 +341,35 @@ func (s *Server) addCSPHeaders(c *gin.Context) {
 	c.Header("Content-Security-Policy", "script-src 'none'; report-uri https://6fd448c230d0731192f779791c8e45c3.report-uri.com/r/d/csp/enforce; report-to default")
 }
 
-func (s *Server) downloadAndOptimize(cacheKey string, urlToProxy string, quality, width, height int64) (*optimizedImage, error) {
+func (s *Server) downloadAndOptimize(params optimizerParams) (*optimizedImage, error) {
+	cacheKey := params.cacheKey()
+	urlToProxy := params.UrlToProxy
 	h := sha1.New()
 	h.Write([]byte(cacheKey))
 	hashedName := hex.EncodeToString(h.Sum(nil))
-	obj, _, err := s.cache.Get(hashedName, nil)
+	obj, err := s.cache.Get(hashedName)
 	if err == nil {
 		metrics.RequestCachedCount.Inc()
 		md, err := s.metadataManager.Retrieve(hashedName)
+		persisted := md != nil
 		if md == nil {
 			if err != nil {
 				logrus.Errorf("cannot retrieve metadata: %s", errors.FullTrace(err))
 			}
 			md = &metadata.ImageMetadata{
-				OriginalURL:      urlToProxy,
-				GodycdnHash:      hashedName,
-				Checksum:         fmt.Sprintf("%x", sha256.Sum256(obj)),
-				OriginalMimeType: "unknown",
-				OriginalSize:     0,
-				OptimizedSize:    len(obj),
+				OriginalURL:       urlToProxy,
+				GodycdnHash:       hashedName,
+				Checksum:          fmt.Sprintf("%x", sha256.Sum256(obj)),
+				OriginalMimeType:  "unknown",
+				OriginalSize:      0,
+				OptimizedSize:     len(obj),
+				OptimizedMimeType: mimetype.Detect(obj).String(),
+				Variant:           params.variant(),
 			}
 		}
+		if entry := s.blockedContent(md, persisted); entry != nil {
+			return nil, &blocklist.BlockedError{Entry: *entry}
+		}
 		return &optimizedImage{
 			optimizedImage: &obj,
 			metadata:       md,
@@ -220,27 +379,85 @@ func (s *Server) downloadAndOptimize(cacheKey string, urlToProxy string, quality
 	if err != nil && !strings.Contains(err.Error(), store.ErrObjectNotFound.Error()) {
 		return nil, err
 	}
-	image, err := downloader.DownloadFile(urlToProxy, false)
+	aliased, err := s.cachedAlias(hashedName)
 	if err != nil {
 		return nil, err
 	}
-	optimized, origMime, optimizedMime, err := s.optimizer.Optimize(image, quality, width, height)
+	if aliased != nil {
+		metrics.RequestCachedCount.Inc()
+		return aliased, nil
+	}
+	source, image, err := s.downloadSource(urlToProxy)
+	if err != nil {
+		return nil, err
+	}
+	// fingerprinting decodes the source, which the quality search and the optimization reuse
+	src := optimizer.NewSource(image)
+	sourceSHA256, phash := s.optimizer.FingerprintSource(src)
+	if entry := s.blocklist.MatchContent(sourceSHA256, phash); entry != nil {
+		return nil, &blocklist.BlockedError{Entry: *entry}
+	}
+	duplicate, err := s.aliasDuplicate(params, hashedName, sourceSHA256)
+	if err != nil {
+		return nil, err
+	}
+	if duplicate != nil {
+		metrics.DuplicateSources.Inc()
+		return duplicate, nil
+	}
+	opts := optimizer.Options{
+		Quality:      params.Quality,
+		Width:        params.Width,
+		Height:       params.Height,
+		RasterizeSVG: params.rasterizeSVG(),
+		Filters:      params.Options.Filters,
+		Lossless:     params.Options.Lossless,
+		Kernel:       params.Options.Kernel,
+		Linear:       params.Options.Linear,
+		// cards are converted to JPEG from the stored object whatever its format
+		KeepSmallerSource: !params.Card && !params.Reencode,
+	}
+	opts.Avif = params.Options.Format == formatAvif && !params.Reencode
+	opts.Png, err = params.pngOptions()
+	if err != nil {
+		return nil, err
+	}
+	if opts.Quality == optimizer.AutoQuality {
+		opts.Quality, err = s.autoQuality(src, opts, hashedName, sourceSHA256, params.variant())
+		if err != nil {
+			return nil, err
+		}
+	}
+	optimized, origMime, optimizedMime, err := s.optimizer.OptimizeSource(src, opts)
 	if err != nil {
 		logrus.Errorf("failed to optimize resource with content type: %s", origMime)
 		return nil, err
 	}
-	err = s.cache.Put(hashedName, optimized, nil)
+	// PNG output is what was asked for, whether or not it's the source
+	kept := opts.Png == nil && keptSource(origMime, optimizedMime)
+	if source.IsVideo() {
+		origMime = source.MimeType
+	}
+	err = s.cache.Put(hashedName, optimized)
 	if err != nil {
 		logrus.Errorf("error storing %s: %s", cacheKey, errors.FullTrace(err))
 	}
+	outWidth, outHeight := optimizer.Dimensions(optimized)
 	md := &metadata.ImageMetadata{
 		OriginalURL:       urlToProxy,
 		GodycdnHash:       hashedName,
 		Checksum:          fmt.Sprintf("%x", sha256.Sum256(optimized)),
 		OriginalMimeType:  origMime,
-		OriginalSize:      len(image),
+		OriginalSize:      int(max(source.Size, 0)),
 		OptimizedSize:     len(optimized),
 		OptimizedMimeType: optimizedMime,
+		Width:             outWidth,
+		Height:            outHeight,
+		Variant:           params.variant(),
+		SourceSHA256:      sourceSHA256,
+		PHash:             phash,
+		Quality:           opts.Quality,
+		KeptSource:        kept,
 	}
 	err = s.metadataManager.Persist(md)
 	if err != nil {
@@ -252,3 +469,31 @@ func (s *Server) downloadAndOptimize(cacheKey string, urlToProxy string, quality
 		cacheHit:       false,
 	}, nil
 }
+
+// autoQuality returns the quality already picked for this variant of the source, or searches for it
+func (s *Server) autoQuality(src *optimizer.Source, opts optimizer.Options, hashedName, sourceSHA256, variant string) (int64, error) {
+	md, err := s.metadataManager.Retrieve(hashedName)
+	if err != nil {
+		logrus.Errorf("cannot retrieve metadata: %s", errors.FullTrace(err))
+	}
+	if md != nil && md.SourceSHA256 == sourceSHA256 && md.Quality > 0 {
+		return md.Quality, nil
+	}
+	// the same source served from other urls
+	candidates, err := s.metadataManager.RetrieveAllForSourceVariant(sourceSHA256, variant)
+	if err != nil {
+		logrus.Errorf("cannot retrieve metadata: %s", errors.FullTrace(err))
+	}
+	for _, candidate := range candidates {
+		if candidate.Quality > 0 {
+			return candidate.Quality, nil
+		}
+	}
+	return s.optimizer.ChooseQualitySource(src, opts)
+}
+
+// keptSource reports whether Optimize kept the source in a format other than WebP. SVGs are passed through
+// whatever the client accepts, and a kept WebP is served like any other variant.
+func keptSource(origMime, optimizedMime string) bool {
+	return origMime == optimizedMime && optimizedMime != "image/webp" && optimizedMime != "image/svg+xml"
+}
@@ -0,0 +1,564 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/OdyseeTeam/mirage/optimizer"
+
+	"github.com/spf13/viper"
+)
+
+func TestOptimize(t *testing.T) {
+	h := newHarness(t)
+	source := h.origin.URL + "/photo.png"
+	path := "/optimize/s:32:0/quality:80/plain/" + source
+
+	rec := h.get(path)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "image/webp" {
+		t.Errorf("content type is %s", ct)
+	}
+	if rec.Header().Get("X-mirage-cache-hit") != "false" {
+		t.Errorf("first request should miss the cache")
+	}
+	if rec.Header().Get("X-mirage-original-mime") != "image/png" {
+		t.Errorf("original mime is %s", rec.Header().Get("X-mirage-original-mime"))
+	}
+	md, err := h.metadata.Retrieve(rec.Header().Get("X-mirage-godycdn-hash"))
+	if err != nil || md == nil {
+		t.Fatalf("metadata was not persisted: %v", err)
+	}
+	if md.Width != 32 || md.Height != 24 || md.Variant != "/optimize/s:32:0/quality:80" || md.OriginalURL != source {
+		t.Errorf("unexpected metadata %+v", md)
+	}
+
+	rec = h.get(path)
+	if rec.Code != http.StatusOK || rec.Header().Get("X-mirage-cache-hit") != "true" {
+		t.Errorf("second request should hit the cache, got %d %s", rec.Code, rec.Header().Get("X-mirage-cache-hit"))
+	}
+	if hits := h.origin.hitsFor("/photo.png"); hits != 1 {
+		t.Errorf("origin was hit %d times", hits)
+	}
+}
+
+func TestOptimizeBothDimensionsKeepsWidth(t *testing.T) {
+	h := newHarness(t)
+	rec := h.get("/optimize/s:32:32/quality:80/plain/" + h.origin.URL + "/photo.png")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+	}
+	md, _ := h.metadata.Retrieve(rec.Header().Get("X-mirage-godycdn-hash"))
+	if md == nil || md.Width != 32 || md.Height != 24 || md.Variant != "/optimize/s:32:0/quality:80" {
+		t.Errorf("unexpected metadata %+v", md)
+	}
+	// other spellings of the variant are served as they are, from the same cached object
+	rec = h.get("/optimize/s:32:24/quality:080/plain/" + h.origin.URL + "/photo.png")
+	if rec.Code != http.StatusOK || rec.Header().Get("X-mirage-godycdn-hash") != md.GodycdnHash {
+		t.Errorf("got %d for %s", rec.Code, rec.Header().Get("X-mirage-godycdn-hash"))
+	}
+}
+
+func TestCard(t *testing.T) {
+	requireVips(t)
+	h := newHarness(t)
+	rec := h.get("/card/s:32:0/quality:80/plain/" + h.origin.URL + "/photo.png")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "image/jpeg" {
+		t.Errorf("content type is %s", ct)
+	}
+	if bytes.Contains(rec.Body.Bytes(), []byte{0xff, 0xc2}) {
+		t.Error("cards are baseline without card.jpeg")
+	}
+
+	progressive := h.get("/card/s:32:0/quality:80/progressive:1,subsampling:444/plain/" + h.origin.URL + "/photo.png")
+	if progressive.Code != http.StatusOK || !bytes.Contains(progressive.Body.Bytes(), []byte{0xff, 0xc2}) {
+		t.Errorf("progressive card: got %d", progressive.Code)
+	}
+	if progressive.Header().Get("X-mirage-godycdn-hash") != rec.Header().Get("X-mirage-godycdn-hash") || h.optimizer.calls.Load() != 1 {
+		t.Error("jpeg options changed the stored object")
+	}
+	if rec := h.get("/optimize/s:32:0/quality:80/progressive:1/plain/" + h.origin.URL + "/photo.png"); rec.Code != http.StatusBadRequest {
+		t.Errorf("jpeg options on /optimize/: got %d", rec.Code)
+	}
+}
+
+func TestPngOutput(t *testing.T) {
+	requireVips(t)
+	h := newHarness(t)
+	source := h.origin.URL + "/photo.png"
+	rec := h.get("/optimize/s:32:0/quality:80/format:png,colors:16/plain/" + source)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "image/png" || rec.Header().Get("X-mirage-kept-source") != "" {
+		t.Errorf("content type is %s, kept source %q", ct, rec.Header().Get("X-mirage-kept-source"))
+	}
+	img, err := png.Decode(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, ok := img.(*image.Paletted); !ok || len(p.Palette) > 16 || img.Bounds().Dx() != 32 {
+		t.Errorf("decoded as %T of %v", img, img.Bounds())
+	}
+	md, _ := h.metadata.Retrieve(rec.Header().Get("X-mirage-godycdn-hash"))
+	if md == nil || md.OptimizedMimeType != "image/png" || md.Variant != "/optimize/s:32:0/quality:80/format:png,colors:16" {
+		t.Errorf("unexpected metadata %+v", md)
+	}
+	for _, path := range []string{
+		"/card/s:32:0/quality:80/format:png/plain/" + source,
+		"/optimize/s:32:0/quality:80/format:png,svg:passthrough/plain/" + h.origin.URL + "/drawing.svg",
+	} {
+		if rec := h.get(path); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d", path, rec.Code)
+		}
+	}
+}
+
+func TestAvifOutput(t *testing.T) {
+	h := newHarness(t)
+	path := "/optimize/s:32:0/quality:80/format:avif/plain/" + h.origin.URL + "/photo.png"
+	get := func(accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Accept", accept)
+		rec := httptest.NewRecorder()
+		h.router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// browsers send */* whether or not they decode AVIF, only an explicit image/avif gets it
+	for _, accept := range []string{"image/webp,*/*", "image/*", "image/avif;q=0,image/webp"} {
+		rec := get(accept)
+		if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/webp" {
+			t.Fatalf("Accept %q: got %d %s", accept, rec.Code, rec.Header().Get("Content-Type"))
+		}
+		if rec.Header().Get("Vary") != "Accept" {
+			t.Errorf("Accept %q: no Vary in %v", accept, rec.Header())
+		}
+	}
+	if calls := h.optimizer.calls.Load(); calls != 1 {
+		t.Errorf("%d optimizations for the WebP fallback", calls)
+	}
+	if rec := h.get("/optimize/s:32:0/quality:80/format:avif,svg:passthrough/plain/" + h.origin.URL + "/drawing.svg"); rec.Code != http.StatusBadRequest {
+		t.Errorf("svg passthrough: got %d", rec.Code)
+	}
+
+	if !avifAvailable() {
+		t.Skip("libvips can't encode AVIF")
+	}
+	rec := get("image/avif,image/webp,*/*")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/avif" || rec.Header().Get("Vary") != "Accept" {
+		t.Fatalf("expected an AVIF, got %d %v", rec.Code, rec.Header())
+	}
+	md, _ := h.metadata.Retrieve(rec.Header().Get("X-mirage-godycdn-hash"))
+	if md == nil || md.OptimizedMimeType != "image/avif" || md.Variant != "/optimize/s:32:0/quality:80/format:avif" {
+		t.Errorf("unexpected metadata %+v", md)
+	}
+	if rec := get("image/webp"); rec.Header().Get("Content-Type") != "image/webp" {
+		t.Errorf("the AVIF replaced the WebP fallback")
+	}
+}
+
+func TestAutoQuality(t *testing.T) {
+	h := newHarness(t)
+	path := "/optimize/s:32:0/quality:auto/plain/" + h.origin.URL + "/photo.png"
+	rec := h.get(path)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+	}
+	hash := rec.Header().Get("X-mirage-godycdn-hash")
+	md, _ := h.metadata.Retrieve(hash)
+	if md == nil || md.Variant != "/optimize/s:32:0/quality:auto" || md.Quality < 40 || md.Quality > 95 {
+		t.Fatalf("unexpected metadata %+v", md)
+	}
+	params, err := parseVariant(md.Variant)
+	if err != nil || params.Quality != optimizer.AutoQuality {
+		t.Errorf("variant parsed as %+v: %v", params, err)
+	}
+
+	// once the object is evicted, the quality picked the first time is reused
+	_ = h.cache.Delete(hash)
+	rec = h.get(path)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+	}
+	if searches, calls := h.optimizer.searches.Load(), h.optimizer.calls.Load(); searches != 1 || calls != 2 {
+		t.Errorf("%d searches for %d optimizations", searches, calls)
+	}
+
+	// cards are encoded by libvips
+	if vipsAvailable() {
+		rec = h.get("/card/s:32:0/quality:auto/plain/" + h.origin.URL + "/photo.png")
+		if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/jpeg" {
+			t.Errorf("auto quality card: got %d %s", rec.Code, rec.Header().Get("Content-Type"))
+		}
+	}
+	// auto is only requested by name, the value standing for it included
+	for _, quality := range []string{"-1", "0", "101"} {
+		if rec := h.get("/optimize/s:32:0/quality:" + quality + "/plain/" + h.origin.URL + "/photo.png"); rec.Code != http.StatusBadRequest {
+			t.Errorf("quality %s: got %d", quality, rec.Code)
+		}
+	}
+}
+
+func TestKeptSource(t *testing.T) {
+	h := newHarness(t)
+	// losslessly, WebP would beat the PNG
+	o, err := optimizer.NewOptimizer(optimizer.Config{WebP: optimizer.WebPConfig{LossyGraphics: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.optimizer.Optimizer = o
+	path := "/optimize/s:0:0/quality:85/plain/" + h.origin.URL + "/board.png"
+	rec := h.get(path)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/png" || !bytes.Equal(rec.Body.Bytes(), testBoard) {
+		t.Fatalf("expected the source back, got %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if rec.Header().Get("X-mirage-kept-source") != "true" || rec.Header().Get("Vary") != "Accept" {
+		t.Errorf("unexpected headers %v", rec.Header())
+	}
+	md, _ := h.metadata.Retrieve(rec.Header().Get("X-mirage-godycdn-hash"))
+	if md == nil || !md.KeptSource || md.OptimizedMimeType != "image/png" {
+		t.Errorf("unexpected metadata %+v", md)
+	}
+
+	// clients that only take WebP get it re-encoded, under a key of its own
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("Accept", "image/webp")
+	rec = httptest.NewRecorder()
+	h.router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/webp" || rec.Header().Get("X-mirage-kept-source") != "" {
+		t.Fatalf("expected a WebP, got %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if rec.Header().Get("Vary") != "Accept" {
+		t.Errorf("re-encoded variant without Vary: %v", rec.Header())
+	}
+	if calls := h.optimizer.calls.Load(); calls != 2 {
+		t.Errorf("%d optimizations", calls)
+	}
+	for accept, png := range map[string]bool{
+		"image/png;q=0":             false,
+		"image/*, image/png;q=0":    false,
+		"image/webp, image/*;q=0.5": true,
+		"image/*;q=0, */*":          false,
+		"text/html, */*;q=0.8":      true,
+		"image/webp, image/PNG;q=1": true,
+	} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Accept", accept)
+		rec = httptest.NewRecorder()
+		h.router.ServeHTTP(rec, req)
+		if got := rec.Header().Get("Content-Type") == "image/png"; got != png {
+			t.Errorf("Accept %q: got %s", accept, rec.Header().Get("Content-Type"))
+		}
+	}
+	if rec = h.get(path); rec.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("the re-encoded variant replaced the kept source")
+	}
+}
+
+func TestSVG(t *testing.T) {
+	h := newHarness(t)
+	source := h.origin.URL + "/drawing.svg"
+	rec := h.get("/optimize/s:0:0/quality:80/plain/" + source)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "image/svg+xml" {
+		t.Errorf("content type is %s", ct)
+	}
+	if body := rec.Body.String(); strings.Contains(body, "alert") || !strings.Contains(body, "<rect") {
+		t.Errorf("svg was not sanitized: %s", body)
+	}
+
+	rec = h.get("/optimize/s:0:0/quality:80/svg:passthrough/plain/" + source)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+	}
+	md, _ := h.metadata.Retrieve(rec.Header().Get("X-mirage-godycdn-hash"))
+	if md == nil || md.Variant != "/optimize/s:0:0/quality:80/svg:passthrough" {
+		t.Errorf("unexpected metadata %+v", md)
+	}
+	params, err := parseVariant(md.Variant)
+	if err != nil || params.Options.SVG != svgPassthrough {
+		t.Errorf("variant parsed to %+v, %v", params, err)
+	}
+
+	for _, path := range []string{
+		"/card/s:0:0/quality:80/svg:passthrough/plain/" + source,
+		"/optimize/s:0:0/quality:80/svg:maybe/plain/" + source,
+		"/optimize/s:0:0/quality:80/unknown:1/plain/" + source,
+	} {
+		if rec := h.get(path); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d", path, rec.Code)
+		}
+	}
+
+	// variants cached before the optimized type was recorded are served with the type of their content,
+	hash := h.get("/optimize/s:0:0/quality:80/plain/" + source).Header().Get("X-mirage-godycdn-hash")
+	md, _ = h.metadata.Retrieve(hash)
+	legacy := *md
+	legacy.OptimizedMimeType = ""
+	if err := h.metadata.Persist(&legacy); err != nil {
+		t.Fatal(err)
+	}
+	// and passed through unsanitized, which serving sanitizes
+	if err := h.cache.Put(hash, []byte(testSVG)); err != nil {
+		t.Fatal(err)
+	}
+	rec = h.get("/optimize/s:0:0/quality:80/plain/" + source)
+	if ct := rec.Header().Get("Content-Type"); rec.Code != http.StatusOK || !strings.HasPrefix(ct, "image/svg+xml") {
+		t.Errorf("legacy svg served as %s (%d)", ct, rec.Code)
+	}
+	if body := rec.Body.String(); strings.Contains(body, "alert") || !strings.Contains(body, "<rect") {
+		t.Errorf("legacy svg was not sanitized: %s", body)
+	}
+}
+
+func TestVideo(t *testing.T) {
+	h := newHarness(t)
+	source := h.origin.URL + "/clip.mp4"
+	rec := h.get("/optimize/s:32:0/quality:80/plain/" + source)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "image/webp" {
+		t.Errorf("content type is %s", ct)
+	}
+	if mime := rec.Header().Get("X-mirage-original-mime"); mime != "video/mp4" {
+		t.Errorf("original mime is %s", mime)
+	}
+	if len(h.frames.sources) != 1 || h.frames.sources[0] != source {
+		t.Errorf("poster frames were extracted from %v", h.frames.sources)
+	}
+	md, _ := h.metadata.Retrieve(rec.Header().Get("X-mirage-godycdn-hash"))
+	if md == nil || md.Width != 32 || md.OriginalSize != len(testVideo) {
+		t.Errorf("unexpected metadata %+v", md)
+	}
+
+	h.server.frames = nil
+	rec = h.get("/optimize/s:16:0/quality:80/plain/" + source)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("video sources without an extractor: got %d", rec.Code)
+	}
+}
+
+func TestFilterOptions(t *testing.T) {
+	tests := []struct {
+		segment, canonical string
+	}{
+		{"grayscale", "grayscale"},
+		{"grayscale,sh:0.50,bl:5", "bl:5,sh:0.5,grayscale"},
+		{"saturation:-100,brightness:10,contrast:20", "brightness:10,contrast:20,saturation:-100"},
+		{"bl:0", ""},
+		{"svg:rasterize,lossless,grayscale", "grayscale,lossless,svg:rasterize"},
+		{"huffman:0,subsampling:444,progressive:1", "progressive:1,subsampling:444,huffman:0"},
+		{"dither:0,colors:64,format:png", "format:png,colors:256,dither:0"},
+		{"format:png,colors:3", "format:png,colors:4"},
+		{"format:avif", "format:avif"},
+		{"linear,kernel:catmullrom,sh:1", "sh:1,kernel:catmullrom,linear"},
+	}
+	for _, tt := range tests {
+		opts, err := parseOptions(tt.segment)
+		if err != nil {
+			t.Errorf("%s: %s", tt.segment, err)
+			continue
+		}
+		if got := opts.String(); got != tt.canonical {
+			t.Errorf("%s: canonical form is %q, want %q", tt.segment, got, tt.canonical)
+		}
+	}
+	for _, segment := range []string{"bl:-1", "bl:x", "bl:51", "sh:11", "contrast:101", "brightness:NaN", "grayscale:1", "lossless:1", "progressive:yes", "subsampling:422",
+		"format:gif", "colors:64", "format:png,colors:1", "format:png,colors:257", "format:avif,colors:4",
+		"kernel:lanczos2", "kernel:", "linear:1"} {
+		if _, err := parseOptions(segment); err == nil {
+			t.Errorf("%s: expected an error", segment)
+		}
+	}
+
+	h := newHarness(t)
+	source := h.origin.URL + "/photo.png"
+	plain := h.get("/optimize/s:32:0/quality:80/plain/" + source)
+	blurred := h.get("/optimize/s:32:0/quality:80/bl:4,grayscale/plain/" + source)
+	if plain.Code != http.StatusOK || blurred.Code != http.StatusOK {
+		t.Fatalf("got %d and %d", plain.Code, blurred.Code)
+	}
+	if plain.Header().Get("X-mirage-godycdn-hash") == blurred.Header().Get("X-mirage-godycdn-hash") {
+		t.Error("filtered variant shares the cache key of the plain one")
+	}
+	if plain.Body.String() == blurred.Body.String() {
+		t.Error("filters were not applied")
+	}
+}
+
+func TestBadParams(t *testing.T) {
+	h := newHarness(t)
+	for _, path := range []string{
+		"/optimize/s:32/quality:80/plain/https://example.com/a.png",
+		"/optimize/s:a:0/quality:80/plain/https://example.com/a.png",
+		"/optimize/s:32:0/quality:high/plain/https://example.com/a.png",
+		"/optimize/s:32/plain/https://example.com/a.png",
+		"/optimize/s:-32:0/quality:80/plain/https://example.com/a.png",
+		"/optimize/s:0:20000/plain/https://example.com/a.png",
+	} {
+		if rec := h.get(path); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d", path, rec.Code)
+		}
+	}
+}
+
+func TestRedirects(t *testing.T) {
+	h := newHarness(t)
+	source := "https://example.com/a.png?size=large&v=2"
+	tests := []struct {
+		path, location string
+	}{
+		{"/optimize/plain/" + source, "/optimize/s:0:0/quality:85/plain/" + url.QueryEscape(source)},
+		{"/optimize/s:10:0/plain/" + source, "/optimize/s:10:0/quality:85/plain/" + url.QueryEscape(source)},
+	}
+	for _, tt := range tests {
+		rec := h.get(tt.path)
+		if rec.Code != http.StatusPermanentRedirect {
+			t.Errorf("%s: got %d", tt.path, rec.Code)
+		}
+		if location := rec.Header().Get("Location"); location != tt.location {
+			t.Errorf("%s: redirected to %s, want %s", tt.path, location, tt.location)
+		}
+	}
+}
+
+func TestHandleExceptions(t *testing.T) {
+	h := newHarness(t)
+	viper.Set("redirect_special", true)
+	t.Cleanup(func() { viper.Set("redirect_special", false) })
+	const optimize = "/optimize/s:10:0/quality:80/plain/"
+	tests := []struct {
+		name     string
+		path     string
+		status   int
+		location string
+	}{
+		{"imgur", optimize + "https://i.imgur.com/abc.png", http.StatusTemporaryRedirect, "https://i.imgur.com/abc.png"},
+		{"malformed spee.ch", optimize + "https://spee.ch/view/abc123/name.jpg", http.StatusTemporaryRedirect,
+			optimize + url.QueryEscape("https://player.odycdn.com/speech/name:abc123.jpg")},
+		{"single slash scheme", optimize + "https:/thumbnails.lbry.com/a.png", http.StatusPermanentRedirect,
+			optimize + url.QueryEscape("https://thumbnails.lbry.com/a.png")},
+		{"@webp suffix", optimize + "https://example.com/a.png@webp", http.StatusPermanentRedirect,
+			optimize + url.QueryEscape("https://example.com/a.png")},
+		{"double dot extension", optimize + "https://example.com/a..jpeg", http.StatusPermanentRedirect,
+			optimize + url.QueryEscape("https://example.com/a")},
+		{"decommissioned proxy", optimize + "https://lbry-boost.org/redirect-event?source=https://example.com/a.png", http.StatusPermanentRedirect,
+			optimize + url.QueryEscape("https://example.com/a.png")},
+		{"recursion", optimize + "https://thumbnails.odycdn.com/optimize/s:0:0/quality:85/plain/https://example.com/a.png", http.StatusPermanentRedirect,
+			optimize + url.QueryEscape("https://example.com/a.png")},
+		{"malformed recursion", optimize + "https://thumbnails.odycdn.com/a.png", http.StatusBadRequest, ""},
+		{"card keeps its route", "/card/s:10:0/quality:80/plain/https://example.com/a.png@webp", http.StatusPermanentRedirect,
+			"/card/s:10:0/quality:80/plain/" + url.QueryEscape("https://example.com/a.png")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := h.get(tt.path)
+			if rec.Code != tt.status {
+				t.Errorf("got %d, want %d", rec.Code, tt.status)
+			}
+			if location := rec.Header().Get("Location"); location != tt.location {
+				t.Errorf("redirected to %q, want %q", location, tt.location)
+			}
+		})
+	}
+}
+
+func TestSingleflight(t *testing.T) {
+	h := newHarness(t)
+	h.origin.gate = make(chan struct{})
+	path := "/optimize/s:16:0/quality:80/plain/" + h.origin.URL + "/slow.png"
+	var wg sync.WaitGroup
+	codes := make([]int, 5)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = h.get(path).Code
+		}(i)
+	}
+	for h.origin.hitsFor("/slow.png") == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// give the other requests time to join the one in flight
+	time.Sleep(50 * time.Millisecond)
+	close(h.origin.gate)
+	wg.Wait()
+	for i, code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("request %d got %d", i, code)
+		}
+	}
+	if hits := h.origin.hitsFor("/slow.png"); hits != 1 {
+		t.Errorf("origin was hit %d times", hits)
+	}
+	if calls := h.optimizer.calls.Load(); calls != 1 {
+		t.Errorf("optimizer ran %d times", calls)
+	}
+}
+
+func TestErrorCache(t *testing.T) {
+	h := newHarness(t)
+	path := "/optimize/s:16:0/quality:80/plain/" + h.origin.URL + "/missing.png"
+	for i := 0; i < 3; i++ {
+		if rec := h.get(path); rec.Code != http.StatusBadRequest {
+			t.Errorf("request %d got %d", i, rec.Code)
+		}
+	}
+	if hits := h.origin.hitsFor("/missing.png"); hits != 1 {
+		t.Errorf("origin was hit %d times, errors should be cached", hits)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	h := newHarness(t)
+	source := h.origin.URL + "/photo.png"
+	for _, path := range []string{"/optimize/s:16:0/quality:80/plain/", "/optimize/s:32:0/quality:80/plain/"} {
+		if rec := h.get(path + source); rec.Code != http.StatusOK {
+			t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+		}
+	}
+	if rec := h.get("/admin/prune/" + source); rec.Code != http.StatusUnauthorized {
+		t.Errorf("prune without credentials got %d", rec.Code)
+	}
+	rec := h.admin(http.MethodGet, "/admin/prune/"+source, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+	}
+	var summary purgeSummary
+	if err := json.Unmarshal(rec.Body.Bytes(), &summary); err != nil {
+		t.Fatal(err)
+	}
+	if len(summary.Purged) != 2 || len(summary.Failed) != 0 {
+		t.Errorf("unexpected summary %+v", summary)
+	}
+	if len(h.cache.objects) != 0 {
+		t.Errorf("%d objects left in the cache", len(h.cache.objects))
+	}
+	if left, _ := h.metadata.RetrieveAllForUrl(source); len(left) != 0 {
+		t.Errorf("%d variants left in metadata", len(left))
+	}
+	if rec := h.admin(http.MethodGet, "/admin/prune/"+source, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("pruning again got %d", rec.Code)
+	}
+	if rec := h.get("/optimize/s:16:0/quality:80/plain/" + source); rec.Header().Get("X-mirage-cache-hit") != "false" {
+		t.Errorf("pruned variant was served from cache")
+	}
+}
@@ -2,11 +2,16 @@ package http
 
 import (
 	"context"
+	"crypto/tls"
+	"net"
 	"net/http"
 	"time"
 
+	"github.com/OdyseeTeam/mirage/blocklist"
+	"github.com/OdyseeTeam/mirage/internal/imagehash"
 	"github.com/OdyseeTeam/mirage/internal/metrics"
 	"github.com/OdyseeTeam/mirage/metadata"
+	"github.com/OdyseeTeam/mirage/notifier"
 	"github.com/OdyseeTeam/mirage/optimizer"
 
 	"github.com/OdyseeTeam/gody-cdn/store"
@@ -14,29 +19,97 @@ import (
 	nice "github.com/ekyoung/gin-nice-recovery"
 	"github.com/gin-contrib/pprof"
 	"github.com/gin-gonic/gin"
+	"github.com/lbryio/lbry.go/v2/extras/errors"
 	"github.com/lbryio/lbry.go/v2/extras/stop"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
+// ImageOptimizer turns source images into the variants served. *optimizer.Optimizer is the production implementation.
+type ImageOptimizer interface {
+	OptimizeSource(src *optimizer.Source, opts optimizer.Options) (optimized []byte, originalContentType, optimizedContentType string, err error)
+	JpegOptimize(data []byte, opts optimizer.JpegOptions) (optimized []byte, originalContentType, optimizedContentType string, err error)
+	ChooseQualitySource(src *optimizer.Source, opts optimizer.Options) (int64, error)
+	FingerprintSource(src *optimizer.Source) (checksum string, phash imagehash.Hash)
+	Analyze(data []byte) (*optimizer.Analysis, error)
+}
+
+// ObjectStore keeps the optimized variants. Get returns an error wrapping store.ErrObjectNotFound for the hashes it
+// doesn't have. NewObjectStore adapts gody-cdn's stores to it.
+type ObjectStore interface {
+	Has(hash string) (bool, error)
+	Get(hash string) ([]byte, error)
+	Put(hash string, object []byte) error
+	Delete(hash string) error
+}
+
+// godycdnStore is an ObjectStore backed by a gody-cdn store
+type godycdnStore struct {
+	store store.ObjectStore
+}
+
+// NewObjectStore returns an ObjectStore that keeps the variants in s
+func NewObjectStore(s store.ObjectStore) ObjectStore {
+	return godycdnStore{store: s}
+}
+
+func (g godycdnStore) Has(hash string) (bool, error) {
+	return g.store.Has(hash, nil)
+}
+
+func (g godycdnStore) Get(hash string) ([]byte, error) {
+	object, _, err := g.store.Get(hash, nil)
+	return object, err
+}
+
+func (g godycdnStore) Put(hash string, object []byte) error {
+	return g.store.Put(hash, object, nil)
+}
+
+func (g godycdnStore) Delete(hash string) error {
+	return g.store.Delete(hash, nil)
+}
+
+// FrameExtractor turns video sources into images. *video.Extractor is the production implementation.
+type FrameExtractor interface {
+	PosterFrame(source, mimeType string) ([]byte, error)
+}
+
 // Server is an instance of a peer server that houses the listener and store.
 type Server struct {
 	grp             *stop.Group
-	optimizer       *optimizer.Optimizer
-	cache           store.ObjectStore
-	metadataManager *metadata.Manager
+	optimizer       ImageOptimizer
+	cache           ObjectStore
+	metadataManager metadata.Store
 	errorCache      gcache.Cache
+	jobs            gcache.Cache
+	purgeNotifier   notifier.Notifier
+	blocklist       *blocklist.Blocklist
+	frames          FrameExtractor
+	// fingerprints queues the cached variants to fingerprint, fingerprinted keeps them from being queued again
+	fingerprints  chan fingerprintJob
+	fingerprinted gcache.Cache
 }
 
-// NewServer returns an initialized Server pointer.
-func NewServer(optimizer *optimizer.Optimizer, cache store.ObjectStore, metadataManager *metadata.Manager) *Server {
-	return &Server{
+// NewServer returns an initialized Server pointer. purgeNotifier, blocklist and frames can be nil, video sources
+// are rejected without the latter.
+func NewServer(optimizer ImageOptimizer, cache ObjectStore, metadataManager metadata.Store, purgeNotifier notifier.Notifier, blocklist *blocklist.Blocklist, frames FrameExtractor) *Server {
+	s := &Server{
 		grp:             stop.New(),
 		optimizer:       optimizer,
 		cache:           cache,
 		metadataManager: metadataManager,
+		purgeNotifier:   purgeNotifier,
+		blocklist:       blocklist,
+		frames:          frames,
 		errorCache:      gcache.New(10000).Expiration(2 * time.Minute).Build(),
+		jobs:            gcache.New(1000).Expiration(24 * time.Hour).Build(),
+		fingerprints:    make(chan fingerprintJob, fingerprintQueueSize),
+		fingerprinted:   gcache.New(fingerprintQueueSize).Expiration(10 * time.Minute).Build(),
 	}
+	s.grp.Add(1)
+	go s.fingerprintVariants()
+	return s
 }
 
 // Shutdown gracefully shuts down the peer server.
@@ -46,49 +119,173 @@ func (s *Server) Shutdown() {
 	log.Debug("HTTP server stopped")
 }
 
-// Start starts the server listener to handle connections.
-func (s *Server) Start(address string) error {
+// Start serves on every configured address until the server is shut down, returning nil then. All the listeners are
+// opened before anything is served, so that a bad address fails Start right away. If any listener stops serving, all
+// of them are closed and its error is returned.
+func (s *Server) Start(cfg ListenConfig) error {
+	public := s.newRouter(cfg.H2C)
+	admin := public
+	if len(cfg.AdminAddresses) > 0 {
+		admin = s.newRouter(cfg.H2C)
+	}
+	metrics.InstallRoute(public, admin)
+	s.installRoutes(public, admin)
+
+	tlsConfig, err := s.tlsConfig(cfg)
+	if err != nil {
+		return err
+	}
+	addresses := cfg.Addresses
+	if len(addresses) == 0 {
+		addresses = []string{DefaultAddress}
+	}
+	bindings, err := listenAll(nil, &http.Server{Handler: public.Handler(), TLSConfig: tlsConfig}, addresses)
+	if err != nil {
+		return err
+	}
+	if admin != public {
+		bindings, err = listenAll(bindings, &http.Server{Handler: admin.Handler(), TLSConfig: tlsConfig}, cfg.AdminAddresses)
+		if err != nil {
+			return err
+		}
+	}
+	return s.serve(bindings)
+}
+
+// installRoutes registers the public routes on public and the admin ones on admin, which can be the same router
+func (s *Server) installRoutes(public, admin *gin.Engine) {
+	//https://thumbnails.odycdn.com/optimize/s:100:0/quality:85/plain/https://thumbnails.lbry.com/UCX_t3BvnQtS5IHzto_y7tbw
+	public.GET("/optimize/:dimensions/quality:quality/plain/*url", s.optimizeHandler)
+	public.GET("/optimize/:dimensions/quality:quality/:options/plain/*url", s.optimizeHandler)
+	public.GET("/card/:dimensions/quality:quality/plain/*url", s.optimizeHandler)
+	public.GET("/card/:dimensions/quality:quality/:options/plain/*url", s.optimizeHandler)
+	public.GET("/optimize/:dimensions/plain/*url", s.noQualityRedirect)
+	public.GET("/optimize/plain/*url", s.simpleRedirect)
+	public.GET("/placeholder/plain/*url", s.placeholderHandler)
+	public.GET("/info/plain/*url", s.infoHandler)
+	rg := admin.Group("/admin", gin.BasicAuth(gin.Accounts{"admin": viper.GetString("security.admin_token")}))
+	pprof.RouteRegister(rg, "pprof")
+	rg.GET("/prune/*url", s.pruneHandler)
+	rg.POST("/purge", s.purgeHandler)
+	rg.GET("/purge/:id", s.purgeStatusHandler)
+	rg.POST("/warm", s.warmHandler)
+	rg.GET("/warm/:id", s.warmStatusHandler)
+	rg.GET("/variants/*url", s.variantsHandler)
+	rg.GET("/hash/:hash", s.hashHandler)
+	rg.GET("/duplicates", s.duplicatesHandler)
+	rg.GET("/blocklist", s.blocklistListHandler)
+	rg.POST("/blocklist", s.blocklistAddHandler)
+	rg.DELETE("/blocklist", s.blocklistRemoveHandler)
+}
+
+func (s *Server) newRouter(useH2C bool) *gin.Engine {
 	//gin.SetMode(gin.ReleaseMode)
 	router := gin.New()
+	router.UseH2C = useH2C
 	router.Use(gin.Logger())
 	router.Use(s.errorHandler)
 	router.Use(nice.Recovery(s.recoveryHandler))
 	router.Use(s.addCSPHeaders)
-	metrics.InstallRoute(router)
-	//https://thumbnails.odycdn.com/optimize/s:100:0/quality:85/plain/https://thumbnails.lbry.com/UCX_t3BvnQtS5IHzto_y7tbw
-	router.GET("/optimize/:dimensions/quality:quality/plain/*url", s.optimizeHandler)
-	router.GET("/card/:dimensions/quality:quality/plain/*url", s.optimizeHandler)
-	router.GET("/optimize/:dimensions/plain/*url", s.noQualityRedirect)
-	router.GET("/optimize/plain/*url", s.simpleRedirect)
-	rg := router.Group("/admin", gin.BasicAuth(gin.Accounts{"admin": viper.GetString("security.admin_token")}))
-	pprof.RouteRegister(rg, "pprof")
-	rg.GET("/prune/*url", s.pruneHandler)
+	return router
+}
+
+// binding is a listener and the server serving on it
+type binding struct {
+	srv     *http.Server
+	l       net.Listener
+	address string
+}
 
-	srv := &http.Server{
-		Addr:    address,
-		Handler: router,
+// listenAll opens a listener for srv on each address, appending them to bindings. If any fails, every listener of
+// bindings is closed.
+func listenAll(bindings []binding, srv *http.Server, addresses []string) ([]binding, error) {
+	for _, address := range addresses {
+		l, err := listen(address)
+		if err != nil {
+			for _, b := range bindings {
+				_ = b.l.Close()
+			}
+			return nil, err
+		}
+		bindings = append(bindings, binding{srv: srv, l: l, address: address})
 	}
-	go s.listenForShutdown(srv)
-	// Initializing the server in a goroutine so that
-	// it won't block the graceful shutdown handling below
+	return bindings, nil
+}
+
+// serve serves on each binding until the server is shut down or a listener fails, in which case all of them are closed
+// and the error returned
+func (s *Server) serve(bindings []binding) error {
 	s.grp.Add(1)
-	go func() {
-		defer s.grp.Done()
-		log.Println("HTTP server listening on " + address)
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("listen: %s\n", err)
+	defer s.grp.Done()
+	errs := make(chan error, len(bindings))
+	var servers []*http.Server
+	for _, b := range bindings {
+		if len(servers) == 0 || servers[len(servers)-1] != b.srv {
+			servers = append(servers, b.srv)
 		}
-	}()
-	return nil
+		useTLS := b.srv.TLSConfig != nil && !isUnixAddress(b.address)
+		go func(b binding) {
+			var err error
+			if useTLS {
+				log.Println("HTTPS server listening on " + b.address)
+				err = b.srv.ServeTLS(b.l, "", "")
+			} else {
+				log.Println("HTTP server listening on " + b.address)
+				err = b.srv.Serve(b.l)
+			}
+			if err == http.ErrServerClosed {
+				err = nil
+			}
+			if err != nil {
+				err = errors.Err("serving on %s: %s", b.address, err)
+			}
+			errs <- err
+		}(b)
+	}
+	received := 0
+	var failure error
+	select {
+	case <-s.grp.Ch():
+		// The context is used to inform the servers they have 5 seconds to finish
+		// the requests they are currently handling
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		for _, srv := range servers {
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Errorf("server forced to shutdown: %s", err)
+			}
+		}
+	case failure = <-errs:
+		received++
+		log.Errorf("closing every listener: %s", failure)
+		for _, srv := range servers {
+			_ = srv.Close()
+		}
+	}
+	// serving on closed listeners returns right away
+	for ; received < len(bindings); received++ {
+		if err := <-errs; failure == nil {
+			failure = err
+		}
+	}
+	return failure
 }
 
-func (s *Server) listenForShutdown(listener *http.Server) {
-	<-s.grp.Ch()
-	// The context is used to inform the server it has 5 seconds to finish
-	// the request it is currently handling
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	if err := listener.Shutdown(ctx); err != nil {
-		log.Fatal("Server forced to shutdown:", err)
+func (s *Server) tlsConfig(cfg ListenConfig) (*tls.Config, error) {
+	if cfg.TLSCertFile == "" && cfg.TLSKeyFile == "" {
+		return nil, nil
 	}
+	reloader, err := newCertReloader(cfg.TLSCertFile, cfg.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	s.grp.Add(1)
+	go func() {
+		defer s.grp.Done()
+		reloader.reloadOnSighup(s.grp.Ch())
+	}()
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}, nil
 }
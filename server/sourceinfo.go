@@ -0,0 +1,183 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/OdyseeTeam/mirage/blocklist"
+	"github.com/OdyseeTeam/mirage/downloader"
+	"github.com/OdyseeTeam/mirage/metadata"
+	"github.com/OdyseeTeam/mirage/optimizer"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/sirupsen/logrus"
+)
+
+type placeholderResponse struct {
+	Width         int    `json:"width"`
+	Height        int    `json:"height"`
+	DominantColor string `json:"dominant_color"`
+	BlurHash      string `json:"blurhash"`
+	ThumbHash     string `json:"thumbhash"`
+	LQIP          string `json:"lqip"`
+}
+
+// placeholderHandler returns the placeholders, dimensions and dominant color of a source
+func (s *Server) placeholderHandler(c *gin.Context) {
+	info := s.sourceInfoFor(c)
+	if info == nil {
+		return
+	}
+	c.JSON(http.StatusOK, placeholderResponse{
+		Width:         info.Width,
+		Height:        info.Height,
+		DominantColor: info.DominantColor,
+		BlurHash:      info.BlurHash,
+		ThumbHash:     info.ThumbHash,
+		LQIP:          info.LQIP,
+	})
+}
+
+// infoHandler returns everything known about a source
+func (s *Server) infoHandler(c *gin.Context) {
+	info := s.sourceInfoFor(c)
+	if info == nil {
+		return
+	}
+	c.JSON(http.StatusOK, info)
+}
+
+// sourceInfoFor returns the info about the source requested, or aborts the request and returns nil
+func (s *Server) sourceInfoFor(c *gin.Context) *metadata.SourceInfo {
+	urlToProxy := extractUrl(c)
+	if entry := s.blocklist.MatchURL(urlToProxy); entry != nil {
+		respondBlockedInfo(c, entry)
+		return nil
+	}
+	key := "info-" + urlToProxy
+	cachedErr, err := s.errorCache.Get(key)
+	if err == nil && cachedErr != nil {
+		if val, ok := cachedErr.(error); ok {
+			if blocked := blockedError(val); blocked != nil {
+				respondBlockedInfo(c, &blocked.Entry)
+				return nil
+			}
+			_ = c.AbortWithError(http.StatusBadRequest, val)
+			return nil
+		}
+	}
+	v, err := sf.Do(key, func() (interface{}, error) {
+		return s.sourceInfo(urlToProxy)
+	})
+	if err != nil {
+		_ = s.errorCache.Set(key, err)
+		if blocked := blockedError(err); blocked != nil {
+			respondBlockedInfo(c, &blocked.Entry)
+			return nil
+		}
+		_ = c.AbortWithError(http.StatusBadRequest, errors.Err(err))
+		return nil
+	}
+	info, ok := v.(*metadata.SourceInfo)
+	if !ok {
+		_ = c.AbortWithError(http.StatusInternalServerError, errors.Err("could not cast from sf cache"))
+		return nil
+	}
+	// sources can be purged and replaced, unlike variants these answers aren't immutable
+	c.Header("Cache-control", "max-age=86400")
+	return info
+}
+
+// respondBlockedInfo is respondBlocked for the JSON endpoints, which have no use for a placeholder image
+func respondBlockedInfo(c *gin.Context, entry *blocklist.Entry) {
+	c.Header("X-mirage-blocked", string(entry.Kind))
+	c.AbortWithStatus(http.StatusUnavailableForLegalReasons)
+}
+
+// sourceInfo returns what is known about a source, downloading and analyzing it the first time only. Stale info is
+// recomputed, and served as it is while the source can't be downloaded or analyzed.
+func (s *Server) sourceInfo(urlToProxy string) (*metadata.SourceInfo, error) {
+	info, err := s.metadataManager.RetrieveSourceInfo(urlToProxy)
+	if err != nil {
+		logrus.Errorf("cannot retrieve source info: %s", errors.FullTrace(err))
+	}
+	if info != nil {
+		if entry := s.blocklist.MatchContent(info.SourceSHA256, info.PHash); entry != nil {
+			return nil, &blocklist.BlockedError{Entry: *entry}
+		}
+		if !info.Stale {
+			return info, nil
+		}
+	}
+	fresh, err := s.analyzeSource(urlToProxy)
+	if err != nil {
+		if info != nil && blockedError(err) == nil {
+			logrus.Warnf("serving stale source info for %s: %s", urlToProxy, errors.FullTrace(err))
+			return info, nil
+		}
+		return nil, err
+	}
+	return fresh, nil
+}
+
+// analyzeSource downloads and analyzes a source and stores what it found
+func (s *Server) analyzeSource(urlToProxy string) (*metadata.SourceInfo, error) {
+	source, image, err := s.downloadSource(urlToProxy)
+	if err != nil {
+		return nil, err
+	}
+	sourceSHA256, phash := s.optimizer.FingerprintSource(optimizer.NewSource(image))
+	if entry := s.blocklist.MatchContent(sourceSHA256, phash); entry != nil {
+		return nil, &blocklist.BlockedError{Entry: *entry}
+	}
+	analysis, err := s.optimizer.Analyze(image)
+	if err != nil {
+		return nil, err
+	}
+	info := &metadata.SourceInfo{
+		URL:           urlToProxy,
+		SourceSHA256:  sourceSHA256,
+		MimeType:      source.MimeType,
+		Size:          source.Size,
+		Width:         analysis.Width,
+		Height:        analysis.Height,
+		Frames:        analysis.Frames,
+		DurationMs:    analysis.Duration.Milliseconds(),
+		HasAlpha:      analysis.HasAlpha,
+		Orientation:   analysis.Orientation,
+		DominantColor: analysis.DominantColor,
+		AverageColor:  analysis.AverageColor,
+		PHash:         phash,
+		BlurHash:      analysis.BlurHash,
+		ThumbHash:     analysis.ThumbHash,
+		LQIP:          analysis.LQIP,
+	}
+	// poster frames describe the video as far as dimensions go, but they are not its frames
+	if source.IsVideo() {
+		info.Frames, info.DurationMs = 0, 0
+	}
+	err = s.metadataManager.PersistSourceInfo(info)
+	if err != nil {
+		logrus.Errorf("failed to persist source info for %s: %s", urlToProxy, errors.FullTrace(err))
+	}
+	return info, nil
+}
+
+// downloadSource downloads a source and returns it along with the image to work on, its poster frame for videos
+func (s *Server) downloadSource(urlToProxy string) (*downloader.Source, []byte, error) {
+	source, err := downloader.Download(urlToProxy)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !source.IsVideo() {
+		return source, source.Data, nil
+	}
+	if s.frames == nil {
+		return nil, nil, errors.Err("%s sources are not supported", source.MimeType)
+	}
+	frame, err := s.frames.PosterFrame(urlToProxy, source.MimeType)
+	if err != nil {
+		return nil, nil, err
+	}
+	return source, frame, nil
+}
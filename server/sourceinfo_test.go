@@ -0,0 +1,140 @@
+package http
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/OdyseeTeam/mirage/blocklist"
+	"github.com/OdyseeTeam/mirage/metadata"
+)
+
+func TestSourceInfo(t *testing.T) {
+	h := newHarness(t)
+	source := h.origin.URL + "/photo.png"
+	for i := 0; i < 2; i++ {
+		rec := h.get("/placeholder/plain/" + source)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+		}
+		var info placeholderResponse
+		decode(t, rec.Body.Bytes(), &info)
+		if info.Width != 64 || info.Height != 48 {
+			t.Errorf("unexpected source info %+v", info)
+		}
+		// 4x3 components: size flag, max AC, 4 characters of DC and 2 per AC component
+		if len(info.BlurHash) != 28 {
+			t.Errorf("unexpected blurhash %q", info.BlurHash)
+		}
+		if info.ThumbHash == "" || len(info.DominantColor) != 7 || !strings.HasPrefix(info.LQIP, "data:image/webp;base64,") {
+			t.Errorf("unexpected placeholders %+v", info)
+		}
+	}
+	if hits := h.origin.hitsFor("/photo.png"); hits != 1 {
+		t.Errorf("the source was downloaded %d times", hits)
+	}
+
+	rec := h.get("/info/plain/" + source)
+	var info metadata.SourceInfo
+	decode(t, rec.Body.Bytes(), &info)
+	if info.MimeType != "image/png" || info.Size != int64(len(testImage(64, 48))) || info.Frames != 1 || info.HasAlpha || info.PHash == 0 {
+		t.Errorf("unexpected source info %+v", info)
+	}
+	if hits := h.origin.hitsFor("/photo.png"); hits != 1 {
+		t.Errorf("the info endpoint downloaded the source again")
+	}
+
+	h.get("/optimize/s:16:0/quality:80/plain/" + source)
+	h.admin(http.MethodGet, "/admin/prune/"+source, "")
+	if info, _ := h.metadata.RetrieveSourceInfo(source); info != nil {
+		t.Errorf("source info survived a prune")
+	}
+
+	// sources that were only probed have nothing cached but their info, which prunes and purges still delete
+	probed := h.origin.URL + "/other.png"
+	h.get("/info/plain/" + probed)
+	if rec := h.admin(http.MethodGet, "/admin/prune/"+probed, ""); rec.Code != http.StatusOK {
+		t.Errorf("pruning the info of a source got %d: %s", rec.Code, rec.Body.String())
+	}
+	if info, _ := h.metadata.RetrieveSourceInfo(probed); info != nil {
+		t.Errorf("source info survived a prune")
+	}
+	if rec := h.admin(http.MethodGet, "/admin/prune/"+probed, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("pruning again got %d", rec.Code)
+	}
+	h.get("/info/plain/" + probed)
+	h.get("/info/plain/" + h.origin.URL + "/board.png")
+	rec = h.admin(http.MethodPost, "/admin/purge", `{"prefixes": ["`+h.origin.URL+`/"]}`)
+	var status purgeJobStatus
+	decode(t, rec.Body.Bytes(), &status)
+	h.waitFor(func() bool {
+		rec = h.admin(http.MethodGet, "/admin/purge/"+status.ID, "")
+		decode(t, rec.Body.Bytes(), &status)
+		return status.Done
+	})
+	if status.Summary.SourceInfoPurged != 2 || len(status.Summary.NotFound) != 0 {
+		t.Errorf("unexpected purge status %s", rec.Body.String())
+	}
+	if info, _ := h.metadata.RetrieveSourceInfo(probed); info != nil {
+		t.Errorf("source info survived a purge")
+	}
+}
+
+func TestSourceInfoBlockedByContent(t *testing.T) {
+	h := newHarness(t)
+	h.server.blocklist = blocklist.NewMemory(4)
+	source := h.origin.URL + "/photo.png"
+	rec := h.get("/info/plain/" + source)
+	var info metadata.SourceInfo
+	decode(t, rec.Body.Bytes(), &info)
+
+	// entries added elsewhere apply to the stored info by perceptual hash too
+	if _, err := h.server.blocklist.Add(blocklist.Entry{Kind: blocklist.KindPHash, Value: (info.PHash ^ 1).String()}); err != nil {
+		t.Fatal(err)
+	}
+	if rec := h.get("/info/plain/" + source); rec.Code != http.StatusUnavailableForLegalReasons {
+		t.Errorf("stored info of a blocked source got %d", rec.Code)
+	}
+
+	// adding an entry deletes the info of sources that were only probed
+	h.server.blocklist = blocklist.NewMemory(4)
+	rec = h.admin(http.MethodPost, "/admin/blocklist", `{"kind": "sha256", "value": "`+info.SourceSHA256+`"}`)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"source_info_purged":1`) {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+	}
+	if info, _ := h.metadata.RetrieveSourceInfo(source); info != nil {
+		t.Errorf("source info survived a content entry")
+	}
+}
+
+func TestStaleSourceInfo(t *testing.T) {
+	h := newHarness(t)
+	// rows stored before sources were described further are recomputed when next requested
+	source := h.origin.URL + "/photo.png"
+	if err := h.metadata.PersistSourceInfo(&metadata.SourceInfo{URL: source, MimeType: "image/png", Width: 64, Height: 48, Stale: true}); err != nil {
+		t.Fatal(err)
+	}
+	rec := h.get("/info/plain/" + source)
+	var info metadata.SourceInfo
+	decode(t, rec.Body.Bytes(), &info)
+	if info.PHash == 0 || info.Frames != 1 || info.AverageColor == "" {
+		t.Errorf("stale info wasn't recomputed: %+v", info)
+	}
+	if stored, _ := h.metadata.RetrieveSourceInfo(source); stored == nil || stored.Stale {
+		t.Errorf("the recomputed info wasn't stored: %+v", stored)
+	}
+
+	// and served as they are while the source is gone
+	gone := h.origin.URL + "/gone.png"
+	if err := h.metadata.PersistSourceInfo(&metadata.SourceInfo{URL: gone, MimeType: "image/png", Width: 10, Height: 10, Stale: true}); err != nil {
+		t.Fatal(err)
+	}
+	rec = h.get("/info/plain/" + gone)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+	}
+	decode(t, rec.Body.Bytes(), &info)
+	if info.Width != 10 {
+		t.Errorf("unexpected source info %+v", info)
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/OdyseeTeam/mirage/optimizer"
+
 	"github.com/gin-gonic/gin"
 	"github.com/lbryio/lbry.go/v2/extras/errors"
 	"github.com/spf13/viper"
@@ -18,13 +20,21 @@ func getOptimizationParams(c *gin.Context) (width int64, height int64, quality i
 	if err != nil {
 		return width, height, 0, err
 	}
-	quality, err = strconv.ParseInt(strings.TrimPrefix(c.Param("quality"), ":"), 10, 32)
+	quality, err = optimizer.ParseQuality(strings.TrimPrefix(c.Param("quality"), ":"))
 	if err != nil {
-		return width, height, quality, errors.Err(err)
+		return width, height, quality, err
 	}
 	return width, height, quality, nil
 }
 
+// formatQuality is the inverse of optimizer.ParseQuality
+func formatQuality(quality int64) string {
+	if quality == optimizer.AutoQuality {
+		return "auto"
+	}
+	return strconv.FormatInt(quality, 10)
+}
+
 func getDimensions(c *gin.Context) (width int64, height int64, err error) {
 	dimensions := strings.Split(c.Param("dimensions"), ":")
 	if len(dimensions) != 3 {
@@ -38,69 +48,127 @@ func getDimensions(c *gin.Context) (width int64, height int64, err error) {
 	if err != nil {
 		return width, 0, errors.Err(err)
 	}
+	return width, height, nil
+}
+
+// maxDimension is the largest width or height a variant is resized to, the most WebP can encode
+const maxDimension = 16383
+
+// newOptimizerParams validates a variant as requested in a url or a warm item and resolves it to the params it is
+// generated with
+func newOptimizerParams(card bool, width, height, quality int64, options string, urlToProxy string) (optimizerParams, error) {
+	if width < 0 || width > maxDimension || height < 0 || height > maxDimension {
+		return optimizerParams{}, errors.Err("width and height should be between 0 and %d", maxDimension)
+	}
+	if quality != optimizer.AutoQuality && (quality < 1 || quality > 100) {
+		return optimizerParams{}, errors.Err("quality should be a number between 1 and 100 or auto")
+	}
 	//the frontend is requesting something it doesn't actually want.... this forces us to hardcode it here
 	//TODO: get rid of this and have the frontend NOT pass both params
 	//this will also mess up the caches as things will be cached with improper parameters
 	if width != 0 && height != 0 {
 		height = 0
 	}
-	return width, height, nil
+	opts, err := parseOptions(options)
+	if err != nil {
+		return optimizerParams{}, err
+	}
+	if card {
+		if opts.SVG == svgPassthrough {
+			return optimizerParams{}, errors.Err("cards are always rasterized")
+		}
+		if opts.Format != "" {
+			return optimizerParams{}, errors.Err("cards are always JPEG")
+		}
+	} else {
+		if !opts.Jpeg.isZero() {
+			return optimizerParams{}, errors.Err("jpeg options only apply to cards")
+		}
+		if opts.Format != "" && opts.SVG == svgPassthrough {
+			return optimizerParams{}, errors.Err("%s output is always rasterized", opts.Format)
+		}
+	}
+	return optimizerParams{
+		Width:      width,
+		Height:     height,
+		Quality:    quality,
+		UrlToProxy: urlToProxy,
+		Card:       card,
+		Options:    opts,
+	}, nil
+}
+
+// sourceRewrite is where a source that can't be proxied as given is found instead
+type sourceRewrite struct {
+	URL    string
+	Status int
+	// Direct sends clients to URL itself rather than to the variant of it
+	Direct bool
 }
 
-func handleExceptions(c *gin.Context, width int64, height int64, quality int64, path string) (redirected bool) {
-	urlToProxy := extractUrl(c)
+// rewriteSource handles the sources known to be broken or not to be proxied, nil means urlToProxy is fine as it is.
+// raw is the source as given in the path, without the query string.
+func rewriteSource(urlToProxy string, raw string) (*sourceRewrite, error) {
 	imgurUrl := regexp.MustCompile(`^https?://i?\.?imgur\.com/.+?$`)
 	// temporarily disable imgur proxying because of throttling
 	if viper.GetBool("redirect_special") && imgurUrl.MatchString(urlToProxy) {
-		c.Redirect(http.StatusTemporaryRedirect, urlToProxy)
-		return true
+		return &sourceRewrite{URL: urlToProxy, Status: http.StatusTemporaryRedirect, Direct: true}, nil
 	}
 	malformedSpeechUrl := strings.Index(urlToProxy, "https://spee.ch/") == 0
 	if malformedSpeechUrl {
 		urlToProxy = strings.TrimPrefix(urlToProxy, "https://spee.ch/")
 		if parts := regexp.MustCompile(`^(view/)?([a-f0-9]+)/(.*?)\.(.*)$`).FindStringSubmatch(urlToProxy); parts != nil {
-			c.Redirect(http.StatusTemporaryRedirect, fmt.Sprintf(path, width, height, quality, url.QueryEscape(fmt.Sprintf("https://player.odycdn.com/speech/%s:%s.%s", parts[3], parts[2], parts[4]))))
-			return true
+			return &sourceRewrite{URL: fmt.Sprintf("https://player.odycdn.com/speech/%s:%s.%s", parts[3], parts[2], parts[4]), Status: http.StatusTemporaryRedirect}, nil
 		}
 	}
 	malformedShttpsUrl := strings.Index(urlToProxy, "https:/t") == 0
 	if malformedShttpsUrl {
 		urlToProxy = strings.ReplaceAll(urlToProxy, "https:/t", "https://t")
-		c.Redirect(http.StatusPermanentRedirect, fmt.Sprintf(path, width, height, quality, url.QueryEscape(urlToProxy)))
-		return true
+		return &sourceRewrite{URL: urlToProxy, Status: http.StatusPermanentRedirect}, nil
 	}
 	atWebp := strings.HasSuffix(urlToProxy, "@webp")
 	if atWebp {
 		urlToProxy = strings.TrimSuffix(urlToProxy, "@webp")
-		c.Redirect(http.StatusPermanentRedirect, fmt.Sprintf(path, width, height, quality, url.QueryEscape(urlToProxy)))
-		return true
+		return &sourceRewrite{URL: urlToProxy, Status: http.StatusPermanentRedirect}, nil
 	}
 	oldSpeechBug := strings.HasSuffix(urlToProxy, "..jpeg") || strings.HasSuffix(urlToProxy, "..png")
 	if oldSpeechBug {
 		urlToProxy = strings.TrimSuffix(urlToProxy, "..jpeg")
 		urlToProxy = strings.TrimSuffix(urlToProxy, "..png")
-		c.Redirect(http.StatusPermanentRedirect, fmt.Sprintf(path, width, height, quality, url.QueryEscape(urlToProxy)))
-		return true
+		return &sourceRewrite{URL: urlToProxy, Status: http.StatusPermanentRedirect}, nil
 	}
 	decommissionedProxy := strings.Contains(urlToProxy, "https://lbry-boost.org/redirect-event?source=")
 	if decommissionedProxy {
 		urlToProxy = strings.Replace(urlToProxy, "https://lbry-boost.org/redirect-event?source=", "", -1)
-		c.Redirect(http.StatusPermanentRedirect, fmt.Sprintf(path, width, height, quality, url.QueryEscape(urlToProxy)))
-		return true
+		return &sourceRewrite{URL: urlToProxy, Status: http.StatusPermanentRedirect}, nil
 	}
-	recursionUrlToProxy := strings.TrimPrefix(c.Param("url"), "/")
-	hasRecursion := strings.Contains(recursionUrlToProxy, "https://thumbnails.odycdn.com")
+	hasRecursion := strings.Contains(raw, "https://thumbnails.odycdn.com")
 	if hasRecursion {
-		cutIndex := strings.LastIndex(recursionUrlToProxy, "plain/") + 6
+		cutIndex := strings.LastIndex(raw, "plain/") + 6
 		if cutIndex > 6 {
-			urlToProxy = recursionUrlToProxy[cutIndex:len(recursionUrlToProxy)]
-			c.Redirect(http.StatusPermanentRedirect, fmt.Sprintf(path, width, height, quality, url.QueryEscape(urlToProxy)))
-			return true
+			return &sourceRewrite{URL: raw[cutIndex:], Status: http.StatusPermanentRedirect}, nil
 		}
-		_ = c.AbortWithError(http.StatusBadRequest, errors.Err("malformed recursive URL"))
+		return nil, errors.Err("malformed recursive URL")
+	}
+	return nil, nil
+}
+
+// handleExceptions redirects the requests for sources rewriteSource rewrites, or aborts them
+func handleExceptions(c *gin.Context, params optimizerParams) (redirected bool) {
+	rewrite, err := rewriteSource(params.UrlToProxy, strings.TrimPrefix(c.Param("url"), "/"))
+	if err != nil {
+		_ = c.AbortWithError(http.StatusBadRequest, err)
+		return true
+	}
+	if rewrite == nil {
+		return false
+	}
+	if rewrite.Direct {
+		c.Redirect(rewrite.Status, rewrite.URL)
 		return true
 	}
-	return false
+	c.Redirect(rewrite.Status, params.path()+"/plain/"+url.QueryEscape(rewrite.URL))
+	return true
 }
 
 func extractUrl(c *gin.Context) string {
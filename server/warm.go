@@ -0,0 +1,344 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OdyseeTeam/mirage/optimizer"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// WarmItem is a source url and the variant of it to generate
+type WarmItem struct {
+	URL    string `json:"url"`
+	Width  int64  `json:"width"`
+	Height int64  `json:"height"`
+	// Quality is 85 when left out, -1 for auto
+	Quality int64 `json:"quality"`
+	Card    bool  `json:"card"`
+	// Options are given as in the url, e.g. "svg:rasterize"
+	Options string `json:"options,omitempty"`
+}
+
+// params validates the item like the url of the variant would be, sources rewritten for requests are warmed
+// rewritten
+func (i WarmItem) params() (optimizerParams, error) {
+	quality := i.Quality
+	if quality == 0 {
+		quality = 85
+	}
+	params, err := newOptimizerParams(i.Card, i.Width, i.Height, quality, i.Options, i.URL)
+	if err != nil {
+		return params, err
+	}
+	rewrite, err := rewriteSource(params.UrlToProxy, params.UrlToProxy)
+	if err != nil {
+		return params, err
+	}
+	if rewrite != nil {
+		if rewrite.Direct {
+			return params, errors.Err("source is not proxied")
+		}
+		params.UrlToProxy = rewrite.URL
+	}
+	return params, nil
+}
+
+// ParseWarmItems reads either a JSON array of items, or one item per line as a JSON object or a bare url
+func ParseWarmItems(r io.Reader) ([]WarmItem, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	data = bytes.TrimSpace(data)
+	var items []WarmItem
+	if bytes.HasPrefix(data, []byte("[")) {
+		err = json.Unmarshal(data, &items)
+		return items, errors.Err(err)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var item WarmItem
+		if strings.HasPrefix(line, "{") {
+			err = json.Unmarshal([]byte(line), &item)
+			if err != nil {
+				return nil, errors.Err(err)
+			}
+		} else {
+			item.URL = line
+		}
+		items = append(items, item)
+	}
+	return items, errors.Err(scanner.Err())
+}
+
+// WarmOptions bounds how hard warming hits the origins
+type WarmOptions struct {
+	// Concurrency is the number of variants generated at once
+	Concurrency int `json:"concurrency"`
+	// Rate is the maximum number of variants started per second, 0 means unlimited
+	Rate float64 `json:"rate"`
+}
+
+// WarmFailure is an item that could not be generated
+type WarmFailure struct {
+	WarmItem
+	Error string `json:"error"`
+}
+
+// WarmProgress reports how far a warm run got
+type WarmProgress struct {
+	Total     int           `json:"total"`
+	Processed int           `json:"processed"`
+	Cached    int           `json:"cached"`
+	Generated int           `json:"generated"`
+	Failed    []WarmFailure `json:"failed"`
+	Done      bool          `json:"done"`
+}
+
+// RecentWarmItems returns the n most recently served variants, for replaying them into an empty cache
+func (s *Server) RecentWarmItems(n int) ([]WarmItem, error) {
+	recent, err := s.metadataManager.RetrieveRecentlyServed(n)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]WarmItem, 0, len(recent))
+	for _, md := range recent {
+		params, err := parseVariant(md.Variant)
+		if err != nil {
+			logrus.Warnf("skipping %s: %s", md.GodycdnHash, err)
+			continue
+		}
+		items = append(items, WarmItem{
+			URL:     md.OriginalURL,
+			Width:   params.Width,
+			Height:  params.Height,
+			Quality: params.Quality,
+			Card:    params.Card,
+			Options: params.Options.String(),
+		})
+	}
+	return items, nil
+}
+
+// Warm generates every item that isn't cached yet. progress, if not nil, is called after each item, one call at a
+// time.
+func (s *Server) Warm(items []WarmItem, opts WarmOptions, progress func(WarmProgress)) WarmProgress {
+	if opts.Concurrency < 1 {
+		opts.Concurrency = 1
+	}
+	var throttle <-chan time.Time
+	if opts.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / opts.Rate))
+		defer ticker.Stop()
+		throttle = ticker.C
+	}
+	var mu sync.Mutex
+	state := WarmProgress{Total: len(items), Failed: []WarmFailure{}}
+	queue := make(chan WarmItem)
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range queue {
+				cacheHit, err := s.warmItem(item)
+				mu.Lock()
+				state.Processed++
+				switch {
+				case err != nil:
+					state.Failed = append(state.Failed, WarmFailure{WarmItem: item, Error: err.Error()})
+				case cacheHit:
+					state.Cached++
+				default:
+					state.Generated++
+				}
+				// reported under mu, so that progress is published in order
+				if progress != nil {
+					progress(state)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+dispatch:
+	for _, item := range items {
+		if throttle != nil {
+			select {
+			case <-throttle:
+			case <-s.grp.Ch():
+				break dispatch
+			}
+		}
+		select {
+		case queue <- item:
+		case <-s.grp.Ch():
+			break dispatch
+		}
+	}
+	close(queue)
+	wg.Wait()
+	state.Done = true
+	if progress != nil {
+		progress(state)
+	}
+	return state
+}
+
+func (s *Server) warmItem(item WarmItem) (cacheHit bool, err error) {
+	if item.URL == "" {
+		return false, errors.Err("url is required")
+	}
+	params, err := item.params()
+	if err != nil {
+		return false, err
+	}
+	if entry := s.blocklist.MatchURL(params.UrlToProxy); entry != nil {
+		return false, errors.Err("source is blocked (%s %s)", entry.Kind, entry.Value)
+	}
+	v, err := sf.Do(params.cacheKey(), func() (interface{}, error) {
+		return s.downloadAndOptimize(params)
+	})
+	if err != nil {
+		return false, err
+	}
+	optimized, ok := v.(*optimizedImage)
+	if !ok {
+		return false, errors.Err("could not cast from sf cache")
+	}
+	return optimized.cacheHit, nil
+}
+
+type warmRequest struct {
+	WarmOptions
+	Items []WarmItem `json:"items"`
+	// Recent replays the given number of most recently served variants
+	Recent int `json:"recent"`
+}
+
+type warmJob struct {
+	mu        sync.Mutex
+	id        string
+	startedAt time.Time
+	progress  WarmProgress
+}
+
+func (j *warmJob) status() gin.H {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return gin.H{
+		"id":         j.id,
+		"started_at": j.startedAt,
+		"progress":   j.progress,
+	}
+}
+
+// warmHandler starts warming the cache with the given items and/or the most recently served variants
+func (s *Server) warmHandler(c *gin.Context) {
+	var req warmRequest
+	err := c.ShouldBindJSON(&req)
+	if err != nil {
+		_ = c.AbortWithError(http.StatusBadRequest, errors.Err(err))
+		return
+	}
+	items := req.Items
+	if req.Recent > 0 {
+		recent, err := s.RecentWarmItems(req.Recent)
+		if err != nil {
+			_ = c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		items = append(items, recent...)
+	}
+	if len(items) == 0 {
+		_ = c.AbortWithError(http.StatusBadRequest, errors.Err("nothing to warm"))
+		return
+	}
+	id, err := newJobID()
+	if err != nil {
+		_ = c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	job := &warmJob{
+		id:        id,
+		startedAt: time.Now(),
+		progress:  WarmProgress{Total: len(items), Failed: []WarmFailure{}},
+	}
+	err = s.jobs.Set(id, job)
+	if err != nil {
+		_ = c.AbortWithError(http.StatusInternalServerError, errors.Err(err))
+		return
+	}
+	s.grp.Add(1)
+	go func() {
+		defer s.grp.Done()
+		s.Warm(items, req.WarmOptions, func(p WarmProgress) {
+			job.mu.Lock()
+			job.progress = p
+			job.mu.Unlock()
+		})
+	}()
+	c.JSON(http.StatusAccepted, job.status())
+}
+
+func (s *Server) warmStatusHandler(c *gin.Context) {
+	cached, err := s.jobs.Get(c.Param("id"))
+	if err != nil {
+		_ = c.AbortWithError(http.StatusNotFound, errors.Err("warm job not found"))
+		return
+	}
+	job, ok := cached.(*warmJob)
+	if !ok {
+		_ = c.AbortWithError(http.StatusNotFound, errors.Err("warm job not found"))
+		return
+	}
+	c.JSON(http.StatusOK, job.status())
+}
+
+// parseVariant is the inverse of optimizerParams.variant
+func parseVariant(variant string) (optimizerParams, error) {
+	var params optimizerParams
+	// route, dimensions, quality and the optional options
+	parts := strings.Split(strings.TrimPrefix(variant, "/"), "/")
+	if len(parts) != 3 && len(parts) != 4 {
+		return params, errors.Err("malformed variant %q", variant)
+	}
+	route := parts[0]
+	var quality string
+	_, err := fmt.Sscanf(parts[1]+"/"+parts[2], "s:%d:%d/quality:%s", &params.Width, &params.Height, &quality)
+	if err != nil {
+		return params, errors.Err("malformed variant %q: %s", variant, err)
+	}
+	params.Quality, err = optimizer.ParseQuality(quality)
+	if err != nil {
+		return params, errors.Err("malformed variant %q: %s", variant, err)
+	}
+	if len(parts) == 4 {
+		params.Options, err = parseOptions(parts[3])
+		if err != nil {
+			return params, err
+		}
+	}
+	switch route {
+	case "optimize":
+	case "card":
+		params.Card = true
+	default:
+		return params, errors.Err("unknown route in variant %q", variant)
+	}
+	return params, nil
+}
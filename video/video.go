@@ -0,0 +1,198 @@
+package video
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/png"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/OdyseeTeam/mirage/downloader"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Config tunes poster frame extraction, the zero value uses the defaults
+type Config struct {
+	// FFmpegPath is the ffmpeg binary, looked up in the PATH by default
+	FFmpegPath string `mapstructure:"ffmpeg_path"`
+	// Timestamp is where the poster frame is taken, 3s in by default
+	Timestamp time.Duration `mapstructure:"timestamp"`
+	// Attempts is how many frames, Skip apart, are tried when they are black. 4 by default.
+	Attempts int `mapstructure:"attempts"`
+	// Skip is how far to move past a black frame, 2s by default
+	Skip time.Duration `mapstructure:"skip"`
+	// Timeout bounds each ffmpeg run, 20s by default
+	Timeout time.Duration `mapstructure:"timeout"`
+	// Deadline bounds the whole extraction, all attempts included, 30s by default. Past it the black frame found so
+	// far, if any, is the poster frame.
+	Deadline time.Duration `mapstructure:"deadline"`
+}
+
+// Extractor takes poster frames out of videos with ffmpeg
+type Extractor struct {
+	cfg Config
+}
+
+func NewExtractor(cfg Config) *Extractor {
+	if cfg.FFmpegPath == "" {
+		cfg.FFmpegPath = "ffmpeg"
+	}
+	if cfg.Timestamp == 0 {
+		cfg.Timestamp = 3 * time.Second
+	}
+	if cfg.Attempts < 1 {
+		cfg.Attempts = 4
+	}
+	if cfg.Skip == 0 {
+		cfg.Skip = 2 * time.Second
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 20 * time.Second
+	}
+	if cfg.Deadline == 0 {
+		cfg.Deadline = 30 * time.Second
+	}
+	return &Extractor{cfg: cfg}
+}
+
+// demuxers are the ffmpeg input formats of the video types mimetype detects. ffmpeg is always told which one to use,
+// since left to probe a url it would also accept playlists (HLS, concat) pointing at local files or internal hosts.
+var demuxers = map[string]string{
+	"video/mp4":        "mov",
+	"video/x-m4v":      "mov",
+	"video/quicktime":  "mov",
+	"video/3gpp":       "mov",
+	"video/3gpp2":      "mov",
+	"video/webm":       "matroska",
+	"video/x-matroska": "matroska",
+	"video/x-msvideo":  "avi",
+	"video/x-flv":      "flv",
+	"video/mpeg":       "mpeg",
+	"video/ogg":        "ogg",
+	"video/x-ms-asf":   "asf",
+}
+
+// PosterFrame returns the first frame that isn't black starting at the configured timestamp, encoded as a PNG.
+// source is handed to ffmpeg as is, so for urls it only downloads the ranges it needs to seek to the frame.
+// mimeType is the type detected from the first bytes of the source, which picks the demuxer. Videos shorter than the
+// timestamp get their first frame.
+func (e *Extractor) PosterFrame(source, mimeType string) ([]byte, error) {
+	demuxer, ok := demuxers[mimeType]
+	if !ok {
+		return nil, errors.Err("%s videos are not supported", mimeType)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), e.cfg.Deadline)
+	defer cancel()
+	var fallback []byte
+	for i := 0; i < e.cfg.Attempts; i++ {
+		frame, err := e.frameAt(ctx, source, demuxer, e.cfg.Timestamp+time.Duration(i)*e.cfg.Skip)
+		if err != nil {
+			if ctx.Err() != nil && fallback != nil {
+				log.Debugf("poster extraction of %s ran out of time, using a black frame", source)
+				break
+			}
+			return nil, err
+		}
+		// seeking past the end yields nothing
+		if frame == nil {
+			break
+		}
+		black, err := isBlack(frame)
+		if err != nil {
+			return nil, err
+		}
+		if !black {
+			return frame, nil
+		}
+		fallback = frame
+	}
+	if fallback != nil {
+		return fallback, nil
+	}
+	frame, err := e.frameAt(ctx, source, demuxer, 0)
+	if err != nil {
+		return nil, err
+	}
+	if frame == nil {
+		return nil, errors.Err("no frame could be extracted from %s", source)
+	}
+	return frame, nil
+}
+
+// frameAt extracts the frame at the given time, returning nil if the video is shorter. The run is bounded by the
+// timeout and by what's left of ctx.
+func (e *Extractor) frameAt(ctx context.Context, source, demuxer string, at time.Duration) ([]byte, error) {
+	if ctx.Err() != nil {
+		return nil, errors.Err("poster extraction of %s exceeded its %s deadline", source, e.cfg.Deadline)
+	}
+	ctx, cancel := context.WithTimeout(ctx, e.cfg.Timeout)
+	defer cancel()
+	args := []string{"-hide_banner", "-loglevel", "error", "-nostdin"}
+	// urls come from clients, so ffmpeg may only follow them over the network, local files are for the CLI
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		args = append(args, "-protocol_whitelist", "http,https,tcp,tls", "-user_agent", downloader.UserAgent)
+	} else {
+		args = append(args, "-protocol_whitelist", "file")
+	}
+	// seeking before the input makes ffmpeg jump straight to the closest keyframe instead of decoding up to it
+	args = append(args,
+		"-ss", fmt.Sprintf("%.3f", at.Seconds()),
+		"-f", demuxer,
+		"-i", source,
+		"-frames:v", "1",
+		"-an", "-sn",
+		"-f", "image2pipe", "-vcodec", "png",
+		"-",
+	)
+	cmd := exec.CommandContext(ctx, e.cfg.FFmpegPath, args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return nil, errors.Err("ffmpeg timed out on %s seeking to %s", source, at)
+	}
+	if err != nil {
+		return nil, errors.Err("ffmpeg failed on %s: %s: %s", source, err, strings.TrimSpace(stderr.String()))
+	}
+	if stdout.Len() == 0 {
+		log.Debugf("no frame at %s in %s", at, source)
+		return nil, nil
+	}
+	return stdout.Bytes(), nil
+}
+
+// blackThreshold is the average luma (out of 255) under which a frame is considered black, fades included
+const blackThreshold = 16
+
+// isBlack reports whether an encoded frame is (nearly) black
+func isBlack(frame []byte) (bool, error) {
+	img, err := png.Decode(bytes.NewReader(frame))
+	if err != nil {
+		return false, errors.Err(err)
+	}
+	return meanLuma(img) < blackThreshold, nil
+}
+
+// meanLuma averages the luma of every 4th pixel in both directions, which is plenty to tell a black frame
+func meanLuma(img image.Image) float64 {
+	b := img.Bounds()
+	var sum float64
+	var n int
+	for y := b.Min.Y; y < b.Max.Y; y += 4 {
+		for x := b.Min.X; x < b.Max.X; x += 4 {
+			r, g, bl, _ := img.At(x, y).RGBA()
+			sum += (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(bl)) / 257
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	return sum / float64(n)
+}
@@ -0,0 +1,158 @@
+package video
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeFFmpeg writes a script standing in for ffmpeg, which outputs frames[-ss] and nothing for other timestamps. It
+// appends its arguments to the args file next to it.
+func fakeFFmpeg(t *testing.T, frames map[string]color.Gray) string {
+	dir := t.TempDir()
+	script := "#!/bin/sh\necho \"$@\" >> " + filepath.Join(dir, "args") + "\nwhile [ $# -gt 0 ]; do if [ \"$1\" = -ss ]; then ss=$2; fi; shift; done\n"
+	for at, c := range frames {
+		img := image.NewGray(image.Rect(0, 0, 16, 9))
+		for i := range img.Pix {
+			img.Pix[i] = c.Y
+		}
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, at+".png")
+		if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		script += "[ \"$ss\" = " + at + " ] && cat " + path + "\n"
+	}
+	script += "exit 0\n"
+	path := filepath.Join(dir, "ffmpeg")
+	if err := os.WriteFile(path, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPosterFrame(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames map[string]color.Gray
+		want   uint8
+	}{
+		{"first frame", map[string]color.Gray{"3.000": {Y: 200}}, 200},
+		{"skips black frames", map[string]color.Gray{"3.000": {Y: 2}, "5.000": {Y: 10}, "7.000": {Y: 120}}, 120},
+		{"all black", map[string]color.Gray{"3.000": {Y: 2}, "5.000": {Y: 3}}, 3},
+		{"shorter than the timestamp", map[string]color.Gray{"0.000": {Y: 80}}, 80},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := NewExtractor(Config{FFmpegPath: fakeFFmpeg(t, tt.frames)})
+			frame, err := e.PosterFrame("clip.mp4", "video/mp4")
+			if err != nil {
+				t.Fatal(err)
+			}
+			img, err := png.Decode(bytes.NewReader(frame))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := img.(*image.Gray).Pix[0]; got != tt.want {
+				t.Errorf("got frame %d, want %d", got, tt.want)
+			}
+		})
+	}
+	e := NewExtractor(Config{FFmpegPath: fakeFFmpeg(t, nil)})
+	if _, err := e.PosterFrame("empty.mp4", "video/mp4"); err == nil {
+		t.Error("expected an error without any frame")
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	dir := t.TempDir()
+	black := image.NewGray(image.Rect(0, 0, 16, 9))
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, black); err != nil {
+		t.Fatal(err)
+	}
+	frame := filepath.Join(dir, "black.png")
+	if err := os.WriteFile(frame, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// each run takes 200ms to output a black frame, from the fourth one on they hang instead
+	runs := filepath.Join(dir, "runs")
+	script := "#!/bin/sh\nruns=$(wc -l < " + runs + " 2>/dev/null || echo 0)\necho x >> " + runs + "\n" +
+		"[ \"$runs\" -ge 3 ] && exec sleep 10\nsleep 0.2\ncat " + frame + "\n"
+	ffmpeg := filepath.Join(dir, "ffmpeg")
+	if err := os.WriteFile(ffmpeg, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	// the attempts run out of time and the black frame found so far is used
+	e := NewExtractor(Config{FFmpegPath: ffmpeg, Attempts: 10, Deadline: 500 * time.Millisecond})
+	start := time.Now()
+	got, err := e.PosterFrame("clip.mp4", "video/mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, buf.Bytes()) {
+		t.Error("got another frame than the black one")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("extraction took %s", elapsed)
+	}
+
+	// without any frame yet, running out of time is an error
+	if err := os.WriteFile(runs, []byte("x\nx\nx\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	e = NewExtractor(Config{FFmpegPath: ffmpeg, Deadline: 300 * time.Millisecond})
+	start = time.Now()
+	if _, err := e.PosterFrame("clip.mp4", "video/mp4"); err == nil {
+		t.Error("expected an error past the deadline")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("extraction took %s", elapsed)
+	}
+}
+
+func TestInputRestrictions(t *testing.T) {
+	ffmpeg := fakeFFmpeg(t, map[string]color.Gray{"3.000": {Y: 200}})
+	e := NewExtractor(Config{FFmpegPath: ffmpeg})
+	argsFile := filepath.Join(filepath.Dir(ffmpeg), "args")
+	tests := []struct {
+		source, mimeType, want string
+	}{
+		{"https://example.com/clip.webm", "video/webm", "-protocol_whitelist http,https,tcp,tls -user_agent"},
+		{"https://example.com/clip.webm", "video/webm", "-f matroska -i https://example.com/clip.webm"},
+		{"clip.mov", "video/quicktime", "-protocol_whitelist file -ss 3.000 -f mov -i clip.mov"},
+	}
+	for _, tt := range tests {
+		_ = os.Remove(argsFile)
+		if _, err := e.PosterFrame(tt.source, tt.mimeType); err != nil {
+			t.Fatal(err)
+		}
+		args, err := os.ReadFile(argsFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(args), tt.want) {
+			t.Errorf("%s: ffmpeg ran with %q, missing %q", tt.source, args, tt.want)
+		}
+	}
+	// playlists and anything else ffmpeg would probe its way into are refused before running it
+	_ = os.Remove(argsFile)
+	for _, mimeType := range []string{"application/vnd.apple.mpegurl", "text/plain", ""} {
+		if _, err := e.PosterFrame("https://example.com/playlist", mimeType); err == nil {
+			t.Errorf("%q was accepted", mimeType)
+		}
+	}
+	if _, err := os.Stat(argsFile); err == nil {
+		t.Error("ffmpeg ran on an unsupported type")
+	}
+}